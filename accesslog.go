@@ -0,0 +1,243 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"gopkg.in/natefinch/lumberjack.v2"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ACCESS_LOG_JSON   = "json"
+	ACCESS_LOG_LOGFMT = "logfmt"
+	ACCESS_LOG_SQUID  = "squid"
+
+	RESULT_OK         = "ok"
+	RESULT_REJECTED   = "rejected"
+	RESULT_DIAL_ERROR = "dial_error"
+	RESULT_ERROR      = "error"
+)
+
+// AccessRecord is the access log entry of a session, written when it ends
+type AccessRecord struct {
+	Time       time.Time     `json:"time"`
+	Client     string        `json:"client"`
+	User       string        `json:"user"`
+	Protocol   string        `json:"protocol"`
+	Command    string        `json:"command"`
+	Target     string        `json:"target"`
+	ResolvedIP string        `json:"resolved_ip"`
+	Route      string        `json:"route"`
+	Rule       string        `json:"rule"`   // router rule choosing Route, empty without router
+	Result     string        `json:"result"` // ok, rejected, dial_error, error or a handshake failure reason
+	Reply      int           `json:"reply"`  // socks reply code or http status sent, -1 for none
+	Duration   time.Duration `json:"-"`
+	BytesIn    int64         `json:"bytes_in"`  // from the client
+	BytesOut   int64         `json:"bytes_out"` // to the client
+}
+
+// AccessLog write one record per session in json lines, logfmt or the
+// squid native format
+type AccessLog struct {
+	mu     sync.Mutex
+	w      io.Writer
+	format string
+}
+
+func NewAccessLog(w io.Writer, format string) (*AccessLog, error) {
+	if format == "" {
+		format = ACCESS_LOG_JSON
+	}
+	if format != ACCESS_LOG_JSON && format != ACCESS_LOG_LOGFMT && format != ACCESS_LOG_SQUID {
+		return nil, errors.New("unknown access log format " + format)
+	}
+	return &AccessLog{w: w, format: format}, nil
+}
+
+// OpenAccessLog write the access log to a file rotated by size, - is stdout
+func OpenAccessLog(cfg AccessLogConfig) (*AccessLog, error) {
+	if cfg.Path == "-" {
+		return NewAccessLog(os.Stdout, cfg.Format)
+	}
+	return NewAccessLog(&lumberjack.Logger{
+		Filename:   cfg.Path,
+		MaxSize:    cfg.MaxSize,
+		MaxBackups: cfg.MaxBackups,
+		MaxAge:     cfg.MaxAge,
+		Compress:   cfg.Compress,
+	}, cfg.Format)
+}
+
+// Log write rec, errors are dropped so serving clients never depends on
+// the log
+func (l *AccessLog) Log(rec *AccessRecord) {
+	var line []byte
+	switch l.format {
+	case ACCESS_LOG_LOGFMT:
+		line = rec.logfmt()
+	case ACCESS_LOG_SQUID:
+		line = rec.squid()
+	default:
+		line, _ = json.Marshal(struct {
+			*AccessRecord
+			DurationMs int64 `json:"duration_ms"`
+		}{rec, rec.Duration.Milliseconds()})
+	}
+	line = append(line, '\n')
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, _ = l.w.Write(line)
+}
+
+func (l *AccessLog) Close() error {
+	if c, ok := l.w.(io.Closer); ok && l.w != os.Stdout {
+		return c.Close()
+	}
+	return nil
+}
+
+func (rec *AccessRecord) logfmt() []byte {
+	var b []byte
+	field := func(key, value string) {
+		if len(b) > 0 {
+			b = append(b, ' ')
+		}
+		b = append(b, key...)
+		b = append(b, '=')
+		if value == "" || strings.ContainsAny(value, " =\"\\") {
+			b = strconv.AppendQuote(b, value)
+		} else {
+			b = append(b, value...)
+		}
+	}
+	field("time", rec.Time.Format(time.RFC3339Nano))
+	field("client", rec.Client)
+	field("user", rec.User)
+	field("protocol", rec.Protocol)
+	field("command", rec.Command)
+	field("target", rec.Target)
+	field("resolved_ip", rec.ResolvedIP)
+	field("route", rec.Route)
+	field("rule", rec.Rule)
+	field("result", rec.Result)
+	field("reply", strconv.Itoa(rec.Reply))
+	field("duration_ms", strconv.FormatInt(rec.Duration.Milliseconds(), 10))
+	field("bytes_in", strconv.FormatInt(rec.BytesIn, 10))
+	field("bytes_out", strconv.FormatInt(rec.BytesOut, 10))
+	return b
+}
+
+/**
+  squid native format, the status of socks sessions is the http status
+  closest to their result:
+
+     time elapsed remotehost code/status bytes method URL rfc931 peerstatus/peerhost type
+*/
+
+func (rec *AccessRecord) squid() []byte {
+	action, status := "TCP_TUNNEL", 200
+	switch {
+	case rec.Protocol == PROTOCOL_HTTP && rec.Reply > 0:
+		status = rec.Reply
+	case rec.Result == HANDSHAKE_AUTH:
+		status = 407
+	case rec.Result == RESULT_REJECTED || rec.Result == HANDSHAKE_PROTOCOL:
+		status = 403
+	case rec.Result == RESULT_DIAL_ERROR:
+		status = 502
+	case rec.Result == HANDSHAKE_TIMEOUT:
+		status = 408
+	case rec.Result != RESULT_OK:
+		status = 400
+	}
+	if rec.Command != COMMAND_CONNECT && rec.Command != COMMAND_BIND && rec.Command != COMMAND_UDP && rec.Command != "" {
+		action = "TCP_MISS"
+	}
+	if status == 403 || status == 407 {
+		action = "TCP_DENIED"
+	} else if rec.Result != RESULT_OK {
+		action = "NONE"
+	}
+	hierarchy := "HIER_NONE/-"
+	if rec.Route == ROUTE_DIRECT && rec.ResolvedIP != "" {
+		hierarchy = "HIER_DIRECT/" + rec.ResolvedIP
+	} else if rec.Route != "" && rec.Result == RESULT_OK {
+		hierarchy = "FIRSTUP_PARENT/" + rec.Route
+	}
+	start := rec.Time.Add(-rec.Duration)
+	return []byte(strconv.FormatInt(start.Unix(), 10) + "." + leftPad(strconv.Itoa(start.Nanosecond()/1e6), 3, '0') +
+		" " + leftPad(strconv.FormatInt(rec.Duration.Milliseconds(), 10), 6, ' ') +
+		" " + hostOnly(rec.Client) +
+		" " + action + "/" + strconv.Itoa(status) +
+		" " + strconv.FormatInt(rec.BytesOut, 10) +
+		" " + orDash(strings.ToUpper(rec.Command)) +
+		" " + orDash(rec.Target) +
+		" " + orDash(rec.User) +
+		" " + hierarchy +
+		" -")
+}
+
+func leftPad(s string, n int, c byte) string {
+	if len(s) >= n {
+		return s
+	}
+	return strings.Repeat(string(c), n-len(s)) + s
+}
+
+func hostOnly(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// logAccess write the access record of a session once it is done
+func (s *SocksServer) logAccess(sess *session, err error) {
+	if s.accessLog == nil {
+		return
+	}
+	target, upstream, rule := sess.route()
+	rec := &AccessRecord{
+		Time:       time.Now(),
+		Client:     sess.conn.RemoteAddr().String(),
+		User:       sess.user,
+		Protocol:   sess.protocol,
+		Command:    sess.command,
+		Target:     target,
+		ResolvedIP: sess.resolved,
+		Route:      upstream,
+		Rule:       rule,
+		Result:     RESULT_OK,
+		Reply:      sess.reply,
+		BytesIn:    sess.bytesUp.Load(),
+		BytesOut:   sess.bytesDown.Load(),
+	}
+	rec.Duration = rec.Time.Sub(sess.start)
+	if err != nil {
+		switch {
+		case !sess.handshaked:
+			rec.Result = handshakeErrorReason(sess, err)
+		case errors.Is(sess.dialErr, errRejected):
+			rec.Result = RESULT_REJECTED
+		case sess.dialErr != nil:
+			rec.Result = RESULT_DIAL_ERROR
+		default:
+			rec.Result = RESULT_ERROR
+		}
+	}
+	s.accessLog.Log(rec)
+}
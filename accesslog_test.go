@@ -0,0 +1,208 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testAccessRecord() *AccessRecord {
+	return &AccessRecord{
+		Time:       time.Date(2026, 1, 2, 3, 4, 5, 678e6, time.UTC),
+		Client:     "192.0.2.1:40000",
+		User:       "alice",
+		Protocol:   PROTOCOL_SOCKS5,
+		Command:    COMMAND_CONNECT,
+		Target:     "example.com:443",
+		ResolvedIP: "93.184.216.34",
+		Route:      ROUTE_DIRECT,
+		Rule:       "DOMAIN-SUFFIX,example.com,DIRECT",
+		Result:     RESULT_OK,
+		Reply:      0,
+		Duration:   1500 * time.Millisecond,
+		BytesIn:    100,
+		BytesOut:   2000,
+	}
+}
+
+func TestAccessLogFormats(t *testing.T) {
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{
+			format: ACCESS_LOG_JSON,
+			want: `{"time":"2026-01-02T03:04:05.678Z","client":"192.0.2.1:40000","user":"alice","protocol":"socks5",` +
+				`"command":"connect","target":"example.com:443","resolved_ip":"93.184.216.34","route":"DIRECT",` +
+				`"rule":"DOMAIN-SUFFIX,example.com,DIRECT","result":"ok",` +
+				`"reply":0,"bytes_in":100,"bytes_out":2000,"duration_ms":1500}`,
+		},
+		{
+			format: ACCESS_LOG_LOGFMT,
+			want: "time=2026-01-02T03:04:05.678Z client=192.0.2.1:40000 user=alice protocol=socks5 command=connect " +
+				"target=example.com:443 resolved_ip=93.184.216.34 route=DIRECT rule=DOMAIN-SUFFIX,example.com,DIRECT result=ok reply=0 duration_ms=1500 " +
+				"bytes_in=100 bytes_out=2000",
+		},
+		{
+			format: ACCESS_LOG_SQUID,
+			want:   "1767323044.178   1500 192.0.2.1 TCP_TUNNEL/200 2000 CONNECT example.com:443 alice HIER_DIRECT/93.184.216.34 -",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			var b bytes.Buffer
+			l, err := NewAccessLog(&b, tt.format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			l.Log(testAccessRecord())
+			if got := b.String(); got != tt.want+"\n" {
+				t.Errorf("got  %s\nwant %s", got, tt.want)
+			}
+		})
+	}
+	if _, err := NewAccessLog(&bytes.Buffer{}, "xml"); err == nil {
+		t.Error("unknown format: no error")
+	}
+}
+
+func TestAccessLogLogfmtQuoting(t *testing.T) {
+	rec := testAccessRecord()
+	rec.User = `a "b"`
+	rec.Command = ""
+	got := string(rec.logfmt())
+	for _, field := range []string{`user="a \"b\""`, `command=""`} {
+		if !strings.Contains(got, field) {
+			t.Errorf("%s missing in %s", field, got)
+		}
+	}
+}
+
+func TestAccessLogSquidStatus(t *testing.T) {
+	tests := []struct {
+		name      string
+		protocol  string
+		command   string
+		result    string
+		reply     int
+		route     string
+		status    string
+		hierarchy string
+	}{
+		{name: "http forward", protocol: PROTOCOL_HTTP, command: "get", result: RESULT_OK, reply: -1, route: "corp", status: "TCP_MISS/200", hierarchy: "FIRSTUP_PARENT/corp"},
+		{name: "http dial error", protocol: PROTOCOL_HTTP, command: COMMAND_CONNECT, result: RESULT_DIAL_ERROR, reply: 502, route: ROUTE_DIRECT, status: "NONE/502", hierarchy: "HIER_NONE/-"},
+		{name: "http rejected", protocol: PROTOCOL_HTTP, command: COMMAND_CONNECT, result: RESULT_REJECTED, reply: 403, route: ROUTE_REJECT, status: "TCP_DENIED/403", hierarchy: "HIER_NONE/-"},
+		{name: "http auth", protocol: PROTOCOL_HTTP, result: HANDSHAKE_AUTH, reply: 407, status: "TCP_DENIED/407", hierarchy: "HIER_NONE/-"},
+		{name: "socks auth", protocol: PROTOCOL_SOCKS5, result: HANDSHAKE_AUTH, reply: -1, status: "TCP_DENIED/407", hierarchy: "HIER_NONE/-"},
+		{name: "socks rejected", protocol: PROTOCOL_SOCKS5, command: COMMAND_CONNECT, result: RESULT_REJECTED, reply: 2, status: "TCP_DENIED/403", hierarchy: "HIER_NONE/-"},
+		{name: "protocol disabled", protocol: PROTOCOL_SOCKS4, result: HANDSHAKE_PROTOCOL, reply: -1, status: "TCP_DENIED/403", hierarchy: "HIER_NONE/-"},
+		{name: "socks dial error", protocol: PROTOCOL_SOCKS4, command: COMMAND_CONNECT, result: RESULT_DIAL_ERROR, reply: 0x5B, route: "corp", status: "NONE/502", hierarchy: "HIER_NONE/-"},
+		{name: "timeout", protocol: PROTOCOL_SOCKS5, result: HANDSHAKE_TIMEOUT, reply: -1, status: "NONE/408", hierarchy: "HIER_NONE/-"},
+		{name: "bad request", protocol: PROTOCOL_SOCKS5, result: HANDSHAKE_BAD_REQUEST, reply: -1, status: "NONE/400", hierarchy: "HIER_NONE/-"},
+		{name: "udp", protocol: PROTOCOL_SOCKS5, command: COMMAND_UDP, result: RESULT_OK, route: ROUTE_DIRECT, status: "TCP_TUNNEL/200", hierarchy: "FIRSTUP_PARENT/DIRECT"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := testAccessRecord()
+			rec.Protocol, rec.Command, rec.Result, rec.Reply, rec.Route, rec.ResolvedIP = tt.protocol, tt.command, tt.result, tt.reply, tt.route, ""
+			fields := strings.Fields(string(rec.squid()))
+			if len(fields) != 10 {
+				t.Fatalf("%d fields in %q, want 10", len(fields), rec.squid())
+			}
+			if fields[3] != tt.status || fields[8] != tt.hierarchy {
+				t.Errorf("got %s %s, want %s %s", fields[3], fields[8], tt.status, tt.hierarchy)
+			}
+		})
+	}
+}
+
+// lockedBuffer is a bytes.Buffer read while sessions write to it
+type lockedBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.String()
+}
+
+func TestAccessLogSessions(t *testing.T) {
+	echo := newEchoServer(t)
+	s := NewSocksServer("127.0.0.1", 0)
+	s.SetDialer(NewDirectDialer())
+	s.SetAuthenticator(StaticAuthenticator{"alice": "a"})
+	router := NewRouter()
+	err := router.AddRule("DOMAIN,blocked.test,REJECT")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetRouter(router)
+	var out lockedBuffer
+	accessLog, err := NewAccessLog(&out, ACCESS_LOG_JSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetAccessLog(accessLog)
+	startServer(t, s)
+	addr := s.ln.Addr().String()
+	closed, _ := net.ResolveTCPAddr("tcp", freePort(t))
+	auth := append([]byte{5, 1, METHOD_USER_PASS}, userPass("alice", "a")...)
+
+	con := proxyExchange(t, addr, append(auth, socks5Request(CMD_CONNECT, echo)...), []byte{5, METHOD_USER_PASS, 1, 0, 5, 0})
+	_ = con.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = con.Read(make([]byte, 8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectEcho(t, con)
+	_ = con.Close()
+	proxyExchange(t, addr, append(auth, socks5Request(CMD_CONNECT, closed)...), []byte{5, METHOD_USER_PASS, 1, 0, 5, 5})
+	proxyExchange(t, addr, []byte("CONNECT blocked.test:80 HTTP/1.1\r\nProxy-Authorization: Basic YWxpY2U6YQ==\r\n\r\n"), []byte("HTTP/1.1 403 "))
+	expectClosed(t, proxyExchange(t, addr, append([]byte{5, 1, METHOD_USER_PASS}, userPass("alice", "b")...), []byte{5, METHOD_USER_PASS, 1, 1}))
+
+	// the sessions log their record before they end
+	waitSessions(t, s)
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("%d records, want one per session:\n%s", len(lines), out.String())
+	}
+	want := map[string]AccessRecord{
+		RESULT_OK:         {User: "alice", Protocol: PROTOCOL_SOCKS5, Command: COMMAND_CONNECT, Target: echo.String(), ResolvedIP: "127.0.0.1", Route: ROUTE_DEFAULT, Rule: "none", Reply: 0, BytesIn: 4, BytesOut: 4},
+		RESULT_DIAL_ERROR: {User: "alice", Protocol: PROTOCOL_SOCKS5, Command: COMMAND_CONNECT, Target: closed.String(), Route: ROUTE_DEFAULT, Rule: "none", Reply: 5},
+		RESULT_REJECTED:   {User: "alice", Protocol: PROTOCOL_HTTP, Command: "connect", Target: "blocked.test:80", Route: ROUTE_REJECT, Rule: "DOMAIN,blocked.test,REJECT", Reply: 403},
+		HANDSHAKE_AUTH:    {Protocol: PROTOCOL_SOCKS5, Reply: -1},
+	}
+	for _, line := range lines {
+		var rec AccessRecord
+		err := json.Unmarshal([]byte(line), &rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w, ok := want[rec.Result]
+		if !ok {
+			t.Errorf("unexpected record %s", line)
+			continue
+		}
+		delete(want, rec.Result)
+		if rec.User != w.User || rec.Protocol != w.Protocol || rec.Command != w.Command || rec.Target != w.Target ||
+			rec.ResolvedIP != w.ResolvedIP || rec.Route != w.Route || rec.Rule != w.Rule || rec.Reply != w.Reply || rec.BytesIn != w.BytesIn ||
+			rec.BytesOut != w.BytesOut || rec.Time.IsZero() {
+			t.Errorf("%s record %s", rec.Result, line)
+		}
+	}
+	for result := range want {
+		t.Errorf("no %s record", result)
+	}
+}
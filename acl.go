@@ -0,0 +1,147 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var metricDenied = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "mixed_socks",
+	Name:      "denied_total",
+	Help:      "Client connections and udp datagrams refused by the listener access list.",
+}, []string{"listener", "network"})
+
+func init() {
+	metricsRegistry.MustRegister(metricDenied)
+}
+
+// AccessConfig is the client access list of a listener, the lists are
+// ips or cidrs and the files hold one per line with # comments
+type AccessConfig struct {
+	Allow     []string `yaml:"allow"` // when set only these clients are served
+	Deny      []string `yaml:"deny"`  // refused even when allowed
+	AllowFile string   `yaml:"allow_file"`
+	DenyFile  string   `yaml:"deny_file"`
+}
+
+// AccessList decide which clients a listener serves, deny wins over allow
+type AccessList struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// NewAccessList build the access list of cfg, reading its files
+func NewAccessList(cfg AccessConfig) (*AccessList, error) {
+	allow, deny := cfg.Allow, cfg.Deny
+	if cfg.AllowFile != "" {
+		lines, err := readCIDRFile(cfg.AllowFile)
+		if err != nil {
+			return nil, err
+		}
+		allow = append(append([]string{}, allow...), lines...)
+	}
+	if cfg.DenyFile != "" {
+		lines, err := readCIDRFile(cfg.DenyFile)
+		if err != nil {
+			return nil, err
+		}
+		deny = append(append([]string{}, deny...), lines...)
+	}
+	a := &AccessList{}
+	var err error
+	a.allow, err = parseCIDRs(allow)
+	if err != nil {
+		return nil, err
+	}
+	a.deny, err = parseCIDRs(deny)
+	if err != nil {
+		return nil, err
+	}
+	// an allow file left empty serves nobody rather than everybody
+	if cfg.AllowFile != "" && a.allow == nil {
+		a.allow = []*net.IPNet{}
+	}
+	return a, nil
+}
+
+// Allowed tell if the client ip may use the listener, a nil list allows
+// everyone
+func (a *AccessList) Allowed(ip net.IP) bool {
+	if a == nil {
+		return true
+	}
+	if ip == nil {
+		return false
+	}
+	if containsIP(a.deny, ip) {
+		return false
+	}
+	return a.allow == nil || containsIP(a.allow, ip)
+}
+
+// parseCIDRs parse cidrs and single ips, nil for an empty list
+func parseCIDRs(values []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, value := range values {
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, errors.New("bad ip " + value)
+			}
+			bits := 128
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, errors.New("bad cidr " + value)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func readCIDRFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func(f *os.File) {
+		_ = f.Close()
+	}(f)
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if _, err := parseCIDRs([]string{line}); err != nil {
+			return nil, errors.New(path + ":" + strconv.Itoa(lineNo) + " " + err.Error())
+		}
+		lines = append(lines, line)
+	}
+	return lines, scanner.Err()
+}
+
+// allowClient check a client against the access list of the listener,
+// refused clients are counted
+func (s *SocksServer) allowClient(network string, addr net.Addr) bool {
+	st := s.settings.Load()
+	if st.access.Allowed(addrIP(addr)) {
+		return true
+	}
+	metricDenied.WithLabelValues(st.name, network).Inc()
+	return false
+}
@@ -0,0 +1,134 @@
+package proxy
+
+import (
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAccessList(t *testing.T) {
+	dir := t.TempDir()
+	allowFile := filepath.Join(dir, "allow.txt")
+	err := os.WriteFile(allowFile, []byte("# office\n10.1.0.0/16\n\n192.0.2.7 # vpn\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	emptyFile := filepath.Join(dir, "empty.txt")
+	err = os.WriteFile(emptyFile, []byte("# nobody yet\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		cfg     AccessConfig
+		allowed []string
+		denied  []string
+	}{
+		{name: "empty", allowed: []string{"127.0.0.1", "::1", "203.0.113.9"}},
+		{name: "allow", cfg: AccessConfig{Allow: []string{"10.0.0.0/8", "2001:db8::/32"}}, allowed: []string{"10.2.3.4", "2001:db8::1"}, denied: []string{"11.0.0.1", "2001:db9::1"}},
+		{name: "deny", cfg: AccessConfig{Deny: []string{"203.0.113.0/24", "::1"}}, allowed: []string{"127.0.0.1", "203.0.114.1"}, denied: []string{"203.0.113.9", "::1"}},
+		{name: "deny wins", cfg: AccessConfig{Allow: []string{"10.0.0.0/8"}, Deny: []string{"10.0.0.1"}}, allowed: []string{"10.0.0.2"}, denied: []string{"10.0.0.1"}},
+		{name: "mapped ipv4", cfg: AccessConfig{Allow: []string{"127.0.0.1"}}, allowed: []string{"::ffff:127.0.0.1"}, denied: []string{"::1"}},
+		{name: "allow file", cfg: AccessConfig{Allow: []string{"127.0.0.1"}, AllowFile: allowFile}, allowed: []string{"127.0.0.1", "10.1.2.3", "192.0.2.7"}, denied: []string{"10.2.0.1", "192.0.2.8"}},
+		{name: "deny file", cfg: AccessConfig{DenyFile: allowFile}, allowed: []string{"127.0.0.1"}, denied: []string{"10.1.2.3"}},
+		{name: "empty allow file", cfg: AccessConfig{AllowFile: emptyFile}, denied: []string{"127.0.0.1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, err := NewAccessList(tt.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, ip := range tt.allowed {
+				if !a.Allowed(net.ParseIP(ip)) {
+					t.Errorf("%s denied", ip)
+				}
+			}
+			for _, ip := range tt.denied {
+				if a.Allowed(net.ParseIP(ip)) {
+					t.Errorf("%s allowed", ip)
+				}
+			}
+		})
+	}
+	if !(*AccessList)(nil).Allowed(net.ParseIP("127.0.0.1")) {
+		t.Error("nil access list denied a client")
+	}
+}
+
+func TestAccessListErrors(t *testing.T) {
+	dir := t.TempDir()
+	badFile := filepath.Join(dir, "bad.txt")
+	err := os.WriteFile(badFile, []byte("10.0.0.0/8\nexample.com\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		cfg  AccessConfig
+	}{
+		{name: "bad ip", cfg: AccessConfig{Allow: []string{"10.0.0.256"}}},
+		{name: "bad cidr", cfg: AccessConfig{Deny: []string{"10.0.0.0/33"}}},
+		{name: "bad line", cfg: AccessConfig{AllowFile: badFile}},
+		{name: "missing file", cfg: AccessConfig{DenyFile: filepath.Join(dir, "missing.txt")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewAccessList(tt.cfg); err == nil {
+				t.Error("no error")
+			}
+		})
+	}
+}
+
+func TestAccessListServer(t *testing.T) {
+	echo := newUdpEchoServer(t)
+	s := newTestServer(t)
+	s.update(func(st *serverSettings) {
+		st.name = "acl"
+	})
+	addr := s.ln.Addr().String()
+	denied := func(network string) float64 {
+		return testutil.ToFloat64(metricDenied.WithLabelValues("acl", network))
+	}
+	tcpBefore, udpBefore := denied("tcp"), denied("udp")
+
+	control := udpAssociate(t, addr)
+	defer control.Close()
+	client, err := net.DialUDP("udp", nil, s.udpServer.udpAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if got := udpRoundTrip(t, client, echo, []byte("ping"), 2*time.Second); string(got) != "ping" {
+		t.Fatalf("relayed %q, want ping", got)
+	}
+
+	access, err := NewAccessList(AccessConfig{Deny: []string{"127.0.0.0/8"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetAccessList(access)
+	if got := udpRoundTrip(t, client, echo, []byte("denied"), 200*time.Millisecond); got != nil {
+		t.Errorf("relayed %q for a denied client", got)
+	}
+	con, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer con.Close()
+	expectClosed(t, con)
+	expectMetric(t, "denied tcp", denied("tcp")-tcpBefore, 1)
+
+	// a reloaded list serves the client again
+	s.SetAccessList(nil)
+	if got := udpRoundTrip(t, client, echo, []byte("again"), 2*time.Second); string(got) != "again" {
+		t.Errorf("relayed %q, want again", got)
+	}
+	// the relay reads the datagrams in order, the denied one was counted
+	// before the one answered
+	expectMetric(t, "denied udp", denied("udp")-udpBefore, 1)
+}
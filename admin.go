@@ -0,0 +1,196 @@
+package proxy
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+/**
+  The admin api list and close the live connections of a Registry:
+
+     GET    /connections               every relay and udp association
+     GET    /connections?user=alice    the ones of a user, or ?ip=10.0.0.5
+     DELETE /connections/42            close the connection with id 42
+     DELETE /connections?user=alice    close every connection of a user
+     DELETE /connections?ip=10.0.0.5   close every connection of a client ip
+     GET    /bandwidth                 the global, user and cidr limits
+     PUT    /bandwidth                 replace them, live connections follow
+     GET    /quotas                    traffic of every user this day and month
+     DELETE /quotas/alice              clear the traffic of a user
+     POST   /reload                    read the config again and apply it, like SIGHUP
+
+  The limits set with PUT last until the config is reloaded, the body is
+  the bandwidth section of the config in json, rates in bytes per second
+  or strings like "512K":
+
+     {"global": {"down": "10M"}, "users": {"ci": {"up": "1M", "down": "2M"}}}
+
+  When a token is set requests need the header Authorization: Bearer token.
+*/
+
+// AdminHandler serve the admin api for registry, shaper and quotas, reload
+// applies the config again. shaper, quotas and reload may be nil
+func AdminHandler(registry *Registry, shaper *Shaper, quotas *Quotas, reload func() error, token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/connections", func(w http.ResponseWriter, r *http.Request) {
+		handleConnections(registry, w, r)
+	})
+	mux.HandleFunc("/connections/", func(w http.ResponseWriter, r *http.Request) {
+		handleConnection(registry, w, r)
+	})
+	if shaper != nil {
+		mux.HandleFunc("/bandwidth", func(w http.ResponseWriter, r *http.Request) {
+			handleBandwidth(shaper, w, r)
+		})
+	}
+	if quotas != nil {
+		mux.HandleFunc("/quotas", func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodGet {
+				writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+				return
+			}
+			writeJSON(w, http.StatusOK, quotas.Status())
+		})
+		mux.HandleFunc("/quotas/", func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodDelete {
+				writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+				return
+			}
+			user := strings.TrimPrefix(r.URL.Path, "/quotas/")
+			quotas.Reset(user)
+			writeJSON(w, http.StatusOK, map[string]string{"reset": user})
+		})
+	}
+	if reload != nil {
+		mux.HandleFunc("/reload", func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+				return
+			}
+			err := reload()
+			if err != nil {
+				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]bool{"reloaded": true})
+		})
+	}
+	if token == "" {
+		return mux
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// serveAdmin serve the admin api on addr until ctx is done
+func serveAdmin(ctx context.Context, addr string, registry *Registry, shaper *Shaper, quotas *Quotas, reload func() error, token string) error {
+	return serveHTTP(ctx, "admin", addr, AdminHandler(registry, shaper, quotas, reload, token))
+}
+
+func handleConnections(registry *Registry, w http.ResponseWriter, r *http.Request) {
+	user, hasUser := r.URL.Query()["user"]
+	ipStr := r.URL.Query().Get("ip")
+	var ip net.IP
+	if ipStr != "" {
+		ip = net.ParseIP(ipStr)
+		if ip == nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "bad ip " + ipStr})
+			return
+		}
+	}
+	switch r.Method {
+	case http.MethodGet:
+		infos := make([]ConnInfo, 0)
+		for _, info := range registry.List() {
+			if hasUser && info.User != user[0] {
+				continue
+			}
+			if ip != nil {
+				host, _, _ := net.SplitHostPort(info.Client)
+				if !ip.Equal(net.ParseIP(host)) {
+					continue
+				}
+			}
+			infos = append(infos, info)
+		}
+		writeJSON(w, http.StatusOK, infos)
+	case http.MethodDelete:
+		closed := 0
+		if hasUser {
+			closed = registry.CloseUser(user[0])
+		} else if ip != nil {
+			closed = registry.CloseIP(ip)
+		} else {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "user or ip required"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]int{"closed": closed})
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+	}
+}
+
+func handleConnection(registry *Registry, w http.ResponseWriter, r *http.Request) {
+	idStr := strings.TrimPrefix(r.URL.Path, "/connections/")
+	id, err := strconv.ParseUint(idStr, 10, 64)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "bad id " + idStr})
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		for _, info := range registry.List() {
+			if info.ID == id {
+				writeJSON(w, http.StatusOK, info)
+				return
+			}
+		}
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "no connection " + idStr})
+	case http.MethodDelete:
+		if !registry.Close(id) {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "no connection " + idStr})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]int{"closed": 1})
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+	}
+}
+
+func handleBandwidth(shaper *Shaper, w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, shaper.Config())
+	case http.MethodPut:
+		var cfg BandwidthConfig
+		err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&cfg)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "bad bandwidth config:" + err.Error()})
+			return
+		}
+		err = shaper.Update(cfg)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, shaper.Config())
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,171 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestAdminReload(t *testing.T) {
+	reloads := 0
+	var reloadErr error
+	reload := func() error {
+		reloads++
+		return reloadErr
+	}
+	tests := []struct {
+		name    string
+		reload  func() error
+		method  string
+		auth    string
+		err     error
+		status  int
+		reloads int
+	}{
+		{name: "reload", reload: reload, method: http.MethodPost, auth: "Bearer secret", status: http.StatusOK, reloads: 1},
+		{name: "reload error", reload: reload, method: http.MethodPost, auth: "Bearer secret", err: errors.New("bad config"), status: http.StatusInternalServerError, reloads: 1},
+		{name: "get", reload: reload, method: http.MethodGet, auth: "Bearer secret", status: http.StatusMethodNotAllowed},
+		{name: "no token", reload: reload, method: http.MethodPost, status: http.StatusUnauthorized},
+		{name: "wrong token", reload: reload, method: http.MethodPost, auth: "Bearer guess", status: http.StatusUnauthorized},
+		{name: "no reloader", method: http.MethodPost, auth: "Bearer secret", status: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reloads, reloadErr = 0, tt.err
+			handler := AdminHandler(NewRegistry(), nil, nil, tt.reload, "secret")
+			req := httptest.NewRequest(tt.method, "/reload", nil)
+			if tt.auth != "" {
+				req.Header.Set("Authorization", tt.auth)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			if w.Code != tt.status {
+				t.Errorf("status %d, want %d: %s", w.Code, tt.status, w.Body.String())
+			}
+			if reloads != tt.reloads {
+				t.Errorf("%d reloads, want %d", reloads, tt.reloads)
+			}
+		})
+	}
+}
+
+// adminRequest serve one request of the admin api and decode its json
+// answer into v
+func adminRequest(t *testing.T, handler http.Handler, method, target string, v interface{}) int {
+	t.Helper()
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(method, target, nil))
+	if v != nil {
+		err := json.Unmarshal(w.Body.Bytes(), v)
+		if err != nil {
+			t.Fatalf("%s %s: %v: %s", method, target, err, w.Body.String())
+		}
+	}
+	return w.Code
+}
+
+func TestAdminConnections(t *testing.T) {
+	echo := newEchoServer(t)
+	s := newTestServer(t)
+	s.SetAuthenticator(StaticAuthenticator{"alice": "a", "bob": "b"})
+	addr := s.ln.Addr().String()
+	relay := func(user, pass string) net.Conn {
+		request := append(append([]byte{5, 1, METHOD_USER_PASS}, userPass(user, pass)...), socks5Request(CMD_CONNECT, echo)...)
+		con := proxyExchange(t, addr, request, []byte{5, METHOD_USER_PASS, 1, 0, 5, 0})
+		_, err := io.ReadFull(con, make([]byte, 8))
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectEcho(t, con)
+		return con
+	}
+	alice1, alice2, bob := relay("alice", "a"), relay("alice", "a"), relay("bob", "b")
+	handler := AdminHandler(s.registry, nil, nil, nil, "")
+
+	var infos []ConnInfo
+	if status := adminRequest(t, handler, http.MethodGet, "/connections", &infos); status != http.StatusOK || len(infos) != 3 {
+		t.Fatalf("status %d, %d connections, want 3", status, len(infos))
+	}
+	info := infos[2]
+	if info.User != "bob" || info.Protocol != PROTOCOL_SOCKS5 || info.Command != "connect" || info.Destination != echo.String() ||
+		info.Upstream != ROUTE_DEFAULT || info.Client != bob.LocalAddr().String() || info.BytesUp != 4 || info.BytesDown != 4 || info.Start.IsZero() {
+		t.Errorf("bob connection %+v", info)
+	}
+	filters := []struct {
+		query string
+		want  int
+	}{
+		{query: "?user=alice", want: 2},
+		{query: "?user=carol", want: 0},
+		{query: "?user=", want: 0},
+		{query: "?ip=127.0.0.1", want: 3},
+		{query: "?ip=10.0.0.1", want: 0},
+	}
+	for _, f := range filters {
+		infos = nil
+		if status := adminRequest(t, handler, http.MethodGet, "/connections"+f.query, &infos); status != http.StatusOK || len(infos) != f.want {
+			t.Errorf("%s: status %d, %d connections, want %d", f.query, status, len(infos), f.want)
+		}
+	}
+
+	var one ConnInfo
+	if status := adminRequest(t, handler, http.MethodGet, "/connections/"+strconv.FormatUint(info.ID, 10), &one); status != http.StatusOK || one.ID != info.ID {
+		t.Errorf("status %d connection %+v, want %d", status, one, info.ID)
+	}
+	errorStatus := []struct {
+		method, target string
+		want           int
+	}{
+		{method: http.MethodGet, target: "/connections?ip=nowhere", want: http.StatusBadRequest},
+		{method: http.MethodGet, target: "/connections/x", want: http.StatusBadRequest},
+		{method: http.MethodGet, target: "/connections/999999", want: http.StatusNotFound},
+		{method: http.MethodDelete, target: "/connections/999999", want: http.StatusNotFound},
+		{method: http.MethodDelete, target: "/connections", want: http.StatusBadRequest},
+		{method: http.MethodPost, target: "/connections", want: http.StatusMethodNotAllowed},
+		{method: http.MethodPut, target: "/connections/1", want: http.StatusMethodNotAllowed},
+	}
+	for _, e := range errorStatus {
+		var body map[string]string
+		if status := adminRequest(t, handler, e.method, e.target, &body); status != e.want || body["error"] == "" {
+			t.Errorf("%s %s: status %d %v, want %d", e.method, e.target, status, body, e.want)
+		}
+	}
+
+	var closed map[string]int
+	if status := adminRequest(t, handler, http.MethodDelete, "/connections/"+strconv.FormatUint(info.ID, 10), &closed); status != http.StatusOK || closed["closed"] != 1 {
+		t.Errorf("status %d %v, want bob closed", status, closed)
+	}
+	expectClosed(t, bob)
+	expectEcho(t, alice1)
+	if status := adminRequest(t, handler, http.MethodDelete, "/connections?user=alice", &closed); status != http.StatusOK || closed["closed"] != 2 {
+		t.Errorf("status %d %v, want 2 closed", status, closed)
+	}
+	expectClosed(t, alice1)
+	expectClosed(t, alice2)
+	waitSessions(t, s)
+	if status := adminRequest(t, handler, http.MethodDelete, "/connections?ip=127.0.0.1", &closed); status != http.StatusOK || closed["closed"] != 0 {
+		t.Errorf("status %d %v, want none left", status, closed)
+	}
+}
+
+func TestAdminUdpAssociation(t *testing.T) {
+	s := newTestServer(t)
+	control := udpAssociate(t, s.ln.Addr().String())
+	handler := AdminHandler(s.registry, nil, nil, nil, "")
+	var infos []ConnInfo
+	adminRequest(t, handler, http.MethodGet, "/connections", &infos)
+	if len(infos) != 1 || infos[0].Command != "udp" {
+		t.Fatalf("connections %+v, want the association", infos)
+	}
+	var closed map[string]int
+	adminRequest(t, handler, http.MethodDelete, "/connections?ip=127.0.0.1", &closed)
+	if closed["closed"] != 1 {
+		t.Errorf("%v, want the association closed", closed)
+	}
+	expectClosed(t, control)
+}
@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"errors"
+	"golang.org/x/crypto/bcrypt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	PROTOCOL_SOCKS4 = "socks4"
+	PROTOCOL_SOCKS5 = "socks5"
+	PROTOCOL_HTTP   = "http"
+)
+
+var ErrAuthFailed = errors.New("authentication failed")
+
+// AuthRequest is the identity presented by a client
+type AuthRequest struct {
+	Protocol   string // socks4, socks5 or http
+	ClientAddr net.Addr
+	Username   string // socks5 UNAME, http basic user or the user part of a socks4 USERID
+	Password   string // socks5 PASSWD, http basic password or the password part of a socks4 USERID
+	UserID     string // raw socks4 USERID
+	Header     string // raw http Proxy-Authorization header
+}
+
+// Authenticator decide whether a client is allowed to use the proxy,
+// it returns the authenticated principal or an error to reject the client
+type Authenticator interface {
+	Authenticate(req *AuthRequest) (string, error)
+}
+
+// AuthenticatorFunc adapt a callback to an Authenticator
+type AuthenticatorFunc func(req *AuthRequest) (string, error)
+
+func (f AuthenticatorFunc) Authenticate(req *AuthRequest) (string, error) {
+	return f(req)
+}
+
+// StaticAuthenticator check the credentials against a username -> password map
+type StaticAuthenticator map[string]string
+
+func (a StaticAuthenticator) Authenticate(req *AuthRequest) (string, error) {
+	expected, ok := a[req.Username]
+	if !ok || req.Username == "" {
+		return "", ErrAuthFailed
+	}
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(req.Password)) != 1 {
+		return "", ErrAuthFailed
+	}
+	return req.Username, nil
+}
+
+// HtpasswdAuthenticator check the credentials against an apache htpasswd file,
+// only bcrypt hashes (htpasswd -B) are accepted
+type HtpasswdAuthenticator struct {
+	path  string
+	mu    sync.RWMutex
+	users map[string][]byte
+}
+
+func NewHtpasswdAuthenticator(path string) (*HtpasswdAuthenticator, error) {
+	a := &HtpasswdAuthenticator{path: path}
+	err := a.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Reload read the htpasswd file again
+func (a *HtpasswdAuthenticator) Reload() error {
+	f, err := os.Open(a.path)
+	if err != nil {
+		return err
+	}
+	defer func(f *os.File) {
+		_ = f.Close()
+	}(f)
+	users := make(map[string][]byte)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		username, hash, ok := strings.Cut(line, ":")
+		if !ok {
+			return errors.New("bad htpasswd line: " + line)
+		}
+		if !strings.HasPrefix(hash, "$2a$") && !strings.HasPrefix(hash, "$2b$") && !strings.HasPrefix(hash, "$2y$") {
+			return errors.New("unsupported htpasswd hash for user " + username + ", use bcrypt")
+		}
+		users[username] = []byte(hash)
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+	a.mu.Lock()
+	a.users = users
+	a.mu.Unlock()
+	return nil
+}
+
+func (a *HtpasswdAuthenticator) Authenticate(req *AuthRequest) (string, error) {
+	a.mu.RLock()
+	hash, ok := a.users[req.Username]
+	a.mu.RUnlock()
+	if !ok || req.Username == "" {
+		return "", ErrAuthFailed
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(req.Password)) != nil {
+		return "", ErrAuthFailed
+	}
+	return req.Username, nil
+}
+
+// authenticate run the configured Authenticator, every client is accepted
+// as an anonymous principal when there is none
+func (s *SocksServer) authenticate(sess *session, req *AuthRequest) error {
+	authenticator := sess.settings.authenticator
+	if authenticator == nil {
+		return nil
+	}
+	req.Protocol = sess.protocol
+	req.ClientAddr = sess.conn.RemoteAddr()
+	user, err := authenticator.Authenticate(req)
+	if err != nil {
+		return err
+	}
+	sess.user = user
+	return nil
+}
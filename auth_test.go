@@ -0,0 +1,192 @@
+package proxy
+
+import (
+	"errors"
+	"golang.org/x/crypto/bcrypt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestStaticAuthenticator(t *testing.T) {
+	a := StaticAuthenticator{"bob": "pw", "alice": ""}
+	tests := []struct {
+		username string
+		password string
+		user     string
+		err      error
+	}{
+		{username: "bob", password: "pw", user: "bob"},
+		{username: "bob", password: "PW", err: ErrAuthFailed},
+		{username: "bob", password: "", err: ErrAuthFailed},
+		{username: "eve", password: "pw", err: ErrAuthFailed},
+		{username: "alice", password: "", user: "alice"},
+		{username: "", password: "", err: ErrAuthFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.username+":"+tt.password, func(t *testing.T) {
+			user, err := a.Authenticate(&AuthRequest{Username: tt.username, Password: tt.password})
+			if user != tt.user || !errors.Is(err, tt.err) {
+				t.Errorf("got %q %v, want %q %v", user, err, tt.user, tt.err)
+			}
+		})
+	}
+}
+
+// writeHtpasswd write an htpasswd file of bcrypt hashes in a test directory
+func writeHtpasswd(t *testing.T, users map[string]string, extra string) string {
+	t.Helper()
+	var content strings.Builder
+	content.WriteString("# users\n\n")
+	for user, password := range users {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		content.WriteString(user + ":" + string(hash) + "\n")
+	}
+	content.WriteString(extra)
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	err := os.WriteFile(path, []byte(content.String()), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestHtpasswdAuthenticator(t *testing.T) {
+	path := writeHtpasswd(t, map[string]string{"bob": "pw", "carol": "secret"}, "")
+	a, err := NewHtpasswdAuthenticator(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		username string
+		password string
+		user     string
+		err      error
+	}{
+		{username: "bob", password: "pw", user: "bob"},
+		{username: "carol", password: "secret", user: "carol"},
+		{username: "bob", password: "secret", err: ErrAuthFailed},
+		{username: "eve", password: "pw", err: ErrAuthFailed},
+		{username: "", password: "", err: ErrAuthFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.username+":"+tt.password, func(t *testing.T) {
+			user, err := a.Authenticate(&AuthRequest{Username: tt.username, Password: tt.password})
+			if user != tt.user || !errors.Is(err, tt.err) {
+				t.Errorf("got %q %v, want %q %v", user, err, tt.user, tt.err)
+			}
+		})
+	}
+
+	// Reload pick up a rewritten file
+	err = os.WriteFile(path, []byte{}, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = a.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = a.Authenticate(&AuthRequest{Username: "bob", Password: "pw"}); !errors.Is(err, ErrAuthFailed) {
+		t.Errorf("removed user after reload: %v", err)
+	}
+}
+
+func TestHtpasswdAuthenticatorErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		extra string
+	}{
+		{name: "md5 hash", extra: "eve:$apr1$salt$hash\n"},
+		{name: "sha1 hash", extra: "eve:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n"},
+		{name: "plain text", extra: "eve:password\n"},
+		{name: "no colon", extra: "eve\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewHtpasswdAuthenticator(writeHtpasswd(t, map[string]string{"bob": "pw"}, tt.extra))
+			if err == nil {
+				t.Error("no error")
+			}
+		})
+	}
+	_, err := NewHtpasswdAuthenticator(filepath.Join(t.TempDir(), "missing"))
+	if err == nil {
+		t.Error("missing file: no error")
+	}
+}
+
+// TestAuthenticatorProtocols check every protocol hands its credentials
+// to the same Authenticator, which picks the principal of the session
+func TestAuthenticatorProtocols(t *testing.T) {
+	echo := newEchoServer(t)
+	var mu sync.Mutex
+	var requests []AuthRequest
+	s := newTestServer(t)
+	s.SetAuthenticator(AuthenticatorFunc(func(req *AuthRequest) (string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if req.ClientAddr == nil || !req.ClientAddr.(*net.TCPAddr).IP.IsLoopback() {
+			t.Errorf("client addr %v", req.ClientAddr)
+		}
+		r := *req
+		r.ClientAddr = nil
+		requests = append(requests, r)
+		if req.Password != "pw" {
+			return "", ErrAuthFailed
+		}
+		return "principal-" + req.Username, nil
+	}))
+	port := []byte{byte(echo.Port >> 8), byte(echo.Port)}
+	tests := []struct {
+		name    string
+		request []byte
+		want    []byte
+		auth    AuthRequest
+	}{
+		{
+			name:    "socks5",
+			request: append(append([]byte{5, 1, METHOD_USER_PASS}, userPass("bob", "pw")...), socks5Request(CMD_CONNECT, echo)...),
+			want:    []byte{5, METHOD_USER_PASS, 1, 0, 5, 0},
+			auth:    AuthRequest{Protocol: PROTOCOL_SOCKS5, Username: "bob", Password: "pw"},
+		},
+		{
+			name:    "socks4 user password",
+			request: append(append([]byte{4, CMD_CONNECT}, append(port, 127, 0, 0, 1)...), "bob:pw\x00"...),
+			want:    []byte{0, 0x5A},
+			auth:    AuthRequest{Protocol: PROTOCOL_SOCKS4, Username: "bob", Password: "pw", UserID: "bob:pw"},
+		},
+		{
+			name:    "socks4 refused",
+			request: append(append([]byte{4, CMD_CONNECT}, append(port, 127, 0, 0, 1)...), "bob\x00"...),
+			want:    []byte{0, 0x5D},
+			auth:    AuthRequest{Protocol: PROTOCOL_SOCKS4, Username: "bob", UserID: "bob"},
+		},
+		{
+			name:    "http",
+			request: []byte("CONNECT " + echo.String() + " HTTP/1.1\r\nProxy-Authorization: Basic Ym9iOnB3\r\n\r\n"),
+			want:    []byte("HTTP/1.1 200 "),
+			auth:    AuthRequest{Protocol: PROTOCOL_HTTP, Username: "bob", Password: "pw", Header: "Basic Ym9iOnB3"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mu.Lock()
+			requests = nil
+			mu.Unlock()
+			proxyExchange(t, s.ln.Addr().String(), tt.request, tt.want)
+			mu.Lock()
+			defer mu.Unlock()
+			if !reflect.DeepEqual(requests, []AuthRequest{tt.auth}) {
+				t.Errorf("authenticator got %+v, want %+v", requests, tt.auth)
+			}
+		})
+	}
+}
@@ -0,0 +1,305 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"golang.org/x/time/rate"
+	"gopkg.in/yaml.v3"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// minBurst let a whole relay buffer or udp datagram through at once
+const minBurst = 64 * 1024
+
+// ByteRate is a rate in bytes per second, 0 for unlimited. In config files
+// it is a number with an optional K, M or G suffix, 1024 based
+type ByteRate int64
+
+func ParseByteRate(s string) (ByteRate, error) {
+	n, err := parseBytes(strings.TrimSuffix(strings.TrimSpace(s), "/s"))
+	return ByteRate(n), err
+}
+
+// parseBytes read a byte count with an optional K, M, G or T suffix,
+// 1024 based, and an optional B or iB
+func parseBytes(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	number := strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(s), "B"), "I")
+	mult := 1.0
+	if number != "" {
+		switch number[len(number)-1] {
+		case 'K':
+			mult = 1 << 10
+		case 'M':
+			mult = 1 << 20
+		case 'G':
+			mult = 1 << 30
+		case 'T':
+			mult = 1 << 40
+		}
+		if mult != 1 {
+			number = number[:len(number)-1]
+		}
+	}
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil || value < 0 || math.IsInf(value*mult, 0) || value*mult > math.MaxInt64 {
+		return 0, errors.New("bad byte count " + s)
+	}
+	return int64(value * mult), nil
+}
+
+func (r *ByteRate) UnmarshalYAML(value *yaml.Node) error {
+	parsed, err := ParseByteRate(value.Value)
+	if err != nil {
+		return err
+	}
+	*r = parsed
+	return nil
+}
+
+func (r *ByteRate) UnmarshalJSON(data []byte) error {
+	var s string
+	if json.Unmarshal(data, &s) != nil {
+		s = string(data)
+	}
+	parsed, err := ParseByteRate(s)
+	if err != nil {
+		return err
+	}
+	*r = parsed
+	return nil
+}
+
+// RateLimit is the upload and download rate of a share of the traffic,
+// up is client to target and down target to client
+type RateLimit struct {
+	Up   ByteRate `yaml:"up" json:"up"`
+	Down ByteRate `yaml:"down" json:"down"`
+}
+
+// BandwidthConfig is the shaping of the relayed traffic, a connection is
+// held to every limit it falls under. The global, user and cidr limits are
+// shared by every matching connection, per_connection applies to each
+type BandwidthConfig struct {
+	Global        RateLimit            `yaml:"global" json:"global"`
+	PerConnection RateLimit            `yaml:"per_connection" json:"per_connection"`
+	Users         map[string]RateLimit `yaml:"users" json:"users"`
+	CIDRs         map[string]RateLimit `yaml:"cidrs" json:"cidrs"` // client network -> limit
+}
+
+func (c *BandwidthConfig) Validate() error {
+	for cidr := range c.CIDRs {
+		_, _, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return errors.New("bad bandwidth cidr " + cidr)
+		}
+	}
+	return nil
+}
+
+// limiterPair is the token bucket of each direction
+type limiterPair struct {
+	up   *rate.Limiter
+	down *rate.Limiter
+}
+
+func newLimiterPair(l RateLimit) *limiterPair {
+	p := &limiterPair{
+		up:   rate.NewLimiter(rate.Inf, 0),
+		down: rate.NewLimiter(rate.Inf, 0),
+	}
+	p.set(l)
+	return p
+}
+
+// set change the rates, connections already using the pair follow
+func (p *limiterPair) set(l RateLimit) {
+	setLimit(p.up, l.Up)
+	setLimit(p.down, l.Down)
+}
+
+func setLimit(limiter *rate.Limiter, r ByteRate) {
+	if r <= 0 {
+		limiter.SetLimit(rate.Inf)
+		return
+	}
+	burst := int(r)
+	if burst < minBurst {
+		burst = minBurst
+	}
+	limiter.SetBurst(burst)
+	limiter.SetLimit(rate.Limit(r))
+}
+
+type cidrLimiter struct {
+	network *net.IPNet
+	pair    *limiterPair
+}
+
+// Shaper hold the shared token buckets, updating it changes the rate of
+// the live connections too, except for the per connection limit which
+// applies to the connections opened afterwards
+type Shaper struct {
+	mu        sync.Mutex
+	cfg       BandwidthConfig
+	global    *limiterPair
+	listeners map[string]*limiterPair
+	users     map[string]*limiterPair
+	cidrs     map[string]*cidrLimiter
+}
+
+func NewShaper() *Shaper {
+	return &Shaper{
+		global:    newLimiterPair(RateLimit{}),
+		listeners: make(map[string]*limiterPair),
+		users:     make(map[string]*limiterPair),
+		cidrs:     make(map[string]*cidrLimiter),
+	}
+}
+
+// Update apply a new bandwidth config, limits which are gone become
+// unlimited
+func (s *Shaper) Update(cfg BandwidthConfig) error {
+	err := cfg.Validate()
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cfg = cfg
+	s.global.set(cfg.Global)
+	for user, pair := range s.users {
+		pair.set(cfg.Users[user])
+	}
+	for user, l := range cfg.Users {
+		if s.users[user] == nil {
+			s.users[user] = newLimiterPair(l)
+		}
+	}
+	for cidr, cl := range s.cidrs {
+		cl.pair.set(cfg.CIDRs[cidr])
+	}
+	for cidr, l := range cfg.CIDRs {
+		if s.cidrs[cidr] == nil {
+			_, network, _ := net.ParseCIDR(cidr)
+			s.cidrs[cidr] = &cidrLimiter{network: network, pair: newLimiterPair(l)}
+		}
+	}
+	return nil
+}
+
+// SetListener change the limit shared by the connections of a listener
+func (s *Shaper) SetListener(name string, l RateLimit) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if pair := s.listeners[name]; pair != nil {
+		pair.set(l)
+		return
+	}
+	s.listeners[name] = newLimiterPair(l)
+}
+
+// RemoveListener forget the limit of a removed listener, its connections
+// still open keep their limiters
+func (s *Shaper) RemoveListener(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.listeners, name)
+}
+
+// Config return the bandwidth config in use
+func (s *Shaper) Config() BandwidthConfig {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cfg
+}
+
+// limiters return every bucket the outbound connections of sess are held to
+func (s *Shaper) limiters(sess *session) []*limiterPair {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pairs := []*limiterPair{s.global}
+	if pair := s.listeners[sess.settings.name]; pair != nil {
+		pairs = append(pairs, pair)
+	}
+	if pair := s.users[sess.user]; pair != nil && sess.user != "" {
+		pairs = append(pairs, pair)
+	}
+	if ip := addrIP(sess.conn.RemoteAddr()); ip != nil {
+		keys := make([]string, 0, len(s.cidrs))
+		for cidr := range s.cidrs {
+			keys = append(keys, cidr)
+		}
+		sort.Strings(keys)
+		for _, cidr := range keys {
+			if cl := s.cidrs[cidr]; cl.network.Contains(ip) {
+				pairs = append(pairs, cl.pair)
+			}
+		}
+	}
+	if s.cfg.PerConnection.Up > 0 || s.cfg.PerConnection.Down > 0 {
+		pairs = append(pairs, newLimiterPair(s.cfg.PerConnection))
+	}
+	return pairs
+}
+
+// shape hold con to the limits of sess, con is returned as is when
+// there is no shaper
+func (s *Shaper) shape(sess *session, con net.Conn) net.Conn {
+	if s == nil {
+		return con
+	}
+	return &shapedConn{Conn: con, ctx: sess.ctx, limiters: s.limiters(sess)}
+}
+
+// shapedConn wait for tokens before writing to the target and after
+// reading from it
+type shapedConn struct {
+	net.Conn
+	ctx      context.Context
+	limiters []*limiterPair
+}
+
+func (c *shapedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	for _, pair := range c.limiters {
+		if waitErr := waitN(c.ctx, pair.down, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
+
+func (c *shapedConn) Write(b []byte) (int, error) {
+	for _, pair := range c.limiters {
+		if err := waitN(c.ctx, pair.up, len(b)); err != nil {
+			return 0, err
+		}
+	}
+	return c.Conn.Write(b)
+}
+
+// waitN take n tokens, by pieces when n is over the burst
+func waitN(ctx context.Context, limiter *rate.Limiter, n int) error {
+	for n > 0 {
+		if limiter.Limit() == rate.Inf {
+			return nil
+		}
+		chunk := n
+		if burst := limiter.Burst(); chunk > burst {
+			chunk = burst
+		}
+		err := limiter.WaitN(ctx, chunk)
+		if err != nil {
+			return err
+		}
+		n -= chunk
+	}
+	return nil
+}
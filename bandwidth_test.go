@@ -0,0 +1,251 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"golang.org/x/time/rate"
+	"gopkg.in/yaml.v3"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseByteRate(t *testing.T) {
+	tests := []struct {
+		s    string
+		want ByteRate
+		err  bool
+	}{
+		{s: "0", want: 0},
+		{s: "1000", want: 1000},
+		{s: "512K", want: 512 << 10},
+		{s: "512k", want: 512 << 10},
+		{s: "1.5M", want: 3 << 19},
+		{s: "2G", want: 2 << 30},
+		{s: "10MB", want: 10 << 20},
+		{s: "10MiB", want: 10 << 20},
+		{s: " 1M/s ", want: 1 << 20},
+		{s: "", err: true},
+		{s: "fast", err: true},
+		{s: "-1M", err: true},
+		{s: "1X", err: true},
+		{s: "9999999999T", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			got, err := ParseByteRate(tt.s)
+			if (err != nil) != tt.err {
+				t.Fatalf("error %v, want error %v", err, tt.err)
+			}
+			if got != tt.want {
+				t.Errorf("got %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBandwidthConfigUnmarshal(t *testing.T) {
+	want := BandwidthConfig{
+		Global:        RateLimit{Up: 20 << 20, Down: 100 << 20},
+		PerConnection: RateLimit{Down: 1000},
+		Users:         map[string]RateLimit{"ci": {Up: 1 << 20}},
+	}
+	var fromYAML, fromJSON BandwidthConfig
+	err := yaml.Unmarshal([]byte("global: {up: 20M, down: 100M}\nper_connection: {down: 1000}\nusers: {ci: {up: 1M}}\n"), &fromYAML)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = json.Unmarshal([]byte(`{"global": {"up": "20M", "down": "100M"}, "per_connection": {"down": 1000}, "users": {"ci": {"up": "1M"}}}`), &fromJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, got := range map[string]BandwidthConfig{"yaml": fromYAML, "json": fromJSON} {
+		if got.Global != want.Global || got.PerConnection != want.PerConnection || got.Users["ci"] != want.Users["ci"] {
+			t.Errorf("%s %+v, want %+v", name, got, want)
+		}
+	}
+	if yaml.Unmarshal([]byte("global: {up: fast}\n"), &fromYAML) == nil {
+		t.Error("bad yaml rate: no error")
+	}
+	if json.Unmarshal([]byte(`{"global": {"up": "fast"}}`), &fromJSON) == nil {
+		t.Error("bad json rate: no error")
+	}
+	bad := BandwidthConfig{CIDRs: map[string]RateLimit{"10.0.0.0": {Up: 1}}}
+	if bad.Validate() == nil {
+		t.Error("bad cidr: no error")
+	}
+}
+
+// shapedSession return a loopback session of user on the listener
+func shapedSession(t *testing.T, listener, user string) *session {
+	t.Helper()
+	sess := newTestSession(t)
+	sess.settings = &serverSettings{name: listener}
+	sess.user = user
+	return sess
+}
+
+func TestShaperLimiters(t *testing.T) {
+	s := NewShaper()
+	err := s.Update(BandwidthConfig{
+		Users: map[string]RateLimit{"ci": {Up: 1 << 20}},
+		CIDRs: map[string]RateLimit{"127.0.0.0/8": {Down: 1 << 20}, "127.0.0.1/32": {Down: 2 << 20}, "10.0.0.0/8": {Down: 1 << 20}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetListener("socks", RateLimit{Down: 1 << 20})
+	tests := []struct {
+		name     string
+		listener string
+		user     string
+		perConn  bool
+		want     []*limiterPair
+	}{
+		{name: "anonymous", want: []*limiterPair{s.global, s.cidrs["127.0.0.0/8"].pair, s.cidrs["127.0.0.1/32"].pair}},
+		{name: "user", user: "ci", want: []*limiterPair{s.global, s.users["ci"], s.cidrs["127.0.0.0/8"].pair, s.cidrs["127.0.0.1/32"].pair}},
+		{name: "user without limit", user: "dev", want: []*limiterPair{s.global, s.cidrs["127.0.0.0/8"].pair, s.cidrs["127.0.0.1/32"].pair}},
+		{
+			name:     "listener",
+			listener: "socks",
+			user:     "ci",
+			want:     []*limiterPair{s.global, s.listeners["socks"], s.users["ci"], s.cidrs["127.0.0.0/8"].pair, s.cidrs["127.0.0.1/32"].pair},
+		},
+		{name: "per connection", perConn: true, want: []*limiterPair{s.global, s.cidrs["127.0.0.0/8"].pair, s.cidrs["127.0.0.1/32"].pair, nil}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := s.Config()
+			cfg.PerConnection = RateLimit{}
+			if tt.perConn {
+				cfg.PerConnection = RateLimit{Up: 1 << 20}
+			}
+			err := s.Update(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := s.limiters(shapedSession(t, tt.listener, tt.user))
+			if len(got) != len(tt.want) {
+				t.Fatalf("%d limiters, want %d", len(got), len(tt.want))
+			}
+			for i, pair := range tt.want {
+				if pair == nil {
+					// a bucket of its own for each connection
+					if got[i].up.Limit() != 1<<20 {
+						t.Errorf("per connection limit %v", got[i].up.Limit())
+					}
+					continue
+				}
+				if got[i] != pair {
+					t.Errorf("limiter %d is not the expected one", i)
+				}
+			}
+		})
+	}
+}
+
+func TestShaperUpdateLivePairs(t *testing.T) {
+	s := NewShaper()
+	err := s.Update(BandwidthConfig{Global: RateLimit{Up: 1 << 20}, Users: map[string]RateLimit{"ci": {Down: 1 << 20}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := s.users["ci"]
+	err = s.Update(BandwidthConfig{Users: map[string]RateLimit{"ci": {Down: 2 << 20}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.users["ci"] != user || user.down.Limit() != 2<<20 || user.up.Limit() != rate.Inf {
+		t.Errorf("user limits %v %v, want the live pair updated", user.up.Limit(), user.down.Limit())
+	}
+	if s.global.up.Limit() != rate.Inf {
+		t.Errorf("global up %v, want unlimited once removed", s.global.up.Limit())
+	}
+	err = s.Update(BandwidthConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.down.Limit() != rate.Inf {
+		t.Errorf("removed user limit %v, want unlimited", user.down.Limit())
+	}
+	if s.Update(BandwidthConfig{CIDRs: map[string]RateLimit{"bad": {}}}) == nil {
+		t.Error("bad cidr: no error")
+	}
+	s.SetListener("a", RateLimit{Up: 1 << 20})
+	pair := s.listeners["a"]
+	s.SetListener("a", RateLimit{})
+	if s.listeners["a"] != pair || pair.up.Limit() != rate.Inf {
+		t.Errorf("listener limit %v, want the live pair unlimited", pair.up.Limit())
+	}
+	if burst := newLimiterPair(RateLimit{Up: 1}).up.Burst(); burst != minBurst {
+		t.Errorf("burst %d, want %d", burst, minBurst)
+	}
+}
+
+// bulkConn read and write any amount of data at once
+type bulkConn struct {
+	net.Conn
+}
+
+func (bulkConn) Read(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (bulkConn) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func TestShapedConnRate(t *testing.T) {
+	const limit = 256 << 10
+	tests := []struct {
+		name string
+		cfg  RateLimit
+		op   func(c net.Conn, b []byte) (int, error)
+	}{
+		{name: "up", cfg: RateLimit{Up: limit}, op: net.Conn.Write},
+		{name: "down", cfg: RateLimit{Down: limit}, op: net.Conn.Read},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewShaper()
+			err := s.Update(BandwidthConfig{Global: tt.cfg})
+			if err != nil {
+				t.Fatal(err)
+			}
+			con := s.shape(shapedSession(t, "", ""), bulkConn{})
+			start := time.Now()
+			// twice the burst, the second half waits for a second
+			for i := 0; i < 4; i++ {
+				n, err := tt.op(con, make([]byte, limit/2))
+				if err != nil || n != limit/2 {
+					t.Fatalf("%d %v", n, err)
+				}
+			}
+			if elapsed := time.Since(start); elapsed < 900*time.Millisecond || elapsed > 3*time.Second {
+				t.Errorf("%d bytes in %v at %d bytes per second", 2*limit, elapsed, limit)
+			}
+		})
+	}
+	if con := (*Shaper)(nil).shape(nil, bulkConn{}); con != (bulkConn{}) {
+		t.Errorf("nil shaper wrapped the connection in %#v", con)
+	}
+}
+
+func TestShapedConnCanceled(t *testing.T) {
+	s := NewShaper()
+	err := s.Update(BandwidthConfig{Global: RateLimit{Up: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess := shapedSession(t, "", "")
+	ctx, cancel := context.WithCancel(context.Background())
+	sess.ctx = ctx
+	con := s.shape(sess, bulkConn{})
+	time.AfterFunc(50*time.Millisecond, cancel)
+	// more than the burst, a part waits for the next tokens
+	_, err = con.Write(make([]byte, 2*minBurst))
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("error %v, want canceled", err)
+	}
+}
@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"github.com/sirupsen/logrus"
+	"net"
+	"time"
+)
+
+const bindTimeout = time.Minute * 2
+
+// listenBind open the socket a BIND peer connects to, on the address
+// the client reached the proxy at
+func listenBind(con net.Conn, network string) (*net.TCPListener, error) {
+	local, ok := con.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return nil, errors.New("bind on non tcp connection")
+	}
+	ip := local.IP
+	if network == "tcp4" && ip.To4() == nil {
+		// socks4 can only announce ipv4, listen on every interface and
+		// let the client substitute 0.0.0.0 with the proxy address
+		ip = nil
+	}
+	return net.ListenTCP(network, &net.TCPAddr{IP: ip})
+}
+
+// bindPeerIPs resolve the address announced in a BIND request with
+// resolver, nil for the system one. nil means any peer is accepted
+func bindPeerIPs(ctx context.Context, resolver Resolver, addr string) ([]net.IP, error) {
+	if ip := net.ParseIP(addr); ip != nil {
+		if ip.IsUnspecified() {
+			return nil, nil
+		}
+		return []net.IP{ip}, nil
+	}
+	if resolver == nil {
+		resolver = systemResolver{}
+	}
+	return resolver.LookupIP(ctx, addr)
+}
+
+// acceptBind wait for the expected peer until bindTimeout,
+// connections coming from any other host are dropped
+func acceptBind(ln *net.TCPListener, expect []net.IP) (net.Conn, error) {
+	err := ln.SetDeadline(time.Now().Add(bindTimeout))
+	if err != nil {
+		return nil, err
+	}
+	for {
+		peer, err := ln.AcceptTCP()
+		if err != nil {
+			return nil, err
+		}
+		if expect == nil {
+			return peer, nil
+		}
+		ip := peer.RemoteAddr().(*net.TCPAddr).IP
+		for _, e := range expect {
+			if e.Equal(ip) {
+				return peer, nil
+			}
+		}
+		logrus.Warningln("bind peer " + peer.RemoteAddr().String() + " does not match the requested address")
+		_ = peer.Close()
+	}
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,220 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"mixed-socks/socks"
+	"net"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestBindPeerIPs(t *testing.T) {
+	tests := []struct {
+		addr string
+		want []net.IP
+	}{
+		{addr: "0.0.0.0", want: nil},
+		{addr: "::", want: nil},
+		{addr: "192.0.2.1", want: []net.IP{net.ParseIP("192.0.2.1")}},
+		{addr: "2001:db8::1", want: []net.IP{net.ParseIP("2001:db8::1")}},
+		{addr: "localhost", want: []net.IP{net.IPv4(127, 0, 0, 1)}},
+	}
+	r := &staticResolver{ips: []net.IP{net.IPv4(127, 0, 0, 1)}}
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			got, err := bindPeerIPs(context.Background(), r, tt.addr)
+			if err != nil || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v %v, want %v", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestAcceptBindDropsOtherPeers(t *testing.T) {
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	type result struct {
+		peer net.Conn
+		err  error
+	}
+	accepted := make(chan result, 1)
+	go func() {
+		peer, err := acceptBind(ln, []net.IP{net.ParseIP("192.0.2.1")})
+		accepted <- result{peer, err}
+	}()
+	stranger, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stranger.Close()
+	expectClosed(t, stranger)
+	_ = ln.Close()
+	r := <-accepted
+	if r.err == nil {
+		t.Errorf("peer %v accepted, want none", r.peer.RemoteAddr())
+	}
+
+	ln, err = net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		peer, err := acceptBind(ln, []net.IP{net.IPv4(127, 0, 0, 1)})
+		accepted <- result{peer, err}
+	}()
+	expected, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer expected.Close()
+	r = <-accepted
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	_ = r.peer.Close()
+}
+
+func TestListenBind(t *testing.T) {
+	for _, network := range []string{"tcp", "tcp4"} {
+		for _, ip := range []string{"127.0.0.1", "::1"} {
+			t.Run(network+" "+ip, func(t *testing.T) {
+				ln, err := net.Listen("tcp", net.JoinHostPort(ip, "0"))
+				if err != nil {
+					t.Skip("no " + ip + ": " + err.Error())
+				}
+				defer ln.Close()
+				client, err := net.Dial("tcp", ln.Addr().String())
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer client.Close()
+				con, err := ln.Accept()
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer con.Close()
+				bind, err := listenBind(con, network)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer bind.Close()
+				got := bind.Addr().(*net.TCPAddr).IP
+				// socks4 can not announce ipv6, it listens on every interface
+				want := net.ParseIP(ip)
+				if network == "tcp4" && want.To4() == nil {
+					want = net.IPv4zero
+				}
+				if !got.Equal(want) {
+					t.Errorf("bind listens on %v, want %v", got, want)
+				}
+			})
+		}
+	}
+}
+
+// readSocks5Reply read a socks5 reply from con
+func readSocks5Reply(t *testing.T, con net.Conn) *socks.Reply {
+	t.Helper()
+	_ = con.SetReadDeadline(time.Now().Add(2 * time.Second))
+	rep, err := socks.ReadReply(con)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rep
+}
+
+func TestSocks5Bind(t *testing.T) {
+	s := newTestServer(t)
+	con := proxyExchange(t, s.ln.Addr().String(),
+		append([]byte{5, 1, METHOD_NO_AUTH}, socks5Request(CMD_BIND, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})...),
+		[]byte{5, METHOD_NO_AUTH})
+	first := readSocks5Reply(t, con)
+	if first.Code != socks.REPLY_SUCCEEDED || first.Addr.Port == 0 || !first.Addr.IP.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Fatalf("first reply %+v, want the address listened on", first)
+	}
+	peer, err := net.Dial("tcp", first.Addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	second := readSocks5Reply(t, con)
+	if second.Code != socks.REPLY_SUCCEEDED || second.Addr.String() != peer.LocalAddr().String() {
+		t.Fatalf("second reply %+v, want the peer address %v", second, peer.LocalAddr())
+	}
+
+	_ = peer.SetDeadline(time.Now().Add(2 * time.Second))
+	_, err = con.Write([]byte("to peer"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 7)
+	if _, err = io.ReadFull(peer, buf); err != nil || string(buf) != "to peer" {
+		t.Fatalf("peer read %q %v", buf, err)
+	}
+	_, err = peer.Write([]byte("to client"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf = make([]byte, 9)
+	if _, err = io.ReadFull(con, buf); err != nil || string(buf) != "to client" {
+		t.Fatalf("client read %q %v", buf, err)
+	}
+}
+
+func TestSocks4Bind(t *testing.T) {
+	tests := []struct {
+		name    string
+		request *socks.Request4
+	}{
+		{name: "socks4", request: &socks.Request4{Command: CMD_BIND, IP: net.IPv4(127, 0, 0, 1).To4(), UserID: "bob"}},
+		{name: "socks4a", request: &socks.Request4{Command: CMD_BIND, Domain: "localhost"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+			s.update(func(st *serverSettings) {
+				st.resolver = &staticResolver{ips: []net.IP{net.IPv4(127, 0, 0, 1)}}
+			})
+			request, err := tt.request.Append(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			con := proxyExchange(t, s.ln.Addr().String(), request, nil)
+			first, err := socks.ReadReply4(con)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if first.Code != socks.REPLY4_GRANTED || first.Port == 0 {
+				t.Fatalf("first reply %+v, want the port listened on", first)
+			}
+			peer, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(int(first.Port))))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer peer.Close()
+			second, err := socks.ReadReply4(con)
+			if err != nil {
+				t.Fatal(err)
+			}
+			peerAddr := peer.LocalAddr().(*net.TCPAddr)
+			if second.Code != socks.REPLY4_GRANTED || int(second.Port) != peerAddr.Port || !second.IP.Equal(peerAddr.IP) {
+				t.Fatalf("second reply %+v, want the peer address %v", second, peerAddr)
+			}
+			_ = peer.SetDeadline(time.Now().Add(2 * time.Second))
+			_, err = peer.Write([]byte("hello"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			buf := make([]byte, 5)
+			if _, err = io.ReadFull(con, buf); err != nil || string(buf) != "hello" {
+				t.Fatalf("client read %q %v", buf, err)
+			}
+		})
+	}
+}
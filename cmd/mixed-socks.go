@@ -2,60 +2,261 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/common-nighthawk/go-figure"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	proxy "mixed-socks"
+	"net"
 	"os"
 	"os/signal"
 	"path"
+	"strconv"
 	"strings"
 	"syscall"
+	"time"
 )
 
 var (
-	host   string
-	port   int
-	ctx    context.Context
-	cancel context.CancelFunc
-	Header = figure.NewFigure("MixedSocks", "doom", true).String()
-	cmd    = &cobra.Command{
+	configFile string
+	host       string
+	port       int
+	users      []string
+	htpasswd   string
+	udpAddr    string
+	upstream   []string
+	outbound   []string
+	rules      string
+	grace      time.Duration
+	metrics    string
+	adminAddr  string
+	adminToken string
+	accessLog  string
+	logFormat  string
+	logLevel   string
+	bwUp       string
+	bwDown     string
+	quotaFile  string
+	daily      string
+	monthly    string
+	timeouts   proxy.TimeoutConfig
+	limits     proxy.LimitConfig
+	access     proxy.AccessConfig
+	dests      proxy.DestinationConfig
+	dns        proxy.ResolverConfig
+	dial       proxy.DialConfig
+	ctx        context.Context
+	cancel     context.CancelFunc
+	Header     = figure.NewFigure("MixedSocks", "doom", true).String()
+	cmd        = &cobra.Command{
 		Use:               os.Args[0],
 		Short:             "Support socks4, socks4a, socks5, socks5h, http proxy all in one",
 		DisableAutoGenTag: true,
 		Run: func(cmd *cobra.Command, args []string) {
 			fmt.Println(Header)
-			ctx, cancel = context.WithCancel(context.Background())
-			server := proxy.NewSocksServer(host, port)
-			server.ListenAndServe(ctx)
+			cfg, err := newConfig()
+			if err != nil {
+				logrus.Fatalln(err)
+			}
+			err = setLogLevel(cfg)
+			if err != nil {
+				logrus.Fatalln(err)
+			}
+			service, err := proxy.NewService(cfg)
+			if err != nil {
+				logrus.Fatalln(err)
+			}
+			service.SetReloader(func() error {
+				return reloadConfig(service)
+			})
+			go reloadOnSighup(service)
+			err = service.Run(ctx)
+			if err != nil {
+				logrus.Fatalln(err)
+			}
+			logrus.Infoln("mixed socks stopped")
 		},
 	}
 )
 
 func init() {
-	logrus.SetLevel(logrus.DebugLevel)
 	logrus.SetReportCaller(true)
 	logrus.SetFormatter(&ConsoleFormatter{})
+	ctx, cancel = context.WithCancel(context.Background())
 	registerSignalHandlers()
+	cmd.PersistentFlags().StringVarP(&configFile, "config", "c", "", "yaml config file, the other flags are ignored when set")
 	cmd.PersistentFlags().StringVarP(&host, "addr", "a", "localhost", "listen addr")
 	cmd.PersistentFlags().IntVarP(&port, "port", "p", 1080, "listen port")
+	cmd.PersistentFlags().StringArrayVarP(&users, "user", "u", nil, "proxy user as user:password, can be repeated")
+	cmd.PersistentFlags().StringVar(&htpasswd, "htpasswd", "", "htpasswd file with bcrypt passwords")
+	cmd.PersistentFlags().StringArrayVar(&upstream, "upstream", nil, "upstream proxy url socks5://, socks5h://, socks4://, socks4a:// or http://, repeat to chain hops in order")
+	cmd.PersistentFlags().StringArrayVar(&outbound, "outbound", nil, "named upstream for rules as name=url[,url...], urls are chained in order")
+	cmd.PersistentFlags().StringVar(&rules, "rules", "", "routing rules file, first match wins")
+	cmd.PersistentFlags().DurationVar(&grace, "shutdown-grace", proxy.DEFAULT_SHUTDOWN_GRACE, "time live sessions have to end on shutdown before they are closed")
+	cmd.PersistentFlags().StringVar(&metrics, "metrics-addr", "", "serve prometheus metrics on host:port/metrics")
+	cmd.PersistentFlags().StringVar(&adminAddr, "admin-addr", "", "serve the admin api listing and closing connections on host:port")
+	cmd.PersistentFlags().StringVar(&adminToken, "admin-token", "", "bearer token required by the admin api")
+	cmd.PersistentFlags().StringVar(&accessLog, "access-log", "", "access log file rotated at 100MB, - for stdout")
+	cmd.PersistentFlags().StringVar(&logFormat, "access-log-format", proxy.ACCESS_LOG_JSON, "access log format json, logfmt or squid")
+	cmd.PersistentFlags().StringVar(&logLevel, "log-level", "info", "debug log level, debug shows every request")
+	cmd.PersistentFlags().StringVar(&bwUp, "bandwidth-up", "", "global upload limit in bytes per second, K M G suffixes, empty for none")
+	cmd.PersistentFlags().StringVar(&bwDown, "bandwidth-down", "", "global download limit in bytes per second, K M G suffixes, empty for none")
+	cmd.PersistentFlags().StringVar(&quotaFile, "quota-file", "", "json file keeping the traffic of every user across restarts")
+	cmd.PersistentFlags().StringVar(&daily, "quota-daily", "", "daily traffic quota of every user, K M G T suffixes, empty for none")
+	cmd.PersistentFlags().StringVar(&monthly, "quota-monthly", "", "monthly traffic quota of every user, K M G T suffixes, empty for none")
+	cmd.PersistentFlags().DurationVar(&timeouts.Handshake, "handshake-timeout", proxy.DEFAULT_HANDSHAKE_TIMEOUT, "time a client has to send its request")
+	cmd.PersistentFlags().DurationVar(&timeouts.Dial, "dial-timeout", proxy.DEFAULT_DIAL_TIMEOUT, "time to open an outbound connection")
+	cmd.PersistentFlags().DurationVar(&timeouts.Idle, "idle-timeout", 0, "close relays with no traffic for this long, 0 for never")
+	cmd.PersistentFlags().IntVar(&limits.MaxConnections, "max-conns", 0, "max concurrent client connections, 0 for unlimited")
+	cmd.PersistentFlags().IntVar(&limits.MaxPerIP, "max-conns-per-ip", 0, "max concurrent connections of a client ip, 0 for unlimited")
+	cmd.PersistentFlags().IntVar(&limits.MaxPerUser, "max-conns-per-user", 0, "max concurrent connections of a user, 0 for unlimited")
+	cmd.PersistentFlags().StringArrayVar(&access.Allow, "allow", nil, "serve only this client ip or cidr, can be repeated")
+	cmd.PersistentFlags().StringArrayVar(&access.Deny, "deny", nil, "refuse this client ip or cidr, can be repeated")
+	cmd.PersistentFlags().StringVar(&access.AllowFile, "allow-file", "", "file of client ips or cidrs to serve, one per line, read again on SIGHUP")
+	cmd.PersistentFlags().StringVar(&access.DenyFile, "deny-file", "", "file of client ips or cidrs to refuse, one per line, read again on SIGHUP")
+	cmd.PersistentFlags().BoolVar(&dests.BlockPrivate, "block-private", true, "refuse direct connections to loopback, private, link-local and reserved addresses, --block-private=false to serve them")
+	cmd.PersistentFlags().StringArrayVar(&dests.Deny, "deny-dest", nil, "refuse direct connections to this ip or cidr, can be repeated")
+	cmd.PersistentFlags().StringArrayVar(&dests.Allow, "allow-dest", nil, "serve this ip or cidr even when private or denied, can be repeated")
+	cmd.PersistentFlags().StringArrayVar(&dns.Servers, "dns", nil, "dns server of direct connections, system, udp://, tcp://, tls:// or https:// url, repeat to try several in order")
+	cmd.PersistentFlags().StringVar(&dns.Prefer, "dns-prefer", "", "address family tried first, ipv4, ipv6, ipv4_only or ipv6_only")
+	cmd.PersistentFlags().DurationVar(&dial.FallbackDelay, "fallback-delay", proxy.DEFAULT_FALLBACK_DELAY, "head start of each address of a dual-stack target over the next one, negative to try them one after the other")
+	cmd.PersistentFlags().DurationVar(&dial.FamilyMemory, "family-memory", proxy.DEFAULT_FAMILY_MEMORY, "time an address family beaten by the other one is tried last for a target, negative to disable")
+	cmd.PersistentFlags().StringVar(&udpAddr, "udp-addr", "", "udp associate address announced to clients, default the address they reached")
 }
 
 func main() {
 	cobra.CheckErr(cmd.Execute())
 }
 
+// newConfig load the config file, or build a single listener from the flags
+func newConfig() (*proxy.Config, error) {
+	if configFile != "" {
+		return proxy.LoadConfig(configFile)
+	}
+	listener := proxy.ListenerConfig{
+		Addr:     net.JoinHostPort(host, strconv.Itoa(port)),
+		UDPAddr:  udpAddr,
+		Auth:     proxy.AuthConfig{Htpasswd: htpasswd},
+		Timeouts: timeouts,
+		Access:   access,
+	}
+	if len(users) > 0 {
+		listener.Auth.Users = make(map[string]string)
+	}
+	for _, u := range users {
+		username, password, ok := strings.Cut(u, ":")
+		if !ok {
+			return nil, errors.New("bad user format, want user:password " + u)
+		}
+		listener.Auth.Users[username] = password
+	}
+	cfg := &proxy.Config{
+		Upstreams:     make(map[string][]string),
+		RulesFile:     rules,
+		ShutdownGrace: grace,
+		Metrics:       proxy.MetricsConfig{Addr: metrics},
+		Admin:         proxy.AdminConfig{Addr: adminAddr, Token: adminToken},
+		AccessLog:     proxy.AccessLogConfig{Path: accessLog, Format: logFormat},
+		Limits:        limits,
+		Destinations:  dests,
+		DNS:           dns,
+		Dial:          dial,
+		LogLevel:      logLevel,
+	}
+	var err error
+	if bwUp != "" {
+		cfg.Bandwidth.Global.Up, err = proxy.ParseByteRate(bwUp)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if bwDown != "" {
+		cfg.Bandwidth.Global.Down, err = proxy.ParseByteRate(bwDown)
+		if err != nil {
+			return nil, err
+		}
+	}
+	cfg.Quotas.File = quotaFile
+	if daily != "" {
+		cfg.Quotas.Default.Daily, err = proxy.ParseByteSize(daily)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if monthly != "" {
+		cfg.Quotas.Default.Monthly, err = proxy.ParseByteSize(monthly)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(upstream) > 0 {
+		cfg.Upstreams["upstream"] = upstream
+		listener.Outbound = "upstream"
+	}
+	for _, o := range outbound {
+		name, urls, ok := strings.Cut(o, "=")
+		if !ok {
+			return nil, errors.New("bad outbound format, want name=url " + o)
+		}
+		cfg.Upstreams[name] = strings.Split(urls, ",")
+	}
+	cfg.Listeners = []proxy.ListenerConfig{listener}
+	return cfg, nil
+}
+
 func registerSignalHandlers() {
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, os.Interrupt, os.Kill, syscall.SIGTERM, syscall.SIGQUIT)
 	go func() {
-		<-sigs
+		sig := <-sigs
+		logrus.Infoln("received " + sig.String() + ", shutting down")
 		cancel()
-		os.Exit(0)
+		<-sigs
+		logrus.Warningln("received a second signal, exiting")
+		os.Exit(1)
 	}()
 }
 
+func setLogLevel(cfg *proxy.Config) error {
+	if cfg.LogLevel == "" {
+		return nil
+	}
+	level, err := logrus.ParseLevel(cfg.LogLevel)
+	if err != nil {
+		return err
+	}
+	logrus.SetLevel(level)
+	return nil
+}
+
+// reloadOnSighup reload the config on SIGHUP, see reloadConfig
+func reloadOnSighup(service *proxy.Service) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+	for range sigs {
+		_ = reloadConfig(service)
+	}
+}
+
+// reloadConfig read the config again, the config file or the files named
+// by the flags, and apply it to the running service
+func reloadConfig(service *proxy.Service) error {
+	cfg, err := newConfig()
+	if err == nil {
+		err = setLogLevel(cfg)
+	}
+	if err == nil {
+		err = service.Reload(cfg)
+	}
+	if err != nil {
+		logrus.Errorln("reload config error", err)
+		return err
+	}
+	logrus.Infoln("config reloaded")
+	return nil
+}
+
 type ConsoleFormatter struct {
 	logrus.TextFormatter
 }
@@ -0,0 +1,275 @@
+package proxy
+
+import (
+	"errors"
+	"gopkg.in/yaml.v3"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config is the content of the yaml configuration file
+type Config struct {
+	Listeners []ListenerConfig    `yaml:"listeners"`
+	Upstreams map[string][]string `yaml:"upstreams"` // name -> proxy urls chained in order
+	Rules     []string            `yaml:"rules"`
+	RulesFile string              `yaml:"rules_file"`
+
+	ShutdownGrace time.Duration     `yaml:"shutdown_grace"` // time live sessions have to end on shutdown
+	Metrics       MetricsConfig     `yaml:"metrics"`
+	Admin         AdminConfig       `yaml:"admin"`
+	AccessLog     AccessLogConfig   `yaml:"access_log"`
+	Bandwidth     BandwidthConfig   `yaml:"bandwidth"`
+	Quotas        QuotaConfig       `yaml:"quotas"`
+	Limits        LimitConfig       `yaml:"limits"`
+	Destinations  DestinationConfig `yaml:"destinations"`
+	DNS           ResolverConfig    `yaml:"dns"`
+	Dial          DialConfig        `yaml:"dial"`
+	LogLevel      string            `yaml:"log_level"` // debug log level, applied by the command
+}
+
+type MetricsConfig struct {
+	Addr string `yaml:"addr"` // host:port serving /metrics, empty to disable
+}
+
+type AccessLogConfig struct {
+	Path       string `yaml:"path"`        // file rotated by size, - for stdout, empty to disable
+	Format     string `yaml:"format"`      // json, logfmt or squid, default json
+	MaxSize    int    `yaml:"max_size"`    // megabytes before rotation, default 100
+	MaxBackups int    `yaml:"max_backups"` // rotated files kept, default all
+	MaxAge     int    `yaml:"max_age"`     // days rotated files are kept, default forever
+	Compress   bool   `yaml:"compress"`    // gzip rotated files
+}
+
+type AdminConfig struct {
+	Addr  string `yaml:"addr"`  // host:port serving the admin api, empty to disable
+	Token string `yaml:"token"` // bearer token required by the admin api, empty for none
+}
+
+// ListenerConfig describe one listening address and the way it is served
+type ListenerConfig struct {
+	Name      string        `yaml:"name"`
+	Addr      string        `yaml:"addr"`      // host:port
+	Protocols []string      `yaml:"protocols"` // socks4, socks5, http, empty for all of them
+	UDPAddr   string        `yaml:"udp_addr"`  // udp associate address announced to clients
+	Auth      AuthConfig    `yaml:"auth"`
+	Access    AccessConfig  `yaml:"access"`   // client ips served
+	Outbound  string        `yaml:"outbound"` // DIRECT or an upstream name, for connections matching no rule
+	Timeouts  TimeoutConfig `yaml:"timeouts"`
+	Bandwidth RateLimit     `yaml:"bandwidth"` // shared by the connections of the listener
+}
+
+type AuthConfig struct {
+	Users    map[string]string `yaml:"users"`
+	Htpasswd string            `yaml:"htpasswd"`
+}
+
+type TimeoutConfig struct {
+	Handshake time.Duration `yaml:"handshake"` // time to send the request, default 30s
+	Dial      time.Duration `yaml:"dial"`      // time to reach the target, default 30s
+	Idle      time.Duration `yaml:"idle"`      // relays with no traffic are closed after it, default never
+}
+
+// LoadConfig read and validate a yaml configuration file
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &Config{Destinations: DestinationConfig{BlockPrivate: true}}
+	err = yaml.Unmarshal(data, cfg)
+	if err != nil {
+		return nil, errors.New("parse " + path + " error:" + err.Error())
+	}
+	err = cfg.Validate()
+	if err != nil {
+		return nil, errors.New(path + ": " + err.Error())
+	}
+	return cfg, nil
+}
+
+// Validate check the config and fill the listener defaults
+func (c *Config) Validate() error {
+	if len(c.Listeners) == 0 {
+		return errors.New("no listener configured")
+	}
+	names := make(map[string]bool)
+	for i := range c.Listeners {
+		l := &c.Listeners[i]
+		if _, _, err := splitListenAddr(l.Addr); err != nil {
+			return err
+		}
+		if l.Name == "" {
+			l.Name = l.Addr
+		}
+		if names[l.Name] {
+			return errors.New("duplicate listener " + l.Name)
+		}
+		names[l.Name] = true
+		for _, p := range l.Protocols {
+			if p != PROTOCOL_SOCKS4 && p != PROTOCOL_SOCKS5 && p != PROTOCOL_HTTP {
+				return errors.New("listener " + l.Name + " has unknown protocol " + p)
+			}
+		}
+		if l.Auth.Htpasswd != "" && len(l.Auth.Users) > 0 {
+			return errors.New("listener " + l.Name + " can not use both users and htpasswd")
+		}
+		if l.Outbound == "" || strings.EqualFold(l.Outbound, ROUTE_DIRECT) {
+			l.Outbound = ROUTE_DIRECT
+		}
+		if _, ok := c.Upstreams[l.Outbound]; !ok && l.Outbound != ROUTE_DIRECT {
+			return errors.New("listener " + l.Name + " has unknown outbound " + l.Outbound)
+		}
+	}
+	switch c.AccessLog.Format {
+	case "", ACCESS_LOG_JSON, ACCESS_LOG_LOGFMT, ACCESS_LOG_SQUID:
+	default:
+		return errors.New("unknown access log format " + c.AccessLog.Format)
+	}
+	err := c.Bandwidth.Validate()
+	if err != nil {
+		return err
+	}
+	for name, urls := range c.Upstreams {
+		if strings.EqualFold(name, ROUTE_DIRECT) || strings.EqualFold(name, ROUTE_REJECT) {
+			return errors.New("upstream name " + name + " is reserved")
+		}
+		if len(urls) == 0 {
+			return errors.New("upstream " + name + " has no url")
+		}
+	}
+	return nil
+}
+
+func splitListenAddr(addr string) (string, int, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, errors.New("bad listen addr " + addr + ":" + err.Error())
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 0 || port > 65535 {
+		return "", 0, errors.New("bad listen port " + addr)
+	}
+	return host, port, nil
+}
+
+// newResolver build the resolver of the dns config, nil for the system one
+func (c *Config) newResolver() (Resolver, error) {
+	if c.DNS.IsZero() {
+		return nil, nil
+	}
+	resolver, err := NewResolver(c.DNS)
+	if err != nil {
+		return nil, errors.New("dns:" + err.Error())
+	}
+	return resolver, nil
+}
+
+// newUpstreams build the dialer of every named upstream, the direct one
+// applies the destination policy and the dial config, every one resolves
+// with resolver
+func (c *Config) newUpstreams(resolver Resolver) (map[string]Dialer, error) {
+	self := []string{c.Metrics.Addr, c.Admin.Addr}
+	for _, l := range c.Listeners {
+		self = append(self, l.Addr)
+	}
+	policy, err := NewDestinationPolicy(c.Destinations, self...)
+	if err != nil {
+		return nil, errors.New("destinations:" + err.Error())
+	}
+	direct := &DirectDialer{Resolver: resolver, FallbackDelay: c.Dial.FallbackDelay, FamilyMemory: c.Dial.FamilyMemory}
+	direct.Dialer.Control = policy.Control
+	// upstream proxies may well be private, their first hop skips the policy
+	hop := &DirectDialer{Resolver: resolver, FallbackDelay: c.Dial.FallbackDelay, FamilyMemory: c.Dial.FamilyMemory}
+	upstreams := map[string]Dialer{ROUTE_DIRECT: direct}
+	for name, urls := range c.Upstreams {
+		dialer, err := newChainDialer(hop, urls...)
+		if err != nil {
+			return nil, errors.New("upstream " + name + ":" + err.Error())
+		}
+		upstreams[name] = dialer
+	}
+	return upstreams, nil
+}
+
+// newRouter build the router shared by every listener, nil without rules
+func (c *Config) newRouter(upstreams map[string]Dialer) (*Router, error) {
+	if len(c.Rules) == 0 && c.RulesFile == "" {
+		return nil, nil
+	}
+	router := NewRouter()
+	for name, dialer := range upstreams {
+		router.AddUpstream(name, dialer)
+	}
+	for _, line := range c.Rules {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		err := router.AddRule(line)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if c.RulesFile != "" {
+		err := router.LoadRules(c.RulesFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return router, nil
+}
+
+func (l *ListenerConfig) newAuthenticator() (Authenticator, error) {
+	if l.Auth.Htpasswd != "" {
+		return NewHtpasswdAuthenticator(l.Auth.Htpasswd)
+	}
+	if len(l.Auth.Users) > 0 {
+		return StaticAuthenticator(l.Auth.Users), nil
+	}
+	return nil, nil
+}
+
+// newSettings build the reloadable settings of a listener
+func (l *ListenerConfig) newSettings(upstreams map[string]Dialer, router *Router, resolver Resolver, shutdownGrace time.Duration) (*serverSettings, error) {
+	authenticator, err := l.newAuthenticator()
+	if err != nil {
+		return nil, errors.New("listener " + l.Name + ":" + err.Error())
+	}
+	access, err := NewAccessList(l.Access)
+	if err != nil {
+		return nil, errors.New("listener " + l.Name + ":" + err.Error())
+	}
+	st := &serverSettings{
+		name:             l.Name,
+		udpIp:            l.UDPAddr,
+		authenticator:    authenticator,
+		dialer:           upstreams[l.Outbound],
+		outbound:         l.Outbound,
+		resolver:         resolver,
+		router:           router,
+		access:           access,
+		handshakeTimeout: DEFAULT_HANDSHAKE_TIMEOUT,
+		dialTimeout:      DEFAULT_DIAL_TIMEOUT,
+		idleTimeout:      l.Timeouts.Idle,
+		shutdownGrace:    DEFAULT_SHUTDOWN_GRACE,
+	}
+	if l.Timeouts.Handshake > 0 {
+		st.handshakeTimeout = l.Timeouts.Handshake
+	}
+	if l.Timeouts.Dial > 0 {
+		st.dialTimeout = l.Timeouts.Dial
+	}
+	if len(l.Protocols) > 0 {
+		st.protocols = make(map[string]bool)
+		for _, p := range l.Protocols {
+			st.protocols[p] = true
+		}
+	}
+	if shutdownGrace > 0 {
+		st.shutdownGrace = shutdownGrace
+	}
+	return st, nil
+}
@@ -0,0 +1,199 @@
+package proxy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeConfig write a config file in a test directory and return its path
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	err := os.WriteFile(path, []byte(content), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigBlockPrivateDefault(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    bool
+	}{
+		{name: "unset", content: "listeners: [{addr: ':1080'}]\n", want: true},
+		{name: "other destination keys", content: "listeners: [{addr: ':1080'}]\ndestinations: {deny: [203.0.113.0/24]}\n", want: true},
+		{name: "disabled", content: "listeners: [{addr: ':1080'}]\ndestinations: {block_private: false}\n", want: false},
+		{name: "enabled", content: "listeners: [{addr: ':1080'}]\ndestinations: {block_private: true}\n", want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := LoadConfig(writeConfig(t, tt.content))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Destinations.BlockPrivate != tt.want {
+				t.Errorf("block_private %v, want %v", cfg.Destinations.BlockPrivate, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Config
+		err  bool
+	}{
+		{name: "one listener", cfg: Config{Listeners: []ListenerConfig{{Addr: ":1080"}}}},
+		{name: "no listener", cfg: Config{}, err: true},
+		{name: "bad addr", cfg: Config{Listeners: []ListenerConfig{{Addr: "1080"}}}, err: true},
+		{name: "bad port", cfg: Config{Listeners: []ListenerConfig{{Addr: ":socks"}}}, err: true},
+		{name: "port out of range", cfg: Config{Listeners: []ListenerConfig{{Addr: ":65536"}}}, err: true},
+		{
+			name: "duplicate name",
+			cfg:  Config{Listeners: []ListenerConfig{{Name: "a", Addr: ":1080"}, {Name: "a", Addr: ":1081"}}},
+			err:  true,
+		},
+		{
+			name: "duplicate default name",
+			cfg:  Config{Listeners: []ListenerConfig{{Addr: ":1080"}, {Addr: ":1080"}}},
+			err:  true,
+		},
+		{
+			name: "protocols",
+			cfg:  Config{Listeners: []ListenerConfig{{Addr: ":1080", Protocols: []string{PROTOCOL_SOCKS4, PROTOCOL_SOCKS5, PROTOCOL_HTTP}}}},
+		},
+		{name: "unknown protocol", cfg: Config{Listeners: []ListenerConfig{{Addr: ":1080", Protocols: []string{"https"}}}}, err: true},
+		{
+			name: "users and htpasswd",
+			cfg:  Config{Listeners: []ListenerConfig{{Addr: ":1080", Auth: AuthConfig{Users: map[string]string{"bob": "pw"}, Htpasswd: "htpasswd"}}}},
+			err:  true,
+		},
+		{
+			name: "upstream outbound",
+			cfg:  Config{Upstreams: map[string][]string{"corp": {"http://127.0.0.1:3128"}}, Listeners: []ListenerConfig{{Addr: ":1080", Outbound: "corp"}}},
+		},
+		{name: "unknown outbound", cfg: Config{Listeners: []ListenerConfig{{Addr: ":1080", Outbound: "corp"}}}, err: true},
+		{
+			name: "reserved upstream name",
+			cfg:  Config{Upstreams: map[string][]string{"reject": {"http://127.0.0.1:3128"}}, Listeners: []ListenerConfig{{Addr: ":1080"}}},
+			err:  true,
+		},
+		{
+			name: "upstream without url",
+			cfg:  Config{Upstreams: map[string][]string{"corp": {}}, Listeners: []ListenerConfig{{Addr: ":1080"}}},
+			err:  true,
+		},
+		{
+			name: "access log format",
+			cfg:  Config{AccessLog: AccessLogConfig{Format: ACCESS_LOG_SQUID}, Listeners: []ListenerConfig{{Addr: ":1080"}}},
+		},
+		{
+			name: "unknown access log format",
+			cfg:  Config{AccessLog: AccessLogConfig{Format: "xml"}, Listeners: []ListenerConfig{{Addr: ":1080"}}},
+			err:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.cfg.Validate()
+			if (err != nil) != tt.err {
+				t.Errorf("error %v, want error %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestConfigValidateDefaults(t *testing.T) {
+	cfg := &Config{Listeners: []ListenerConfig{{Addr: "127.0.0.1:1080"}, {Name: "b", Addr: ":1081", Outbound: "direct"}}}
+	err := cfg.Validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Listeners[0].Name != "127.0.0.1:1080" || cfg.Listeners[0].Outbound != ROUTE_DIRECT {
+		t.Errorf("first listener %+v, want named after its addr and direct", cfg.Listeners[0])
+	}
+	if cfg.Listeners[1].Outbound != ROUTE_DIRECT {
+		t.Errorf("outbound %s, want %s", cfg.Listeners[1].Outbound, ROUTE_DIRECT)
+	}
+}
+
+func TestLoadConfigExample(t *testing.T) {
+	cfg, err := LoadConfig("config.example.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Listeners) != 3 {
+		t.Fatalf("%d listeners, want 3", len(cfg.Listeners))
+	}
+	socks5 := cfg.Listeners[1]
+	if socks5.Name != "socks5" || socks5.Addr != "0.0.0.0:1081" || len(socks5.Protocols) != 1 || socks5.Protocols[0] != PROTOCOL_SOCKS5 ||
+		socks5.Auth.Users["alice"] != "secret" || socks5.Outbound != "tunnel" || socks5.Timeouts.Handshake != 10*time.Second ||
+		socks5.Timeouts.Dial != 15*time.Second || socks5.Timeouts.Idle != 10*time.Minute {
+		t.Errorf("socks5 listener %+v", socks5)
+	}
+	if len(cfg.Upstreams["tunnel"]) != 2 || len(cfg.Rules) != 3 || cfg.ShutdownGrace != 10*time.Second {
+		t.Errorf("upstreams %v rules %v shutdown grace %v", cfg.Upstreams, cfg.Rules, cfg.ShutdownGrace)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	for _, content := range []string{
+		"listeners: {addr: ':1080'}\n",
+		"listeners: [{addr: ':1080', timeouts: {dial: soon}}]\n",
+		"log_level: info\n",
+	} {
+		if _, err := LoadConfig(writeConfig(t, content)); err == nil {
+			t.Errorf("%q: no error", content)
+		}
+	}
+	if _, err := LoadConfig(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Error("missing file: no error")
+	}
+}
+
+func TestListenerNewSettings(t *testing.T) {
+	corp := NewDirectDialer()
+	upstreams := map[string]Dialer{ROUTE_DIRECT: NewDirectDialer(), "corp": corp}
+	l := &ListenerConfig{
+		Name:      "socks",
+		Addr:      ":1080",
+		Protocols: []string{PROTOCOL_SOCKS5},
+		Auth:      AuthConfig{Users: map[string]string{"bob": "pw"}},
+		Outbound:  "corp",
+		Timeouts:  TimeoutConfig{Dial: time.Second, Idle: time.Minute},
+	}
+	st, err := l.newSettings(upstreams, nil, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.dialer != corp || st.outbound != "corp" {
+		t.Errorf("outbound %s %#v, want corp", st.outbound, st.dialer)
+	}
+	if len(st.protocols) != 1 || !st.protocols[PROTOCOL_SOCKS5] {
+		t.Errorf("protocols %v, want socks5", st.protocols)
+	}
+	if _, ok := st.authenticator.(StaticAuthenticator); !ok {
+		t.Errorf("authenticator %#v, want the users", st.authenticator)
+	}
+	if st.handshakeTimeout != DEFAULT_HANDSHAKE_TIMEOUT || st.dialTimeout != time.Second || st.idleTimeout != time.Minute ||
+		st.shutdownGrace != DEFAULT_SHUTDOWN_GRACE {
+		t.Errorf("timeouts %v %v %v %v", st.handshakeTimeout, st.dialTimeout, st.idleTimeout, st.shutdownGrace)
+	}
+
+	st, err = (&ListenerConfig{Name: "open", Outbound: ROUTE_DIRECT}).newSettings(upstreams, nil, nil, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.protocols != nil || st.authenticator != nil || st.shutdownGrace != time.Second {
+		t.Errorf("protocols %v authenticator %#v shutdown grace %v", st.protocols, st.authenticator, st.shutdownGrace)
+	}
+	_, err = (&ListenerConfig{Name: "bad", Auth: AuthConfig{Htpasswd: "missing"}}).newSettings(upstreams, nil, nil, 0)
+	if err == nil {
+		t.Error("missing htpasswd: no error")
+	}
+}
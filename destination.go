@@ -0,0 +1,158 @@
+package proxy
+
+import (
+	"net"
+	"strconv"
+	"syscall"
+)
+
+// special purpose ranges blocked along with the private ones, the
+// loopback, private and link-local ranges are told by net.IP itself
+var reservedNetworks, _ = parseCIDRs([]string{
+	"0.0.0.0/8",      // this network
+	"100.64.0.0/10",  // carrier grade nat
+	"192.0.0.0/24",   // ietf protocol assignments
+	"198.18.0.0/15",  // benchmarking
+	"240.0.0.0/4",    // reserved and broadcast
+	"64:ff9b::/96",   // nat64, may embed any ipv4 address
+	"64:ff9b:1::/48", // local use nat64
+})
+
+// DestinationConfig restrict the targets of direct connections, checked
+// on the address connected to after dns resolution so a name resolving to
+// a blocked address is refused too. The addresses of the proxy listeners,
+// admin api and metrics are always refused
+type DestinationConfig struct {
+	BlockPrivate bool     `yaml:"block_private"` // loopback, private, link-local and reserved ranges, cloud metadata included, default true
+	Deny         []string `yaml:"deny"`          // more ips or cidrs to refuse
+	Allow        []string `yaml:"allow"`         // ips or cidrs served even when private or denied
+}
+
+// blockedError is a target refused by the destination policy, it is
+// answered like a request rejected by a rule
+type blockedError struct {
+	addr   string
+	reason string
+}
+
+func (e *blockedError) Error() string {
+	return "destination " + e.addr + " is blocked, " + e.reason
+}
+
+func (e *blockedError) Is(target error) bool {
+	return target == errRejected
+}
+
+// DestinationPolicy decide which addresses direct connections may reach
+type DestinationPolicy struct {
+	blockPrivate bool
+	deny         []*net.IPNet
+	allow        []*net.IPNet
+	self         map[string]bool // ip:port of the proxy itself
+	selfPorts    map[int]bool    // ports the proxy binds on every interface
+	localIPs     map[string]bool // ips of this host
+}
+
+// NewDestinationPolicy build the policy of cfg, selfAddrs are the
+// host:port the proxy listens on
+func NewDestinationPolicy(cfg DestinationConfig, selfAddrs ...string) (*DestinationPolicy, error) {
+	p := &DestinationPolicy{
+		blockPrivate: cfg.BlockPrivate,
+		self:         make(map[string]bool),
+		selfPorts:    make(map[int]bool),
+		localIPs:     make(map[string]bool),
+	}
+	var err error
+	p.deny, err = parseCIDRs(cfg.Deny)
+	if err != nil {
+		return nil, err
+	}
+	p.allow, err = parseCIDRs(cfg.Allow)
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range selfAddrs {
+		if addr == "" {
+			continue
+		}
+		host, portStr, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		port, err := strconv.Atoi(portStr)
+		if err != nil {
+			return nil, err
+		}
+		ip := net.ParseIP(host)
+		if host == "" || (ip != nil && ip.IsUnspecified()) {
+			p.selfPorts[port] = true
+			continue
+		}
+		ips := []net.IP{ip}
+		if ip == nil {
+			ips, err = net.LookupIP(host)
+			if err != nil {
+				return nil, err
+			}
+		}
+		for _, ip := range ips {
+			p.self[net.JoinHostPort(ip.String(), portStr)] = true
+		}
+	}
+	if len(p.selfPorts) > 0 {
+		addrs, _ := net.InterfaceAddrs()
+		for _, a := range addrs {
+			if ipNet, ok := a.(*net.IPNet); ok {
+				p.localIPs[ipNet.IP.String()] = true
+			}
+		}
+	}
+	return p, nil
+}
+
+// Control is the net.Dialer hook applying the policy, it runs on the
+// resolved address before connecting, for tcp and udp
+func (p *DestinationPolicy) Control(network, address string, _ syscall.RawConn) error {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	port, _ := strconv.Atoi(portStr)
+	return p.check(net.ParseIP(host), port)
+}
+
+// check return a blockedError when ip:port may not be reached
+func (p *DestinationPolicy) check(ip net.IP, port int) error {
+	if ip == nil {
+		return nil
+	}
+	addr := net.JoinHostPort(ip.String(), strconv.Itoa(port))
+	if p.self[addr] || (p.selfPorts[port] && (ip.IsLoopback() || ip.IsUnspecified() || p.localIPs[ip.String()])) {
+		return &blockedError{addr: addr, reason: "address of the proxy"}
+	}
+	if containsIP(p.allow, ip) {
+		return nil
+	}
+	if containsIP(p.deny, ip) {
+		return &blockedError{addr: addr, reason: "denied"}
+	}
+	if p.blockPrivate && isPrivateIP(ip) {
+		return &blockedError{addr: addr, reason: "private address"}
+	}
+	return nil
+}
+
+func isPrivateIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() ||
+		containsIP(reservedNetworks, ip)
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,183 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestDestinationPolicyCheck(t *testing.T) {
+	tests := []struct {
+		name  string
+		cfg   DestinationConfig
+		self  []string
+		ip    string
+		port  int
+		block bool
+	}{
+		{name: "public open", ip: "93.184.216.34", port: 443},
+		{name: "private open", ip: "10.0.0.1", port: 80},
+		{name: "private blocked", cfg: DestinationConfig{BlockPrivate: true}, ip: "10.0.0.1", port: 80, block: true},
+		{name: "loopback blocked", cfg: DestinationConfig{BlockPrivate: true}, ip: "127.0.0.1", port: 80, block: true},
+		{name: "ipv6 loopback blocked", cfg: DestinationConfig{BlockPrivate: true}, ip: "::1", port: 80, block: true},
+		{name: "metadata blocked", cfg: DestinationConfig{BlockPrivate: true}, ip: "169.254.169.254", port: 80, block: true},
+		{name: "unspecified blocked", cfg: DestinationConfig{BlockPrivate: true}, ip: "0.0.0.0", port: 80, block: true},
+		{name: "carrier nat blocked", cfg: DestinationConfig{BlockPrivate: true}, ip: "100.64.0.1", port: 80, block: true},
+		{name: "nat64 blocked", cfg: DestinationConfig{BlockPrivate: true}, ip: "64:ff9b::a00:1", port: 80, block: true},
+		{name: "ula blocked", cfg: DestinationConfig{BlockPrivate: true}, ip: "fd00::1", port: 80, block: true},
+		{name: "public with block private", cfg: DestinationConfig{BlockPrivate: true}, ip: "93.184.216.34", port: 443},
+		{name: "denied", cfg: DestinationConfig{Deny: []string{"203.0.113.0/24"}}, ip: "203.0.113.7", port: 80, block: true},
+		{name: "denied single ip", cfg: DestinationConfig{Deny: []string{"203.0.113.7"}}, ip: "203.0.113.8", port: 80},
+		{
+			name:  "allowed private",
+			cfg:   DestinationConfig{BlockPrivate: true, Allow: []string{"10.20.0.5"}},
+			ip:    "10.20.0.5",
+			port:  80,
+			block: false,
+		},
+		{
+			name: "allow beats deny",
+			cfg:  DestinationConfig{Deny: []string{"203.0.113.0/24"}, Allow: []string{"203.0.113.7/32"}},
+			ip:   "203.0.113.7",
+			port: 80,
+		},
+		{name: "self", self: []string{"192.0.2.1:1080"}, ip: "192.0.2.1", port: 1080, block: true},
+		{name: "self other port", self: []string{"192.0.2.1:1080"}, ip: "192.0.2.1", port: 1081},
+		{
+			name:  "self even allowed",
+			cfg:   DestinationConfig{Allow: []string{"192.0.2.1"}},
+			self:  []string{"192.0.2.1:1080"},
+			ip:    "192.0.2.1",
+			port:  1080,
+			block: true,
+		},
+		{name: "any address port on loopback", self: []string{":1080"}, ip: "127.0.0.1", port: 1080, block: true},
+		{name: "any address other port", self: []string{"0.0.0.0:1080"}, ip: "127.0.0.1", port: 1081},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := NewDestinationPolicy(tt.cfg, tt.self...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = p.check(net.ParseIP(tt.ip), tt.port)
+			if (err != nil) != tt.block {
+				t.Fatalf("check %s:%d = %v, want blocked %v", tt.ip, tt.port, err, tt.block)
+			}
+			if err != nil && !errors.Is(err, errRejected) {
+				t.Errorf("%v is not a rejection", err)
+			}
+		})
+	}
+}
+
+func TestNewDestinationPolicyErrors(t *testing.T) {
+	for _, cfg := range []DestinationConfig{
+		{Deny: []string{"not an ip"}},
+		{Allow: []string{"10.0.0.0/33"}},
+	} {
+		if _, err := NewDestinationPolicy(cfg); err == nil {
+			t.Errorf("%+v: no error", cfg)
+		}
+	}
+	if _, err := NewDestinationPolicy(DestinationConfig{}, "no port"); err == nil {
+		t.Error("bad self address: no error")
+	}
+}
+
+// TestBlockedDestinationReplies check a server with the default dialer
+// refuses a loopback target with the reply of each protocol
+func TestBlockedDestinationReplies(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			con, err := target.Accept()
+			if err != nil {
+				return
+			}
+			_ = con.Close()
+			t.Error("blocked target reached")
+		}
+	}()
+	port := target.Addr().(*net.TCPAddr).Port
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := NewSocksServer("127.0.0.1", 0)
+	err = s.Listen(ctx)
+	if err != nil {
+		cancel()
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		_ = s.Serve(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	tests := []struct {
+		name    string
+		request []byte
+		want    []byte
+	}{
+		{
+			name:    "socks5",
+			request: []byte{5, 1, 0, 5, 1, 0, 1, 127, 0, 0, 1, byte(port >> 8), byte(port)},
+			want:    []byte{5, 0, 5, 2},
+		},
+		{
+			name:    "socks4",
+			request: []byte{4, 1, byte(port >> 8), byte(port), 127, 0, 0, 1, 0},
+			want:    []byte{0, 0x5B},
+		},
+		{
+			name:    "http connect",
+			request: []byte("CONNECT 127.0.0.1:" + strconv.Itoa(port) + " HTTP/1.1\r\n\r\n"),
+			want:    []byte("HTTP/1.1 403 Forbidden\r\n"),
+		},
+		{
+			name:    "http forward",
+			request: []byte("GET http://127.0.0.1:" + strconv.Itoa(port) + "/ HTTP/1.1\r\n\r\n"),
+			want:    []byte("HTTP/1.1 403 Forbidden\r\n"),
+		},
+		{
+			name:    "socks5 proxy itself",
+			request: append([]byte{5, 1, 0, 5, 1, 0, 1, 127, 0, 0, 1}, byte(s.ln.Addr().(*net.TCPAddr).Port>>8), byte(s.ln.Addr().(*net.TCPAddr).Port)),
+			want:    []byte{5, 0, 5, 2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, err := net.Dial("tcp", s.ln.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			_ = client.SetDeadline(time.Now().Add(2 * time.Second))
+			_, err = client.Write(tt.request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make([]byte, len(tt.want))
+			_, err = io.ReadFull(bufio.NewReader(client), got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != string(tt.want) {
+				t.Errorf("reply %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
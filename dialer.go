@@ -0,0 +1,198 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Dialer open the outbound connections of the proxy, network is tcp or udp
+// and address a host:port where host may be a domain. *DirectDialer is the
+// direct Dialer
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// NewDirectDialer connect the targets from this host
+func NewDirectDialer() Dialer {
+	return &DirectDialer{}
+}
+
+// DirectDialer connect the targets from this host, domains are resolved
+// with Resolver and their ipv6 and ipv4 addresses raced, happy eyeballs
+// style. The zero value is ready to use
+type DirectDialer struct {
+	Dialer        net.Dialer
+	Resolver      Resolver      // nil for the system resolver
+	FallbackDelay time.Duration // head start of each tcp attempt, see DialConfig
+	FamilyMemory  time.Duration // time a failed family is tried last, see DialConfig
+
+	familiesOnce sync.Once
+	families     *familyMemory
+}
+
+func (d *DirectDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || net.ParseIP(host) != nil {
+		return d.Dialer.DialContext(ctx, network, address)
+	}
+	resolver := d.Resolver
+	if resolver == nil {
+		resolver = systemResolver{}
+	}
+	ips, err := resolver.LookupIP(ctx, host)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+	if len(ips) == 0 {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}}
+	}
+	if network == "tcp" {
+		return d.dialParallel(ctx, network, host, port, ips)
+	}
+	// udp sockets connect without a handshake, the first address is used
+	var firstErr error
+	for _, ip := range ips {
+		con, err := d.Dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return con, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, firstErr
+}
+
+// NewUpstreamDialer reach the targets through the proxy described by rawURL,
+// one of socks5://, socks5h://, socks4://, socks4a:// or http:// with optional
+// user:password. forward is used to reach the proxy itself so dialers can be
+// chained, nil means direct
+func NewUpstreamDialer(rawURL string, forward Dialer) (Dialer, error) {
+	return newUpstreamDialer(rawURL, forward, nil)
+}
+
+// newUpstreamDialer is NewUpstreamDialer with the resolver of the targets
+// of socks5:// and socks4://, nil for the system resolver
+func newUpstreamDialer(rawURL string, forward Dialer, resolver Resolver) (Dialer, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, errors.New("bad upstream url " + rawURL + ":" + err.Error())
+	}
+	if u.Host == "" || u.Port() == "" {
+		return nil, errors.New("upstream url needs host:port " + rawURL)
+	}
+	if forward == nil {
+		forward = NewDirectDialer()
+	}
+	username := u.User.Username()
+	password, _ := u.User.Password()
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		return &Socks5Dialer{
+			addr:         u.Host,
+			username:     username,
+			password:     password,
+			resolveLocal: u.Scheme == "socks5",
+			resolver:     resolver,
+			forward:      forward,
+		}, nil
+	case "socks4", "socks4a":
+		userid := username
+		if _, ok := u.User.Password(); ok {
+			userid += ":" + password
+		}
+		return &Socks4Dialer{
+			addr:         u.Host,
+			userid:       userid,
+			resolveLocal: u.Scheme == "socks4",
+			resolver:     resolver,
+			forward:      forward,
+		}, nil
+	case "http":
+		return &HTTPDialer{
+			addr:     u.Host,
+			username: username,
+			password: password,
+			forward:  forward,
+		}, nil
+	}
+	return nil, errors.New("unsupported upstream scheme " + u.Scheme)
+}
+
+// NewChainDialer reach the targets through every upstream in order, the first
+// one is dialed directly and each next one through the previous hops
+func NewChainDialer(rawURLs ...string) (Dialer, error) {
+	return newChainDialer(&DirectDialer{}, rawURLs...)
+}
+
+// newChainDialer is NewChainDialer with the first hop dialed by direct,
+// whose resolver also resolves the targets of socks5:// and socks4://
+func newChainDialer(direct *DirectDialer, rawURLs ...string) (Dialer, error) {
+	var dialer Dialer = direct
+	for _, rawURL := range rawURLs {
+		next, err := newUpstreamDialer(rawURL, dialer, direct.Resolver)
+		if err != nil {
+			return nil, err
+		}
+		dialer = next
+	}
+	return dialer, nil
+}
+
+// handshakeContext run the handshake with an upstream proxy on con,
+// giving up when ctx is done
+func handshakeContext(ctx context.Context, con net.Conn, handshake func() error) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = con.SetDeadline(deadline)
+		defer func() {
+			_ = con.SetDeadline(time.Time{})
+		}()
+	}
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			_ = con.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+	err := handshake()
+	// wait for the watcher so a ctx canceled once the dial returns never
+	// expires the connection handed to the caller
+	close(done)
+	<-stopped
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	return err
+}
+
+// resolveIP lookup host with resolver when it is a domain, preferring ipv4
+// when want4 is set. A nil resolver is the system one
+func resolveIP(ctx context.Context, resolver Resolver, host string, want4 bool) (net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return ip, nil
+	}
+	if resolver == nil {
+		resolver = systemResolver{}
+	}
+	ips, err := resolver.LookupIP(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		if !want4 || ip.To4() != nil {
+			return ip, nil
+		}
+	}
+	return nil, errors.New("no suitable address for " + host)
+}
@@ -0,0 +1,223 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestNewUpstreamDialer(t *testing.T) {
+	tests := []struct {
+		url  string
+		want Dialer
+		err  bool
+	}{
+		{
+			url:  "socks5://bob:pw@127.0.0.1:1080",
+			want: &Socks5Dialer{addr: "127.0.0.1:1080", username: "bob", password: "pw", resolveLocal: true},
+		},
+		{
+			url:  "socks5h://proxy.example:1080",
+			want: &Socks5Dialer{addr: "proxy.example:1080"},
+		},
+		{
+			url:  "socks4://bob@127.0.0.1:1080",
+			want: &Socks4Dialer{addr: "127.0.0.1:1080", userid: "bob", resolveLocal: true},
+		},
+		{
+			url:  "socks4a://bob:pw@[::1]:1080",
+			want: &Socks4Dialer{addr: "[::1]:1080", userid: "bob:pw"},
+		},
+		{
+			url:  "http://bob:pw@127.0.0.1:3128",
+			want: &HTTPDialer{addr: "127.0.0.1:3128", username: "bob", password: "pw"},
+		},
+		{url: "https://127.0.0.1:3128", err: true},
+		{url: "socks5://127.0.0.1", err: true},
+		{url: "127.0.0.1:1080", err: true},
+		{url: "socks5://127.0.0.1:1080/%zz", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			got, err := NewUpstreamDialer(tt.url, nil)
+			if (err != nil) != tt.err {
+				t.Fatalf("error %v, want error %v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+			// forward defaults to a direct dialer, left out of the comparison
+			switch d := got.(type) {
+			case *Socks5Dialer:
+				if _, ok := d.forward.(*DirectDialer); !ok {
+					t.Errorf("forward %#v is not direct", d.forward)
+				}
+				d.forward = nil
+				if want, ok := tt.want.(*Socks5Dialer); !ok || *d != *want {
+					t.Errorf("got %#v, want %#v", d, tt.want)
+				}
+			case *Socks4Dialer:
+				if _, ok := d.forward.(*DirectDialer); !ok {
+					t.Errorf("forward %#v is not direct", d.forward)
+				}
+				d.forward = nil
+				if want, ok := tt.want.(*Socks4Dialer); !ok || *d != *want {
+					t.Errorf("got %#v, want %#v", d, tt.want)
+				}
+			case *HTTPDialer:
+				if _, ok := d.forward.(*DirectDialer); !ok {
+					t.Errorf("forward %#v is not direct", d.forward)
+				}
+				d.forward = nil
+				if want, ok := tt.want.(*HTTPDialer); !ok || *d != *want {
+					t.Errorf("got %#v, want %#v", d, tt.want)
+				}
+			default:
+				t.Errorf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewChainDialerErrors(t *testing.T) {
+	_, err := NewChainDialer("socks5://127.0.0.1:1080", "ftp://127.0.0.1:21")
+	if err == nil {
+		t.Error("bad hop: no error")
+	}
+	d, err := NewChainDialer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := d.(*DirectDialer); !ok {
+		t.Errorf("empty chain %#v is not direct", d)
+	}
+}
+
+// expectEcho check con is relayed to an echo server
+func expectEcho(t *testing.T, con net.Conn) {
+	t.Helper()
+	_ = con.SetDeadline(time.Now().Add(2 * time.Second))
+	_, err := con.Write([]byte("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 4)
+	_, err = io.ReadFull(con, got)
+	if err != nil || string(got) != "ping" {
+		t.Errorf("relayed %q %v, want ping", got, err)
+	}
+}
+
+func TestUpstreamDialers(t *testing.T) {
+	echo := newEchoServer(t)
+	udpEcho := newUdpEchoServer(t)
+	withAuth := newTestServer(t)
+	withAuth.SetAuthenticator(StaticAuthenticator{"bob": "pw"})
+	open := newTestServer(t)
+	authAddr, openAddr := withAuth.ln.Addr().String(), open.ln.Addr().String()
+	tests := []struct {
+		name    string
+		urls    []string
+		network string
+		target  string
+	}{
+		{name: "socks5", urls: []string{"socks5://bob:pw@" + authAddr}, network: "tcp", target: echo.String()},
+		{name: "socks5 domain", urls: []string{"socks5h://" + openAddr}, network: "tcp", target: net.JoinHostPort("localhost", strconv.Itoa(echo.Port))},
+		{name: "socks5 udp", urls: []string{"socks5://bob:pw@" + authAddr}, network: "udp", target: udpEcho.String()},
+		{name: "socks4", urls: []string{"socks4://bob:pw@" + authAddr}, network: "tcp", target: echo.String()},
+		{name: "socks4a", urls: []string{"socks4a://" + openAddr}, network: "tcp", target: net.JoinHostPort("localhost", strconv.Itoa(echo.Port))},
+		{name: "http", urls: []string{"http://bob:pw@" + authAddr}, network: "tcp", target: echo.String()},
+		{
+			name:    "chain",
+			urls:    []string{"socks5h://bob:pw@" + authAddr, "socks4a://" + openAddr, "http://bob:pw@" + authAddr},
+			network: "tcp",
+			target:  echo.String(),
+		},
+		{
+			name:    "chain udp",
+			urls:    []string{"socks5h://" + openAddr, "socks5://bob:pw@" + authAddr},
+			network: "udp",
+			target:  udpEcho.String(),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := NewChainDialer(tt.urls...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+			con, err := d.DialContext(ctx, tt.network, tt.target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer con.Close()
+			expectEcho(t, con)
+		})
+	}
+}
+
+func TestUpstreamDialerErrors(t *testing.T) {
+	withAuth := newTestServer(t)
+	withAuth.SetAuthenticator(StaticAuthenticator{"bob": "pw"})
+	addr := withAuth.ln.Addr().String()
+	closed := freePort(t)
+	tests := []struct {
+		name    string
+		url     string
+		network string
+		target  string
+		rep     byte // reply code of a socks5ReplyError, 0 for any error
+	}{
+		{name: "socks5 wrong password", url: "socks5://bob:guess@" + addr, network: "tcp", target: closed},
+		{name: "socks5 refused", url: "socks5://bob:pw@" + addr, network: "tcp", target: closed, rep: 0x05},
+		{name: "socks5 network", url: "socks5://bob:pw@" + addr, network: "unix", target: closed},
+		{name: "socks4 refused", url: "socks4://bob:pw@" + addr, network: "tcp", target: closed},
+		{name: "socks4 ipv6", url: "socks4://bob:pw@" + addr, network: "tcp", target: "[::1]:80"},
+		{name: "socks4 udp", url: "socks4://bob:pw@" + addr, network: "udp", target: closed},
+		{name: "http wrong password", url: "http://bob:guess@" + addr, network: "tcp", target: closed},
+		{name: "http refused", url: "http://bob:pw@" + addr, network: "tcp", target: closed},
+		{name: "http udp", url: "http://bob:pw@" + addr, network: "udp", target: closed},
+		{name: "upstream down", url: "socks5://" + closed, network: "tcp", target: addr},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := NewUpstreamDialer(tt.url, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+			con, err := d.DialContext(ctx, tt.network, tt.target)
+			if err == nil {
+				_ = con.Close()
+				t.Fatal("no error")
+			}
+			var replyErr *socks5ReplyError
+			if tt.rep != 0 && (!errors.As(err, &replyErr) || replyErr.rep != tt.rep) {
+				t.Errorf("error %v, want upstream reply %d", err, tt.rep)
+			}
+		})
+	}
+}
+
+func TestHandshakeContextCanceled(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	err := handshakeContext(ctx, client, func() error {
+		// the silent upstream never answers
+		_, err := client.Read(make([]byte, 1))
+		return err
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("error %v, want canceled", err)
+	}
+}
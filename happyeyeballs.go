@@ -0,0 +1,212 @@
+package proxy
+
+import (
+	"context"
+	"github.com/sirupsen/logrus"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_FALLBACK_DELAY = 250 * time.Millisecond // head start of an attempt over the next one, rfc 8305
+	DEFAULT_FAMILY_MEMORY  = 10 * time.Minute       // time a failed address family is tried last
+
+	familyMemorySize = 4096
+)
+
+// DialConfig tune the direct connections to targets resolving to several
+// addresses, ipv6 and ipv4 ones are tried alternately, each attempt being
+// given a head start over the next one
+type DialConfig struct {
+	FallbackDelay time.Duration `yaml:"fallback_delay"` // head start, default 250ms, negative to try addresses one after the other
+	FamilyMemory  time.Duration `yaml:"family_memory"`  // time a family beaten by the other one is tried last for a host, default 10m, negative to disable
+}
+
+// familyMemory remember the hosts whose preferred address family recently
+// lost against the other one
+type familyMemory struct {
+	mu     sync.Mutex
+	ttl    time.Duration
+	failed map[string]familyFailure
+}
+
+type familyFailure struct {
+	ipv6  bool
+	until time.Time
+}
+
+func newFamilyMemory(ttl time.Duration) *familyMemory {
+	return &familyMemory{ttl: ttl, failed: make(map[string]familyFailure)}
+}
+
+// failedFamily tell if a family of host recently failed and which one
+func (m *familyMemory) failedFamily(host string) (ipv6 bool, ok bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, ok := m.failed[host]
+	if ok && time.Now().After(f.until) {
+		delete(m.failed, host)
+		return false, false
+	}
+	return f.ipv6, ok
+}
+
+// record the outcome of a race for host, the preferred family is
+// remembered as failed when the other one won and forgotten when it won
+func (m *familyMemory) record(host string, preferred, winner net.IP) {
+	preferred6, winner6 := isIPv6(preferred), isIPv6(winner)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if preferred6 == winner6 {
+		delete(m.failed, host)
+		return
+	}
+	// kept until it expires so the preferred family is tried again then
+	if f, ok := m.failed[host]; ok && time.Now().Before(f.until) {
+		return
+	}
+	if len(m.failed) >= familyMemorySize {
+		now := time.Now()
+		for h, f := range m.failed {
+			if now.After(f.until) {
+				delete(m.failed, h)
+			}
+		}
+		if len(m.failed) >= familyMemorySize {
+			return
+		}
+	}
+	m.failed[host] = familyFailure{ipv6: preferred6, until: time.Now().Add(m.ttl)}
+}
+
+func isIPv6(ip net.IP) bool {
+	return ip.To4() == nil
+}
+
+// sortAddrs interleave the ipv6 and ipv4 addresses starting with the
+// family of the first one, or with the family told by prefer6 on override
+func sortAddrs(ips []net.IP, override bool, prefer6 bool) []net.IP {
+	var first, second []net.IP
+	firstIs6 := isIPv6(ips[0])
+	if override {
+		firstIs6 = prefer6
+	}
+	for _, ip := range ips {
+		if isIPv6(ip) == firstIs6 {
+			first = append(first, ip)
+		} else {
+			second = append(second, ip)
+		}
+	}
+	sorted := make([]net.IP, 0, len(ips))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			sorted = append(sorted, first[i])
+		}
+		if i < len(second) {
+			sorted = append(sorted, second[i])
+		}
+	}
+	return sorted
+}
+
+type dialResult struct {
+	con net.Conn
+	ip  net.IP
+	err error
+}
+
+// dialParallel connect port on one of the addresses of host, an attempt is
+// started each time the previous one failed or ran for the fallback delay
+// and the first connection established wins
+func (d *DirectDialer) dialParallel(ctx context.Context, network, host, port string, ips []net.IP) (net.Conn, error) {
+	preferred := ips[0]
+	memory := d.familyMemory()
+	if memory != nil {
+		failed6, ok := memory.failedFamily(host)
+		ips = sortAddrs(ips, ok, !failed6)
+	} else {
+		ips = sortAddrs(ips, false, false)
+	}
+	delay := d.FallbackDelay
+	if delay == 0 {
+		delay = DEFAULT_FALLBACK_DELAY
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan dialResult, len(ips))
+	next, pending := 0, 0
+	var fallback <-chan time.Time
+	start := func() {
+		ip := ips[next]
+		next++
+		pending++
+		go func() {
+			con, err := d.Dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+			results <- dialResult{con: con, ip: ip, err: err}
+		}()
+		fallback = nil
+		if delay > 0 && next < len(ips) {
+			fallback = time.After(delay)
+		}
+	}
+	start()
+	var firstErr error
+	for pending > 0 {
+		select {
+		case <-fallback:
+			start()
+		case r := <-results:
+			pending--
+			if r.err != nil {
+				if firstErr == nil {
+					firstErr = r.err
+				}
+				if next < len(ips) && ctx.Err() == nil {
+					start()
+				}
+				continue
+			}
+			// the attempts still running lose, a late connection is closed
+			cancel()
+			go func(pending int) {
+				for i := 0; i < pending; i++ {
+					if late := <-results; late.con != nil {
+						_ = late.con.Close()
+					}
+				}
+			}(pending)
+			if memory != nil {
+				memory.record(host, preferred, r.ip)
+			}
+			if !r.ip.Equal(ips[0]) {
+				logrus.Debugln(host + " reached on " + r.ip.String() + " after trying " + ips[0].String())
+			}
+			return r.con, nil
+		}
+	}
+	return nil, firstErr
+}
+
+// familyMemory is the failed families memory of d, nil when disabled
+func (d *DirectDialer) familyMemory() *familyMemory {
+	if d.FamilyMemory < 0 {
+		return nil
+	}
+	d.familiesOnce.Do(func() {
+		ttl := d.FamilyMemory
+		if ttl == 0 {
+			ttl = DEFAULT_FAMILY_MEMORY
+		}
+		d.families = newFamilyMemory(ttl)
+	})
+	return d.families
+}
+
+// systemResolver is the Resolver of the host, addresses in its order
+type systemResolver struct{}
+
+func (systemResolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	return net.DefaultResolver.LookupIP(ctx, "ip", host)
+}
@@ -0,0 +1,308 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"strconv"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSortAddrs(t *testing.T) {
+	tests := []struct {
+		name     string
+		ips      []string
+		override bool
+		prefer6  bool
+		want     []string
+	}{
+		{name: "single", ips: []string{"192.0.2.1"}, want: []string{"192.0.2.1"}},
+		{name: "ipv6 first", ips: []string{"2001:db8::1", "2001:db8::2", "192.0.2.1", "192.0.2.2"}, want: []string{"2001:db8::1", "192.0.2.1", "2001:db8::2", "192.0.2.2"}},
+		{name: "ipv4 first", ips: []string{"192.0.2.1", "2001:db8::1", "2001:db8::2"}, want: []string{"192.0.2.1", "2001:db8::1", "2001:db8::2"}},
+		{name: "one family", ips: []string{"192.0.2.2", "192.0.2.1"}, want: []string{"192.0.2.2", "192.0.2.1"}},
+		{name: "override to ipv4", ips: []string{"2001:db8::1", "192.0.2.1", "192.0.2.2"}, override: true, want: []string{"192.0.2.1", "2001:db8::1", "192.0.2.2"}},
+		{name: "override to ipv6", ips: []string{"192.0.2.1", "2001:db8::1"}, override: true, prefer6: true, want: []string{"2001:db8::1", "192.0.2.1"}},
+		{name: "mapped ipv4", ips: []string{"::ffff:192.0.2.1", "2001:db8::1"}, override: true, want: []string{"192.0.2.1", "2001:db8::1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ips []net.IP
+			for _, ip := range tt.ips {
+				ips = append(ips, net.ParseIP(ip))
+			}
+			var got []string
+			for _, ip := range sortAddrs(ips, tt.override, tt.prefer6) {
+				got = append(got, ip.String())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFamilyMemory(t *testing.T) {
+	ip4, ip6 := net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")
+	m := newFamilyMemory(time.Hour)
+	if _, ok := m.failedFamily("a.test"); ok {
+		t.Error("failure remembered for a new host")
+	}
+	m.record("a.test", ip6, ip4)
+	if failed6, ok := m.failedFamily("a.test"); !ok || !failed6 {
+		t.Errorf("failed family %v %v, want ipv6", failed6, ok)
+	}
+	// a race won by the fallback again keeps the first failure
+	m.failed["a.test"] = familyFailure{ipv6: true, until: time.Now().Add(time.Minute)}
+	m.record("a.test", ip6, ip4)
+	if until := m.failed["a.test"].until; until.After(time.Now().Add(2 * time.Minute)) {
+		t.Errorf("failure extended to %v", until)
+	}
+	m.record("a.test", ip6, ip6)
+	if _, ok := m.failedFamily("a.test"); ok {
+		t.Error("failure kept after the preferred family won")
+	}
+
+	m.record("b.test", ip4, ip6)
+	m.failed["b.test"] = familyFailure{ipv6: false, until: time.Now().Add(-time.Second)}
+	if _, ok := m.failedFamily("b.test"); ok {
+		t.Error("expired failure remembered")
+	}
+
+	full := newFamilyMemory(time.Hour)
+	for i := 0; i < familyMemorySize; i++ {
+		full.failed[net.IPv4(10, 0, byte(i>>8), byte(i)).String()] = familyFailure{until: time.Now().Add(time.Hour)}
+	}
+	full.record("c.test", ip6, ip4)
+	if len(full.failed) != familyMemorySize {
+		t.Errorf("%d hosts remembered, want at most %d", len(full.failed), familyMemorySize)
+	}
+	full.failed["10.0.0.0"] = familyFailure{until: time.Now().Add(-time.Second)}
+	full.record("c.test", ip6, ip4)
+	if _, ok := full.failedFamily("c.test"); !ok {
+		t.Error("failure not remembered once expired hosts were dropped")
+	}
+}
+
+// raceDialer is a DirectDialer to the domain dual.test whose attempts
+// are held or failed per address before connecting
+type raceDialer struct {
+	*DirectDialer
+	mu       sync.Mutex
+	attempts []string
+	held     chan string   // address of each attempt held
+	release  chan struct{} // closed to refuse the held attempts
+	once     sync.Once
+}
+
+const (
+	attemptFail = "fail" // refused at once
+	attemptHold = "hold" // refused once released
+)
+
+func newRaceDialer(ips []string, behavior map[string]string, delay time.Duration) *raceDialer {
+	r := &raceDialer{held: make(chan string, len(ips)), release: make(chan struct{})}
+	resolver := &staticResolver{}
+	for _, ip := range ips {
+		resolver.ips = append(resolver.ips, net.ParseIP(ip))
+	}
+	r.DirectDialer = &DirectDialer{
+		Resolver:      resolver,
+		FallbackDelay: delay,
+		Dialer: net.Dialer{Control: func(network, address string, c syscall.RawConn) error {
+			host, _, _ := net.SplitHostPort(address)
+			r.mu.Lock()
+			r.attempts = append(r.attempts, host)
+			r.mu.Unlock()
+			switch behavior[host] {
+			case attemptHold:
+				r.held <- host
+				<-r.release
+				return syscall.ECONNREFUSED
+			case attemptFail:
+				return syscall.ECONNREFUSED
+			}
+			return nil
+		}},
+	}
+	return r
+}
+
+func (r *raceDialer) tried() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string{}, r.attempts...)
+}
+
+func (r *raceDialer) releaseHeld() {
+	r.once.Do(func() {
+		close(r.release)
+	})
+}
+
+func TestDialParallel(t *testing.T) {
+	// ipv4 only, the ipv6 attempts never reach it
+	ln, err := net.Listen("tcp4", "0.0.0.0:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			_ = c.Close()
+		}
+	}()
+	port := ln.Addr().(*net.TCPAddr).Port
+	tests := []struct {
+		name     string
+		ips      []string
+		behavior map[string]string
+		delay    time.Duration
+		winner   string // "" for a failed dial
+		tried    []string
+		release  bool // the held attempt is released once it alone was tried
+		min, max time.Duration
+	}{
+		{
+			name:   "preferred wins",
+			ips:    []string{"127.0.0.1", "::1"},
+			winner: "127.0.0.1",
+			tried:  []string{"127.0.0.1"},
+			max:    250 * time.Millisecond,
+		},
+		{
+			name:     "fallback after failure",
+			ips:      []string{"::1", "127.0.0.1"},
+			behavior: map[string]string{"::1": attemptFail},
+			winner:   "127.0.0.1",
+			tried:    []string{"::1", "127.0.0.1"},
+			max:      250 * time.Millisecond,
+		},
+		{
+			name:     "fallback after head start",
+			ips:      []string{"::1", "127.0.0.1"},
+			behavior: map[string]string{"::1": attemptHold},
+			winner:   "127.0.0.1",
+			tried:    []string{"::1", "127.0.0.1"},
+			min:      290 * time.Millisecond,
+			max:      900 * time.Millisecond,
+		},
+		{
+			name:     "families interleaved",
+			ips:      []string{"::1", "::2", "127.0.0.2", "127.0.0.1"},
+			behavior: map[string]string{"::1": attemptFail, "127.0.0.2": attemptFail, "::2": attemptFail},
+			winner:   "127.0.0.1",
+			tried:    []string{"::1", "127.0.0.2", "::2", "127.0.0.1"},
+			max:      250 * time.Millisecond,
+		},
+		{
+			name:     "one after the other",
+			ips:      []string{"::1", "127.0.0.1"},
+			behavior: map[string]string{"::1": attemptHold},
+			delay:    -1,
+			winner:   "127.0.0.1",
+			tried:    []string{"::1", "127.0.0.1"},
+			release:  true,
+			max:      250 * time.Millisecond,
+		},
+		{
+			name:     "all fail",
+			ips:      []string{"::1", "127.0.0.2"},
+			behavior: map[string]string{"::1": attemptFail, "127.0.0.2": attemptFail},
+			tried:    []string{"::1", "127.0.0.2"},
+			max:      250 * time.Millisecond,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			delay := tt.delay
+			if delay == 0 {
+				delay = 300 * time.Millisecond
+			}
+			d := newRaceDialer(tt.ips, tt.behavior, delay)
+			defer d.releaseHeld()
+			type dialed struct {
+				con net.Conn
+				err error
+			}
+			result := make(chan dialed, 1)
+			start := time.Now()
+			go func() {
+				con, err := d.DialContext(context.Background(), "tcp", net.JoinHostPort("dual.test", strconv.Itoa(port)))
+				result <- dialed{con: con, err: err}
+			}()
+			if tt.release {
+				select {
+				case <-d.held:
+				case <-time.After(2 * time.Second):
+					t.Fatal("no attempt held")
+				}
+				if got := d.tried(); len(got) != 1 {
+					t.Errorf("tried %v while the first attempt runs", got)
+				}
+				d.releaseHeld()
+			}
+			r := <-result
+			con, err := r.con, r.err
+			elapsed := time.Since(start)
+			if tt.winner == "" {
+				if !errors.Is(err, syscall.ECONNREFUSED) {
+					t.Errorf("error %v, want refused", err)
+				}
+			} else {
+				if err != nil {
+					t.Fatal(err)
+				}
+				_ = con.Close()
+				if ip := con.RemoteAddr().(*net.TCPAddr).IP.String(); ip != tt.winner {
+					t.Errorf("connected to %s, want %s", ip, tt.winner)
+				}
+			}
+			if got := d.tried(); !reflect.DeepEqual(got, tt.tried) {
+				t.Errorf("tried %v, want %v", got, tt.tried)
+			}
+			if elapsed < tt.min || elapsed > tt.max {
+				t.Errorf("dial took %v, want between %v and %v", elapsed, tt.min, tt.max)
+			}
+		})
+	}
+}
+
+func TestDialParallelFamilyMemory(t *testing.T) {
+	echo := newEchoServer(t)
+	target := net.JoinHostPort("dual.test", strconv.Itoa(echo.Port))
+	tests := []struct {
+		name   string
+		memory time.Duration
+		second []string // addresses tried by the dial after ipv6 lost
+	}{
+		{name: "remembered", second: []string{"127.0.0.1"}},
+		{name: "disabled", memory: -1, second: []string{"::1", "127.0.0.1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newRaceDialer([]string{"::1", "127.0.0.1"}, map[string]string{"::1": attemptFail}, 100*time.Millisecond)
+			d.FamilyMemory = tt.memory
+			for i, want := range [][]string{{"::1", "127.0.0.1"}, tt.second} {
+				d.mu.Lock()
+				d.attempts = nil
+				d.mu.Unlock()
+				con, err := d.DialContext(context.Background(), "tcp", target)
+				if err != nil {
+					t.Fatal(err)
+				}
+				_ = con.Close()
+				if got := d.tried(); !reflect.DeepEqual(got, want) {
+					t.Errorf("dial %d tried %v, want %v", i, got, want)
+				}
+			}
+		})
+	}
+}
@@ -2,8 +2,8 @@ package proxy
 
 import (
 	"bufio"
+	"encoding/base64"
 	"errors"
-	"fmt"
 	"github.com/sirupsen/logrus"
 	"io"
 	"net"
@@ -11,6 +11,8 @@ import (
 	"strings"
 )
 
+const httpRealm = "mixed-socks"
+
 func readString(conn net.Conn, delim byte) (string, error) {
 	buf := make([]byte, 1024)
 	i := 0
@@ -32,13 +34,14 @@ func readString(conn net.Conn, delim byte) (string, error) {
 	return string(buf[:i]), nil
 }
 
-func (s *SocksServer) handleProxy(con net.Conn, firstc byte) error {
+func (s *SocksServer) handleProxy(sess *session, firstc byte) error {
+	con := sess.conn
 	line, err := readString(con, '\n')
 	if err != nil {
 		return err
 	}
 	line = string(firstc) + line
-	logrus.Infoln("http proxy requestLine " + strings.ReplaceAll(line, "\r\n", ""))
+	logrus.Debugln("http proxy requestLine " + strings.ReplaceAll(line, "\r\n", ""))
 	requestLine := strings.Split(line, " ")
 	if len(requestLine) < 3 {
 		return errors.New("request line error")
@@ -47,24 +50,44 @@ func (s *SocksServer) handleProxy(con net.Conn, firstc byte) error {
 	requestTarget := requestLine[1]
 	version := requestLine[2]
 
+	reader := bufio.NewReader(con)
+	header, authorization, err := readHeader(reader)
+	if err != nil {
+		return err
+	}
+	err = s.authenticate(sess, parseProxyAuthorization(authorization))
+	if err != nil {
+		sess.reply = 407
+		_, _ = con.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n" +
+			"Proxy-Authenticate: Basic realm=\"" + httpRealm + "\"\r\n" +
+			"Content-Length: 0\r\n" +
+			"Connection: close\r\n\r\n"))
+		_ = con.Close()
+		return authError(errors.New("http proxy authentication failed:" + err.Error()))
+	}
+	sess.conn = &bufferedConn{Conn: con, r: reader}
+	s.handshakeDone(sess)
+
+	sess.command = strings.ToLower(method)
+	err = s.admit(sess)
+	if err != nil {
+		writeHTTPError(sess, err)
+		return err
+	}
 	if method == "CONNECT" {
-		reader := bufio.NewReader(con)
-		shp := strings.Split(requestTarget, ":")
-		addr := shp[0]
-		port, _ := strconv.Atoi(shp[1])
-		//consume rest header
-		for {
-			line, err = reader.ReadString('\n')
-			if line == "\r\n" {
-				break
-			}
-			logrus.Infoln("rest:" + strings.ReplaceAll(line, "\r\n", ""))
+		addr, port, err := splitTargetPort(requestTarget, "")
+		if err != nil {
+			writeHTTPStatus(sess, "400 Bad Request", 400)
+			return errors.New("bad CONNECT target " + requestTarget + ":" + err.Error())
 		}
-		return s.handleHTTPConnectMethod(con, addr, uint16(port))
+		return s.handleHTTPConnectMethod(sess, addr, port)
 	} else {
 		si := strings.Index(requestTarget, "//")
+		if si == -1 {
+			writeHTTPStatus(sess, "400 Bad Request", 400)
+			return errors.New("bad request target " + requestTarget)
+		}
 		restUrl := requestTarget[si+2:]
-		port := 80
 		ei := strings.Index(restUrl, "/")
 		url := "/"
 		hostPort := restUrl
@@ -72,70 +95,265 @@ func (s *SocksServer) handleProxy(con net.Conn, firstc byte) error {
 			hostPort = restUrl[:ei]
 			url = restUrl[ei:]
 		}
-		as := strings.Split(hostPort, ":")
-		addr := as[0]
-		if len(as) == 2 {
-			port, _ = strconv.Atoi(as[1])
+		addr, port, err := splitTargetPort(hostPort, "80")
+		if err != nil {
+			writeHTTPStatus(sess, "400 Bad Request", 400)
+			return errors.New("bad request target " + requestTarget + ":" + err.Error())
+		}
+		header, body, err := forwardHeader(header, reader)
+		if err != nil {
+			writeHTTPStatus(sess, "400 Bad Request", 400)
+			return errors.New("bad request header:" + err.Error())
 		}
+		// one request per connection, the ones after it would skip the
+		// authentication and the routing
+		sess.conn = &httpRequestConn{Conn: con, body: body, r: reader}
 		newline := method + " " + url + " " + version
-		logrus.Infoln("http proxy newline " + strings.ReplaceAll(newline, "\r\n", ""))
-		return s.handleHTTPProxy(con, addr, uint16(port), newline)
+		logrus.Debugln("http proxy newline " + strings.ReplaceAll(newline, "\r\n", ""))
+		return s.handleHTTPProxy(sess, addr, port, newline+header+"\r\n")
 	}
 }
 
-func (s *SocksServer) handleHTTPConnectMethod(con net.Conn, addr string, port uint16) error {
+// splitTargetPort split the host:port of a request target, ipv6 hosts in
+// brackets, defaultPort is used when the port is missing and allowed to be
+func splitTargetPort(hostPort, defaultPort string) (string, uint16, error) {
+	if defaultPort != "" && strings.LastIndex(hostPort, ":") <= strings.LastIndex(hostPort, "]") {
+		hostPort = net.JoinHostPort(strings.TrimSuffix(strings.TrimPrefix(hostPort, "["), "]"), defaultPort)
+	}
+	host, portStr, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return "", 0, err
+	}
+	if host == "" {
+		return "", 0, errors.New("missing host")
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port <= 0 || port > 65535 {
+		return "", 0, errors.New("bad port " + portStr)
+	}
+	return host, uint16(port), nil
+}
 
-	destAddrPort := fmt.Sprintf("%s:%d", addr, port)
-	dest, err := net.Dial("tcp", destAddrPort)
-	/**
+// readHeader consume the rest header, Proxy-Authorization is returned apart
+// and never forwarded to the destination
+func readHeader(reader *bufio.Reader) (string, string, error) {
+	var header strings.Builder
+	authorization := ""
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return "", "", errors.New("read header error:" + err.Error())
+		}
+		if line == "\r\n" || line == "\n" {
+			break
+		}
+		name, value, _ := strings.Cut(line, ":")
+		if strings.EqualFold(strings.TrimSpace(name), "Proxy-Authorization") {
+			// the credentials are never logged
+			authorization = strings.TrimSpace(value)
+			continue
+		}
+		logrus.Debugln("rest:" + strings.ReplaceAll(line, "\r\n", ""))
+		header.WriteString(line)
+	}
+	return header.String(), authorization, nil
+}
+
+// forwardHeader drop the connection headers of a forwarded request and ask
+// the destination to close after its response, the returned reader yields
+// the raw request body framed by Content-Length or chunked encoding
+func forwardHeader(header string, reader *bufio.Reader) (string, io.Reader, error) {
+	var out strings.Builder
+	var contentLength, transferEncoding []string
+	for _, line := range strings.SplitAfter(header, "\n") {
+		name, value, _ := strings.Cut(line, ":")
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		switch {
+		case line == "":
+			continue
+		case strings.EqualFold(name, "Connection"), strings.EqualFold(name, "Proxy-Connection"),
+			strings.EqualFold(name, "Keep-Alive"):
+			continue
+		case strings.EqualFold(name, "Content-Length"):
+			contentLength = append(contentLength, value)
+		case strings.EqualFold(name, "Transfer-Encoding"):
+			transferEncoding = append(transferEncoding, value)
+		}
+		out.WriteString(line)
+	}
+	out.WriteString("Connection: close\r\n")
+	switch {
+	case len(transferEncoding) > 0 && len(contentLength) > 0:
+		return "", nil, errors.New("both Transfer-Encoding and Content-Length")
+	case len(transferEncoding) > 0:
+		codings := strings.Split(strings.Join(transferEncoding, ","), ",")
+		if !strings.EqualFold(strings.TrimSpace(codings[len(codings)-1]), "chunked") {
+			return "", nil, errors.New("request body not chunked: " + strings.Join(transferEncoding, ","))
+		}
+		return out.String(), &chunkedBody{r: reader}, nil
+	case len(contentLength) > 0:
+		n, err := strconv.ParseInt(contentLength[0], 10, 64)
+		if err != nil || n < 0 {
+			return "", nil, errors.New("bad Content-Length " + contentLength[0])
+		}
+		for _, v := range contentLength[1:] {
+			if v != contentLength[0] {
+				return "", nil, errors.New("conflicting Content-Length")
+			}
+		}
+		return out.String(), io.LimitReader(reader, n), nil
+	}
+	return out.String(), strings.NewReader(""), nil
+}
 
-	 */
+// chunkedBody pass a chunked body through unchanged, up to the end of its
+// trailer
+type chunkedBody struct {
+	r       *bufio.Reader
+	pending string // framing line not yet returned
+	left    int64  // bytes left of the chunk data and its CRLF
+	trailer bool
+	done    bool
+}
+
+func (c *chunkedBody) Read(b []byte) (int, error) {
+	if c.pending != "" {
+		n := copy(b, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+	if c.left > 0 {
+		if int64(len(b)) > c.left {
+			b = b[:c.left]
+		}
+		n, err := c.r.Read(b)
+		c.left -= int64(n)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return n, err
+	}
+	if c.done {
+		return 0, io.EOF
+	}
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return 0, errors.New("read chunk error:" + err.Error())
+	}
+	if c.trailer {
+		c.done = line == "\r\n" || line == "\n"
+	} else {
+		size, _, _ := strings.Cut(line, ";")
+		n, err := strconv.ParseInt(strings.TrimSpace(size), 16, 64)
+		if err != nil || n < 0 {
+			return 0, errors.New("bad chunk size " + strings.TrimSpace(line))
+		}
+		if n == 0 {
+			c.trailer = true
+		} else {
+			c.left = n + 2
+		}
+	}
+	c.pending = line
+	return c.Read(b)
+}
+
+// httpRequestConn pass the body of one request to the destination, the
+// bytes the client sends after it are read and dropped so the response
+// still reaches the client until the destination closes
+type httpRequestConn struct {
+	net.Conn
+	body io.Reader
+	r    *bufio.Reader
+}
+
+func (c *httpRequestConn) Read(b []byte) (int, error) {
+	if c.body != nil {
+		n, err := c.body.Read(b)
+		if err == io.EOF {
+			c.body = nil
+			err = nil
+		}
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+	for {
+		_, err := c.r.Read(b)
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// parseProxyAuthorization decode the Basic credentials, other schemes are
+// left to the Authenticator through the raw header
+func parseProxyAuthorization(authorization string) *AuthRequest {
+	req := &AuthRequest{Header: authorization}
+	scheme, credentials, ok := strings.Cut(authorization, " ")
+	if !ok || !strings.EqualFold(scheme, "Basic") {
+		return req
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(credentials))
 	if err != nil {
-		//con.Write([]byte("HTTP/1.1 404 Not Found\r\n\r\n"))
+		return req
+	}
+	req.Username, req.Password, _ = strings.Cut(string(decoded), ":")
+	return req
+}
+
+func (s *SocksServer) handleHTTPConnectMethod(sess *session, addr string, port uint16) error {
+	con := sess.conn
+	dest, err := s.dial(sess, "tcp", addr, port)
+	if err != nil {
+		writeHTTPError(sess, err)
 		return errors.New("connect dist error :" + err.Error())
 	}
+	sess.reply = 200
 	_, err = con.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
 
 	if err != nil {
 		return errors.New("write  response error:" + err.Error())
 	}
 
-	forward := func(src net.Conn, dest net.Conn) {
-		defer func(src, dest net.Conn) {
-			_ = dest.Close()
-			_ = src.Close()
-		}(src, dest)
-		_, _ = io.Copy(dest, src)
-	}
-	logrus.Infoln(con.RemoteAddr().String() + "<->" + dest.LocalAddr().String() + "-" + dest.RemoteAddr().String() + " connect established!")
-	go forward(con, dest)
-	go forward(dest, con)
+	logrus.Debugln(con.RemoteAddr().String() + "<->" + dest.LocalAddr().String() + "-" + dest.RemoteAddr().String() + " connect established!")
+	s.relay(sess, dest)
 	return nil
 }
 
 // 后续的request line都是全路径，某些服务器可能有问题
 
-func (s *SocksServer) handleHTTPProxy(con net.Conn, addr string, port uint16, line string) error {
-	destAddrPort := fmt.Sprintf("%s:%d", addr, port)
-	dest, err := net.Dial("tcp", destAddrPort)
-	/**
-	 */
+func (s *SocksServer) handleHTTPProxy(sess *session, addr string, port uint16, line string) error {
+	con := sess.conn
+	dest, err := s.dial(sess, "tcp", addr, port)
 	if err != nil {
+		writeHTTPError(sess, err)
 		return errors.New("connect dist error :" + err.Error())
 	}
 	_, err = dest.Write([]byte(line))
 	if err != nil {
 		return errors.New("write  response error:" + err.Error())
 	}
-	forward := func(src net.Conn, dest net.Conn) {
-		defer func(src, dest net.Conn) {
-			_ = dest.Close()
-			_ = src.Close()
-		}(src, dest)
-		_, _ = io.Copy(dest, src)
-	}
-	logrus.Infoln(con.RemoteAddr().String() + "<->" + dest.LocalAddr().String() + "-" + dest.RemoteAddr().String() + " connect established!")
-	go forward(con, dest)
-	go forward(dest, con)
+	logrus.Debugln(con.RemoteAddr().String() + "<->" + dest.LocalAddr().String() + "-" + dest.RemoteAddr().String() + " connect established!")
+	s.relay(sess, dest)
 	return nil
 }
+
+// writeHTTPError answer a request refused or whose outbound connection
+// failed
+func writeHTTPError(sess *session, err error) {
+	status, reply := "502 Bad Gateway", 502
+	var limitErr *limitError
+	if errors.As(err, &limitErr) {
+		status, reply = "429 Too Many Requests", 429
+	} else if errors.Is(err, errRejected) {
+		status, reply = "403 Forbidden", 403
+	}
+	writeHTTPStatus(sess, status, reply)
+}
+
+// writeHTTPStatus answer the client with an empty response
+func writeHTTPStatus(sess *session, status string, reply int) {
+	sess.reply = reply
+	_, _ = sess.conn.Write([]byte("HTTP/1.1 " + status + "\r\nContent-Length: 0\r\nConnection: close\r\n\r\n"))
+}
@@ -0,0 +1,308 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSplitTargetPort(t *testing.T) {
+	tests := []struct {
+		name        string
+		hostPort    string
+		defaultPort string
+		host        string
+		port        uint16
+		err         bool
+	}{
+		{name: "host port", hostPort: "example.com:443", host: "example.com", port: 443},
+		{name: "ipv4", hostPort: "127.0.0.1:8080", host: "127.0.0.1", port: 8080},
+		{name: "ipv6", hostPort: "[::1]:443", host: "::1", port: 443},
+		{name: "connect no port", hostPort: "example.com", err: true},
+		{name: "connect ipv6 no port", hostPort: "[::1]", err: true},
+		{name: "connect empty", hostPort: "", err: true},
+		{name: "default port", hostPort: "example.com", defaultPort: "80", host: "example.com", port: 80},
+		{name: "default port ipv6", hostPort: "[::1]", defaultPort: "80", host: "::1", port: 80},
+		{name: "explicit port over default", hostPort: "[::1]:8080", defaultPort: "80", host: "::1", port: 8080},
+		{name: "ipv6 without brackets", hostPort: "::1", defaultPort: "80", err: true},
+		{name: "missing host", hostPort: ":80", err: true},
+		{name: "empty port", hostPort: "example.com:", err: true},
+		{name: "port not a number", hostPort: "example.com:http", err: true},
+		{name: "port zero", hostPort: "example.com:0", err: true},
+		{name: "port out of range", hostPort: "example.com:65536", err: true},
+		{name: "negative port", hostPort: "example.com:-1", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host, port, err := splitTargetPort(tt.hostPort, tt.defaultPort)
+			if (err != nil) != tt.err {
+				t.Fatalf("error %v, want error %v", err, tt.err)
+			}
+			if host != tt.host || port != tt.port {
+				t.Errorf("got %s %d, want %s %d", host, port, tt.host, tt.port)
+			}
+		})
+	}
+}
+
+func TestForwardHeader(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		input  string
+		want   string
+		body   string
+		err    bool
+	}{
+		{
+			name:   "no body",
+			header: "Host: a\r\nConnection: keep-alive\r\nProxy-Connection: keep-alive\r\nKeep-Alive: 300\r\n",
+			input:  "GET / HTTP/1.1\r\n\r\n",
+			want:   "Host: a\r\nConnection: close\r\n",
+		},
+		{
+			name:   "content length",
+			header: "Host: a\r\nContent-Length: 5\r\n",
+			input:  "hello" + "GET / HTTP/1.1\r\n\r\n",
+			want:   "Host: a\r\nContent-Length: 5\r\nConnection: close\r\n",
+			body:   "hello",
+		},
+		{
+			name:   "same content length twice",
+			header: "Content-Length: 2\r\ncontent-length: 2\r\n",
+			input:  "hi",
+			want:   "Content-Length: 2\r\ncontent-length: 2\r\nConnection: close\r\n",
+			body:   "hi",
+		},
+		{
+			name:   "chunked",
+			header: "Transfer-Encoding: chunked\r\n",
+			input:  "5;ext=1\r\nhello\r\nA\r\n0123456789\r\n0\r\nTrailer: x\r\n\r\n" + "GET / HTTP/1.1\r\n\r\n",
+			want:   "Transfer-Encoding: chunked\r\nConnection: close\r\n",
+			body:   "5;ext=1\r\nhello\r\nA\r\n0123456789\r\n0\r\nTrailer: x\r\n\r\n",
+		},
+		{
+			name:   "gzip then chunked",
+			header: "Transfer-Encoding: gzip\r\nTransfer-Encoding: chunked\r\n",
+			input:  "0\r\n\r\n",
+			want:   "Transfer-Encoding: gzip\r\nTransfer-Encoding: chunked\r\nConnection: close\r\n",
+			body:   "0\r\n\r\n",
+		},
+		{name: "not chunked", header: "Transfer-Encoding: gzip\r\n", err: true},
+		{name: "both framings", header: "Transfer-Encoding: chunked\r\nContent-Length: 5\r\n", err: true},
+		{name: "bad content length", header: "Content-Length: five\r\n", err: true},
+		{name: "negative content length", header: "Content-Length: -1\r\n", err: true},
+		{name: "conflicting content length", header: "Content-Length: 1\r\nContent-Length: 2\r\n", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header, body, err := forwardHeader(tt.header, bufio.NewReader(strings.NewReader(tt.input)))
+			if (err != nil) != tt.err {
+				t.Fatalf("error %v, want error %v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+			if header != tt.want {
+				t.Errorf("header %q, want %q", header, tt.want)
+			}
+			got, err := io.ReadAll(body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.body {
+				t.Errorf("body %q, want %q", got, tt.body)
+			}
+		})
+	}
+}
+
+func TestChunkedBodyErrors(t *testing.T) {
+	for _, input := range []string{
+		"x\r\n",
+		"-1\r\n",
+		"5\r\nhel",
+		"0\r\nTrailer: x\r\n",
+	} {
+		_, err := io.ReadAll(&chunkedBody{r: bufio.NewReader(strings.NewReader(input))})
+		if err == nil {
+			t.Errorf("%q: no error", input)
+		}
+	}
+}
+
+// newTestServer start a proxy on the loopback dialing targets directly,
+// stopped with the test
+func newTestServer(t *testing.T) *SocksServer {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	s := NewSocksServer("127.0.0.1", 0)
+	s.SetDialer(NewDirectDialer())
+	err := s.Listen(ctx)
+	if err != nil {
+		cancel()
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		_ = s.Serve(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return s
+}
+
+func TestHTTPProxyOneRequestPerConnection(t *testing.T) {
+	origin, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer origin.Close()
+	received := make(chan string, 1)
+	go func() {
+		con, err := origin.Accept()
+		if err != nil {
+			return
+		}
+		defer con.Close()
+		reader := bufio.NewReader(con)
+		var request strings.Builder
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				break
+			}
+			request.WriteString(line)
+			if line == "\r\n" {
+				break
+			}
+		}
+		body := make([]byte, 4)
+		_, _ = io.ReadFull(reader, body)
+		request.Write(body)
+		_, _ = con.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"))
+		// wait for anything the proxy would pass after the request
+		_ = con.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		rest, _ := io.ReadAll(reader)
+		received <- request.String() + string(rest)
+	}()
+
+	s := newTestServer(t)
+	client, err := net.Dial("tcp", s.ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	target := origin.Addr().String()
+	_, err = client.Write([]byte("POST http://" + target + "/first HTTP/1.1\r\nHost: " + target + "\r\n" +
+		"Proxy-Connection: keep-alive\r\nContent-Length: 4\r\n\r\nbody" +
+		"GET http://" + target + "/second HTTP/1.1\r\nHost: " + target + "\r\n" +
+		"Proxy-Authorization: Basic Ym9iOnB3\r\n\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	response, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatalf("connection not closed after the response: %v", err)
+	}
+	if string(response) != "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok" {
+		t.Errorf("response %q", response)
+	}
+	want := "POST /first HTTP/1.1\r\nHost: " + target + "\r\nContent-Length: 4\r\nConnection: close\r\n\r\nbody"
+	if got := <-received; got != want {
+		t.Errorf("origin received %q, want %q", got, want)
+	}
+}
+
+func TestParseProxyAuthorization(t *testing.T) {
+	tests := []struct {
+		header   string
+		username string
+		password string
+	}{
+		{header: "Basic Ym9iOnB3", username: "bob", password: "pw"},
+		{header: "basic Ym9iOnB3", username: "bob", password: "pw"},
+		{header: "Basic  Ym9iOnB3 ", username: "bob", password: "pw"},
+		{header: "Basic Ym9iOnA6dzo=", username: "bob", password: "p:w:"},
+		{header: "Basic Ym9i", username: "bob"},
+		{header: "Basic not base64"},
+		{header: "Bearer Ym9iOnB3"},
+		{header: "Basic"},
+		{header: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			req := parseProxyAuthorization(tt.header)
+			if req.Username != tt.username || req.Password != tt.password || req.Header != tt.header {
+				t.Errorf("got %+v, want %s:%s", req, tt.username, tt.password)
+			}
+		})
+	}
+}
+
+func TestReadHeaderStripsProxyAuthorization(t *testing.T) {
+	var logged bytes.Buffer
+	logger := logrus.StandardLogger()
+	out, level := logger.Out, logger.GetLevel()
+	logger.SetOutput(&logged)
+	logger.SetLevel(logrus.DebugLevel)
+	defer func() {
+		logger.SetOutput(out)
+		logger.SetLevel(level)
+	}()
+	reader := bufio.NewReader(strings.NewReader("Host: a\r\nproxy-authorization: Basic Ym9iOnB3\r\nAccept: */*\r\n\r\nbody"))
+	header, authorization, err := readHeader(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header != "Host: a\r\nAccept: */*\r\n" || authorization != "Basic Ym9iOnB3" {
+		t.Errorf("header %q authorization %q", header, authorization)
+	}
+	if strings.Contains(logged.String(), "Ym9iOnB3") || !strings.Contains(logged.String(), "Accept") {
+		t.Errorf("credentials logged or header missing from the log: %s", logged.String())
+	}
+	rest, _ := io.ReadAll(reader)
+	if string(rest) != "body" {
+		t.Errorf("body %q left", rest)
+	}
+	_, _, err = readHeader(bufio.NewReader(strings.NewReader("Host: a\r\n")))
+	if err == nil {
+		t.Error("unterminated header: no error")
+	}
+}
+
+func TestHTTPProxyAuthentication(t *testing.T) {
+	echo := newEchoServer(t)
+	s := newTestServer(t)
+	s.SetAuthenticator(StaticAuthenticator{"bob": "pw"})
+	challenge := "HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: Basic realm=\"" + httpRealm + "\"\r\n"
+	tests := []struct {
+		name          string
+		authorization string
+		want          string
+	}{
+		{name: "valid", authorization: "Basic Ym9iOnB3", want: "HTTP/1.1 200 Connection Established\r\n\r\n"},
+		{name: "missing", want: challenge},
+		{name: "wrong password", authorization: "Basic Ym9iOnBhc3M=", want: challenge},
+		{name: "other scheme", authorization: "Bearer Ym9iOnB3", want: challenge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := "CONNECT " + echo.String() + " HTTP/1.1\r\nHost: " + echo.String() + "\r\n"
+			if tt.authorization != "" {
+				request += "Proxy-Authorization: " + tt.authorization + "\r\n"
+			}
+			proxyExchange(t, s.ln.Addr().String(), []byte(request+"\r\n"), []byte(tt.want))
+		})
+	}
+}
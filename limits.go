@@ -0,0 +1,182 @@
+package proxy
+
+import (
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	LIMIT_CONNECTIONS = "connections" // max concurrent connections of the process
+	LIMIT_IP          = "ip"          // max concurrent connections of a client ip
+	LIMIT_USER        = "user"        // max concurrent connections of a user
+
+	DEFAULT_HANDSHAKE_TIMEOUT = 30 * time.Second
+	DEFAULT_DIAL_TIMEOUT      = 30 * time.Second
+)
+
+var metricLimitRejections = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "mixed_socks",
+	Name:      "limit_rejections_total",
+	Help:      "Clients refused for being over a connection limit.",
+}, []string{"protocol", "limit"})
+
+func init() {
+	metricsRegistry.MustRegister(metricLimitRejections)
+}
+
+// LimitConfig bound the concurrent client connections, shared by every
+// listener, 0 for unlimited
+type LimitConfig struct {
+	MaxConnections int `yaml:"max_connections"`
+	MaxPerIP       int `yaml:"max_per_ip"`
+	MaxPerUser     int `yaml:"max_per_user"`
+}
+
+// limitError is a client over a connection limit, it is answered like a
+// request rejected by a rule, or 429 for http
+type limitError struct {
+	limit string
+	max   int
+}
+
+func (e *limitError) Error() string {
+	return "over the " + e.limit + " connection limit of " + strconv.Itoa(e.max)
+}
+
+func (e *limitError) Is(target error) bool {
+	return target == errRejected
+}
+
+// ConnLimits count the live client connections. The connection and ip
+// limits are taken when a client is accepted, the user limit once it is
+// authenticated, over a limit the client is answered with a rejection
+// after its request is read
+type ConnLimits struct {
+	mu    sync.Mutex
+	cfg   LimitConfig
+	total int
+	ips   map[string]int
+	users map[string]int
+}
+
+func NewConnLimits(cfg LimitConfig) *ConnLimits {
+	return &ConnLimits{
+		cfg:   cfg,
+		ips:   make(map[string]int),
+		users: make(map[string]int),
+	}
+}
+
+// Update change the limits, clients already admitted are kept
+func (l *ConnLimits) Update(cfg LimitConfig) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.cfg = cfg
+}
+
+// acquireConn take the connection and ip slots of a new client
+func (l *ConnLimits) acquireConn(sess *session) error {
+	if l == nil {
+		return nil
+	}
+	ip := addrIP(sess.conn.RemoteAddr()).String()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.cfg.MaxConnections > 0 && l.total >= l.cfg.MaxConnections {
+		return &limitError{limit: LIMIT_CONNECTIONS, max: l.cfg.MaxConnections}
+	}
+	if l.cfg.MaxPerIP > 0 && l.ips[ip] >= l.cfg.MaxPerIP {
+		return &limitError{limit: LIMIT_IP, max: l.cfg.MaxPerIP}
+	}
+	l.total++
+	l.ips[ip]++
+	sess.connSlot = ip
+	return nil
+}
+
+// acquireUser take the user slot of an authenticated client
+func (l *ConnLimits) acquireUser(sess *session) error {
+	if l == nil || sess.user == "" {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.cfg.MaxPerUser > 0 && l.users[sess.user] >= l.cfg.MaxPerUser {
+		return &limitError{limit: LIMIT_USER, max: l.cfg.MaxPerUser}
+	}
+	l.users[sess.user]++
+	sess.userSlot = sess.user
+	return nil
+}
+
+// release free the slots taken by sess
+func (l *ConnLimits) release(sess *session) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if ip := sess.connSlot; ip != "" {
+		l.total--
+		if l.ips[ip]--; l.ips[ip] <= 0 {
+			delete(l.ips, ip)
+		}
+		sess.connSlot = ""
+	}
+	if user := sess.userSlot; user != "" {
+		if l.users[user]--; l.users[user] <= 0 {
+			delete(l.users, user)
+		}
+		sess.userSlot = ""
+	}
+}
+
+// admit check the connection limits once the client request is read, the
+// caller answers the error with the rejection of its protocol
+func (s *SocksServer) admit(sess *session) error {
+	err := sess.limitErr
+	if err == nil {
+		err = s.limits.acquireUser(sess)
+	}
+	if err == nil {
+		return nil
+	}
+	var limitErr *limitError
+	if errors.As(err, &limitErr) {
+		metricLimitRejections.WithLabelValues(sess.protocol, limitErr.limit).Inc()
+	}
+	sess.dialErr = err
+	logrus.Debugln(sess.conn.RemoteAddr().String() + " " + err.Error())
+	return err
+}
+
+// watchIdle close sess once no byte was relayed for the idle timeout of
+// its listener, until done is closed
+func watchIdle(sess *session, done chan struct{}) {
+	timeout := sess.settings.idleTimeout
+	if timeout <= 0 {
+		return
+	}
+	interval := timeout / 4
+	if interval < 100*time.Millisecond {
+		interval = 100 * time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if time.Since(time.Unix(0, sess.lastActive.Load())) >= timeout {
+				logrus.Debugln(sess.client.RemoteAddr().String() + " idle for " + timeout.String() + ", closing")
+				_ = sess.Close()
+				return
+			}
+		}
+	}
+}
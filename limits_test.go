@@ -0,0 +1,185 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestConnLimits(t *testing.T) {
+	tests := []struct {
+		name  string
+		cfg   LimitConfig
+		users []string // one client per entry, all from 127.0.0.1
+		want  []string // limit hit by each client, "" when admitted
+	}{
+		{name: "unlimited", users: []string{"", "a", "a"}, want: []string{"", "", ""}},
+		{name: "connections", cfg: LimitConfig{MaxConnections: 2, MaxPerIP: 5}, users: []string{"", "", ""}, want: []string{"", "", LIMIT_CONNECTIONS}},
+		{name: "ip", cfg: LimitConfig{MaxConnections: 5, MaxPerIP: 1}, users: []string{"", ""}, want: []string{"", LIMIT_IP}},
+		{name: "user", cfg: LimitConfig{MaxPerUser: 1}, users: []string{"a", "b", "a", ""}, want: []string{"", "", LIMIT_USER, ""}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := NewConnLimits(tt.cfg)
+			var admitted []*session
+			for i, user := range tt.users {
+				sess := newTestSession(t)
+				sess.user = user
+				err := l.acquireConn(sess)
+				if err == nil {
+					err = l.acquireUser(sess)
+				}
+				var limitErr *limitError
+				switch {
+				case tt.want[i] == "" && err != nil:
+					t.Errorf("client %d: error %v", i, err)
+				case tt.want[i] != "" && (!errors.As(err, &limitErr) || limitErr.limit != tt.want[i]):
+					t.Errorf("client %d: error %v, want over the %s limit", i, err, tt.want[i])
+				case err != nil && !errors.Is(err, errRejected):
+					t.Errorf("client %d: %v is not a rejection", i, err)
+				}
+				admitted = append(admitted, sess)
+			}
+			for _, sess := range admitted {
+				l.release(sess)
+			}
+			if l.total != 0 || len(l.ips) != 0 || len(l.users) != 0 {
+				t.Errorf("slots left after release: %d %v %v", l.total, l.ips, l.users)
+			}
+		})
+	}
+	var l *ConnLimits
+	sess := newTestSession(t)
+	sess.user = "a"
+	if l.acquireConn(sess) != nil || l.acquireUser(sess) != nil {
+		t.Error("nil limits refused a client")
+	}
+	l.release(sess)
+}
+
+func TestConnLimitReplies(t *testing.T) {
+	echo := newEchoServer(t)
+	s := NewSocksServer("127.0.0.1", 0)
+	s.SetDialer(NewDirectDialer())
+	limits := NewConnLimits(LimitConfig{MaxConnections: 1})
+	s.SetConnLimits(limits)
+	startServer(t, s)
+	addr := s.ln.Addr().String()
+	held := socks5Connect(t, addr, echo)
+	tests := []struct {
+		name    string
+		request []byte
+		want    []byte
+	}{
+		{name: "socks5", request: append([]byte{5, 1, METHOD_NO_AUTH}, socks5Request(CMD_CONNECT, echo)...), want: []byte{5, METHOD_NO_AUTH, 5, 2}},
+		{name: "socks4", request: []byte{4, 1, byte(echo.Port >> 8), byte(echo.Port), 127, 0, 0, 1, 0}, want: []byte{0, 0x5B}},
+		{name: "http", request: []byte("CONNECT " + echo.String() + " HTTP/1.1\r\n\r\n"), want: []byte("HTTP/1.1 429 Too Many Requests\r\n")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxyExchange(t, addr, tt.request, tt.want)
+		})
+	}
+	expectEcho(t, held)
+	_ = held.Close()
+
+	// the slot is free again once the relay ended
+	waitSessions(t, s)
+	socks5Connect(t, addr, echo)
+
+	limits.Update(LimitConfig{MaxPerUser: 1})
+	s.SetAuthenticator(StaticAuthenticator{"bob": "pw"})
+	auth := append([]byte{5, 1, METHOD_USER_PASS}, userPass("bob", "pw")...)
+	bob := proxyExchange(t, addr, append(auth, socks5Request(CMD_CONNECT, echo)...), []byte{5, METHOD_USER_PASS, 1, 0, 5, 0})
+	_, err := io.ReadFull(bob, make([]byte, 8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyExchange(t, addr, append(auth, socks5Request(CMD_CONNECT, echo)...), []byte{5, METHOD_USER_PASS, 1, 0, 5, 2})
+}
+
+// blockDialer never connects, its dials end with their ctx
+type blockDialer struct{}
+
+func (blockDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestTimeouts(t *testing.T) {
+	echo := newEchoServer(t)
+	tests := []struct {
+		name  string
+		setup func(s *SocksServer)
+		run   func(t *testing.T, addr string) net.Conn // return the connection the proxy should close, if any
+		min   time.Duration
+	}{
+		{
+			name:  "handshake silent client",
+			setup: func(s *SocksServer) { s.SetHandshakeTimeout(200 * time.Millisecond) },
+			run: func(t *testing.T, addr string) net.Conn {
+				con, err := net.Dial("tcp", addr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(func() { _ = con.Close() })
+				return con
+			},
+			min: 200 * time.Millisecond,
+		},
+		{
+			name:  "handshake partial request",
+			setup: func(s *SocksServer) { s.SetHandshakeTimeout(200 * time.Millisecond) },
+			run: func(t *testing.T, addr string) net.Conn {
+				return proxyExchange(t, addr, []byte{5, 1, METHOD_NO_AUTH, 5, 1}, []byte{5, METHOD_NO_AUTH})
+			},
+			min: 200 * time.Millisecond,
+		},
+		{
+			name:  "idle relay",
+			setup: func(s *SocksServer) { s.SetIdleTimeout(300 * time.Millisecond) },
+			run: func(t *testing.T, addr string) net.Conn {
+				con := socks5Connect(t, addr, echo)
+				// traffic keeps the relay open past the idle timeout
+				for end := time.Now().Add(450 * time.Millisecond); time.Now().Before(end); {
+					expectEcho(t, con)
+				}
+				return con
+			},
+			min: 300 * time.Millisecond,
+		},
+		{
+			name: "dial",
+			setup: func(s *SocksServer) {
+				s.SetDialer(blockDialer{})
+				s.SetDialTimeout(200 * time.Millisecond)
+			},
+			run: func(t *testing.T, addr string) net.Conn {
+				start := time.Now()
+				proxyExchange(t, addr, append([]byte{5, 1, METHOD_NO_AUTH}, socks5Request(CMD_CONNECT, echo)...), []byte{5, METHOD_NO_AUTH, 5, 6})
+				if elapsed := time.Since(start); elapsed < 150*time.Millisecond || elapsed > 2*time.Second {
+					t.Errorf("ttl expired reply after %v, want the 200ms dial timeout", elapsed)
+				}
+				return nil
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+			tt.setup(s)
+			con := tt.run(t, s.ln.Addr().String())
+			if con == nil {
+				return
+			}
+			start := time.Now()
+			expectClosed(t, con)
+			if elapsed := time.Since(start); elapsed < tt.min-50*time.Millisecond {
+				t.Errorf("closed after %v, want at least %v", elapsed, tt.min)
+			}
+		})
+	}
+}
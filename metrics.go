@@ -0,0 +1,170 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+const (
+	PROTOCOL_UDP = "udp" // protocol label of the udp relay
+
+	HANDSHAKE_AUTH        = "auth"        // authentication failed or no acceptable method
+	HANDSHAKE_PROTOCOL    = "protocol"    // protocol not enabled on the listener
+	HANDSHAKE_TIMEOUT     = "timeout"     // request not read before the handshake timeout
+	HANDSHAKE_BAD_REQUEST = "bad_request" // malformed request or client gone
+)
+
+var (
+	metricsRegistry = prometheus.NewRegistry()
+
+	metricConnections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "mixed_socks",
+		Name:      "connections_total",
+		Help:      "Accepted client connections.",
+	}, []string{"protocol"})
+	metricHandshakeErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "mixed_socks",
+		Name:      "handshake_errors_total",
+		Help:      "Clients failing before their request is served.",
+	}, []string{"protocol", "reason"})
+	metricRelays = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "mixed_socks",
+		Name:      "relays",
+		Help:      "Active tcp relays.",
+	}, []string{"protocol", "user", "upstream"})
+	metricUdpAssociations = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "mixed_socks",
+		Name:      "udp_associations",
+		Help:      "Active socks5 udp associations.",
+	}, []string{"user"})
+	metricBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "mixed_socks",
+		Name:      "bytes_total",
+		Help:      "Bytes relayed, up is client to target and down target to client.",
+	}, []string{"protocol", "direction", "user", "upstream"})
+	metricDialDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "mixed_socks",
+		Name:      "dial_duration_seconds",
+		Help:      "Time to open outbound connections.",
+		Buckets:   []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+	}, []string{"protocol", "upstream"})
+	metricDialErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "mixed_socks",
+		Name:      "dial_errors_total",
+		Help:      "Outbound connections that failed.",
+	}, []string{"protocol", "upstream", "type"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		metricConnections,
+		metricHandshakeErrors,
+		metricRelays,
+		metricUdpAssociations,
+		metricBytes,
+		metricDialDuration,
+		metricDialErrors,
+	)
+}
+
+// MetricsHandler serve the metrics in the prometheus text format
+func MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+}
+
+// serveMetrics serve /metrics on addr until ctx is done
+func serveMetrics(ctx context.Context, addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", MetricsHandler())
+	return serveHTTP(ctx, "metrics", addr, mux)
+}
+
+// handshakeError is a client failure with the reason it is counted under
+type handshakeError struct {
+	reason string
+	err    error
+}
+
+func (e *handshakeError) Error() string {
+	return e.err.Error()
+}
+
+func (e *handshakeError) Unwrap() error {
+	return e.err
+}
+
+func authError(err error) error {
+	return &handshakeError{reason: HANDSHAKE_AUTH, err: err}
+}
+
+// dialErrorType classify a failed outbound connection
+func dialErrorType(err error) string {
+	var dnsErr *net.DNSError
+	var quotaErr *quotaError
+	var blockedErr *blockedError
+	switch {
+	case errors.As(err, &quotaErr):
+		return "quota"
+	case errors.As(err, &blockedErr):
+		return "blocked"
+	case errors.Is(err, errRejected):
+		return "rejected"
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case errors.Is(err, context.DeadlineExceeded) || isTimeout(err):
+		return "timeout"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused"
+	case errors.Is(err, syscall.ENETUNREACH) || errors.Is(err, syscall.EHOSTUNREACH):
+		return "unreachable"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	}
+	return "other"
+}
+
+// meteredConn count the bytes relayed through an outbound connection,
+// in the metrics and in the session
+type meteredConn struct {
+	net.Conn
+	sess   *session
+	quotas *Quotas // traffic accounting of the user, may be nil
+	up     prometheus.Counter
+	down   prometheus.Counter
+}
+
+func newMeteredConn(sess *session, con net.Conn, protocol, upstream string) *meteredConn {
+	return &meteredConn{
+		Conn: con,
+		sess: sess,
+		up:   metricBytes.WithLabelValues(protocol, "up", sess.user, upstream),
+		down: metricBytes.WithLabelValues(protocol, "down", sess.user, upstream),
+	}
+}
+
+func (c *meteredConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.down.Add(float64(n))
+	c.sess.bytesDown.Add(int64(n))
+	c.sess.lastActive.Store(time.Now().UnixNano())
+	c.quotas.add(c.sess.user, n)
+	return n, err
+}
+
+func (c *meteredConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.up.Add(float64(n))
+	c.sess.bytesUp.Add(int64(n))
+	c.sess.lastActive.Store(time.Now().UnixNano())
+	c.quotas.add(c.sess.user, n)
+	return n, err
+}
@@ -0,0 +1,139 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestDialErrorType(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{err: &quotaError{}, want: "quota"},
+		{err: &blockedError{}, want: "blocked"},
+		{err: errRejected, want: "rejected"},
+		{err: &net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", Name: "a.test"}}, want: "dns"},
+		{err: context.DeadlineExceeded, want: "timeout"},
+		{err: &net.OpError{Op: "dial", Err: os.ErrDeadlineExceeded}, want: "timeout"},
+		{err: &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, want: "refused"},
+		{err: &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ENETUNREACH)}, want: "unreachable"},
+		{err: &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.EHOSTUNREACH)}, want: "unreachable"},
+		{err: context.Canceled, want: "canceled"},
+		{err: errors.New("upstream http proxy replied 502"), want: "other"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.want+" "+tt.err.Error(), func(t *testing.T) {
+			if got := dialErrorType(tt.err); got != tt.want {
+				t.Errorf("type %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// expectMetric check a metric once the sessions updating it ended
+func expectMetric(t *testing.T, name string, value, want float64) {
+	t.Helper()
+	if value != want {
+		t.Errorf("%s %v, want %v", name, value, want)
+	}
+}
+
+// dialCount is the number of dials observed by the latency histogram
+func dialCount(t *testing.T, protocol, upstream string) uint64 {
+	t.Helper()
+	var m dto.Metric
+	err := metricDialDuration.WithLabelValues(protocol, upstream).(prometheus.Metric).Write(&m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestRelayMetrics(t *testing.T) {
+	echo := newEchoServer(t)
+	s := newTestServer(t)
+	s.SetAuthenticator(StaticAuthenticator{"metrics": "pw"})
+	// an upstream of its own keeps the series apart from the other tests
+	router := NewRouter()
+	router.AddUpstream("metrics", NewDirectDialer())
+	err := router.AddRule("MATCH,metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetRouter(router)
+	addr := s.ln.Addr().String()
+	connections := testutil.ToFloat64(metricConnections.WithLabelValues(PROTOCOL_SOCKS5))
+	authErrors := testutil.ToFloat64(metricHandshakeErrors.WithLabelValues(PROTOCOL_SOCKS5, HANDSHAKE_AUTH))
+	refused := testutil.ToFloat64(metricDialErrors.WithLabelValues(PROTOCOL_SOCKS5, "metrics", "refused"))
+	dials := dialCount(t, PROTOCOL_SOCKS5, "metrics")
+	upBefore := testutil.ToFloat64(metricBytes.WithLabelValues(PROTOCOL_SOCKS5, "up", "metrics", "metrics"))
+	downBefore := testutil.ToFloat64(metricBytes.WithLabelValues(PROTOCOL_SOCKS5, "down", "metrics", "metrics"))
+	relays := metricRelays.WithLabelValues(PROTOCOL_SOCKS5, "metrics", "metrics")
+	up := metricBytes.WithLabelValues(PROTOCOL_SOCKS5, "up", "metrics", "metrics")
+	down := metricBytes.WithLabelValues(PROTOCOL_SOCKS5, "down", "metrics", "metrics")
+
+	auth := append([]byte{5, 1, METHOD_USER_PASS}, userPass("metrics", "pw")...)
+	con := proxyExchange(t, addr, append(auth, socks5Request(CMD_CONNECT, echo)...), []byte{5, METHOD_USER_PASS, 1, 0, 5, 0})
+	_, err = con.Read(make([]byte, 8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectEcho(t, con)
+	if v := testutil.ToFloat64(relays); v != 1 {
+		t.Errorf("relays %v, want 1", v)
+	}
+	_ = con.Close()
+	waitSessions(t, s)
+	expectMetric(t, "bytes up", testutil.ToFloat64(up)-upBefore, 4)
+	expectMetric(t, "bytes down", testutil.ToFloat64(down)-downBefore, 4)
+	expectMetric(t, "relays", testutil.ToFloat64(relays), 0)
+
+	expectClosed(t, proxyExchange(t, addr, append([]byte{5, 1, METHOD_USER_PASS}, userPass("metrics", "guess")...), []byte{5, METHOD_USER_PASS, 1, 1}))
+	closed := freePort(t)
+	target, _ := net.ResolveTCPAddr("tcp", closed)
+	proxyExchange(t, addr, append(auth, socks5Request(CMD_CONNECT, target)...), []byte{5, METHOD_USER_PASS, 1, 0, 5, 5})
+
+	waitSessions(t, s)
+	expectMetric(t, "connections", testutil.ToFloat64(metricConnections.WithLabelValues(PROTOCOL_SOCKS5))-connections, 3)
+	expectMetric(t, "auth errors", testutil.ToFloat64(metricHandshakeErrors.WithLabelValues(PROTOCOL_SOCKS5, HANDSHAKE_AUTH))-authErrors, 1)
+	expectMetric(t, "refused dials", testutil.ToFloat64(metricDialErrors.WithLabelValues(PROTOCOL_SOCKS5, "metrics", "refused"))-refused, 1)
+	if n := dialCount(t, PROTOCOL_SOCKS5, "metrics"); n != dials+1 {
+		t.Errorf("%d dials observed, want %d", n, dials+1)
+	}
+}
+
+func TestUdpAssociationMetric(t *testing.T) {
+	s := newTestServer(t)
+	associations := metricUdpAssociations.WithLabelValues("")
+	before := testutil.ToFloat64(associations)
+	control := udpAssociate(t, s.ln.Addr().String())
+	expectMetric(t, "udp associations", testutil.ToFloat64(associations)-before, 1)
+	_ = control.Close()
+	waitSessions(t, s)
+	expectMetric(t, "udp associations", testutil.ToFloat64(associations)-before, 0)
+}
+
+func TestMetricsHandler(t *testing.T) {
+	metricConnections.WithLabelValues(PROTOCOL_HTTP).Add(0)
+	w := httptest.NewRecorder()
+	MetricsHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d", w.Code)
+	}
+	for _, name := range []string{`mixed_socks_connections_total{protocol="http"}`, "go_goroutines"} {
+		if !strings.Contains(w.Body.String(), name) {
+			t.Errorf("%s missing", name)
+		}
+	}
+}
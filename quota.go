@@ -0,0 +1,288 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	QUOTA_DAILY   = "daily"
+	QUOTA_MONTHLY = "monthly"
+
+	DEFAULT_QUOTA_SAVE_INTERVAL = time.Minute
+)
+
+// ByteSize is a byte count, in config files a number with an optional
+// K, M, G or T suffix, 1024 based
+type ByteSize int64
+
+func ParseByteSize(s string) (ByteSize, error) {
+	n, err := parseBytes(s)
+	return ByteSize(n), err
+}
+
+func (b *ByteSize) UnmarshalYAML(value *yaml.Node) error {
+	parsed, err := ParseByteSize(value.Value)
+	if err != nil {
+		return err
+	}
+	*b = parsed
+	return nil
+}
+
+// UserQuota is the traffic a user may relay per day and per month, up
+// and down together, 0 for unlimited
+type UserQuota struct {
+	Daily   ByteSize `yaml:"daily" json:"daily"`
+	Monthly ByteSize `yaml:"monthly" json:"monthly"`
+}
+
+// QuotaConfig limit the traffic of authenticated users. Days and months
+// follow the local time of the server
+type QuotaConfig struct {
+	File          string               `yaml:"file"`           // json usage snapshot, empty to keep usage in memory only
+	SaveInterval  time.Duration        `yaml:"save_interval"`  // default 1m
+	CloseSessions bool                 `yaml:"close_sessions"` // close the live sessions of a user going over a quota
+	Default       UserQuota            `yaml:"default"`        // quota of the users not listed
+	Users         map[string]UserQuota `yaml:"users"`
+}
+
+// QuotaUsage is the traffic of a user in the current day and month
+type QuotaUsage struct {
+	Day        string `json:"day"` // 2006-01-02
+	DayBytes   int64  `json:"day_bytes"`
+	Month      string `json:"month"` // 2006-01
+	MonthBytes int64  `json:"month_bytes"`
+}
+
+// QuotaStatus is the usage of a user along its quota
+type QuotaStatus struct {
+	User string `json:"user"`
+	QuotaUsage
+	Quota    UserQuota `json:"quota"`
+	Exceeded string    `json:"exceeded,omitempty"` // daily or monthly when over a quota
+}
+
+// quotaError is a request of a user over a quota, it is answered like a
+// request rejected by a rule
+type quotaError struct {
+	user   string
+	period string
+}
+
+func (e *quotaError) Error() string {
+	return "user " + e.user + " is over its " + e.period + " quota"
+}
+
+func (e *quotaError) Is(target error) bool {
+	return target == errRejected
+}
+
+// Quotas account the traffic of every user and refuse the requests of
+// the ones over their quota
+type Quotas struct {
+	mu       sync.Mutex
+	cfg      QuotaConfig
+	usage    map[string]*QuotaUsage
+	dirty    bool
+	registry *Registry // sessions closed when a user goes over a quota
+}
+
+// NewQuotas load the usage saved in cfg.File, a missing file starts
+// from zero
+func NewQuotas(cfg QuotaConfig, registry *Registry) (*Quotas, error) {
+	q := &Quotas{cfg: cfg, usage: make(map[string]*QuotaUsage), registry: registry}
+	if cfg.File == "" {
+		return q, nil
+	}
+	data, err := os.ReadFile(cfg.File)
+	if errors.Is(err, os.ErrNotExist) {
+		return q, nil
+	}
+	if err != nil {
+		return nil, errors.New("read quota file error:" + err.Error())
+	}
+	err = json.Unmarshal(data, &q.usage)
+	if err != nil {
+		return nil, errors.New("bad quota file " + cfg.File + ":" + err.Error())
+	}
+	return q, nil
+}
+
+// Update change the quotas, the usage file is only read at start
+func (q *Quotas) Update(cfg QuotaConfig) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	cfg.File = q.cfg.File
+	q.cfg = cfg
+}
+
+func (q *Quotas) quota(user string) UserQuota {
+	if quota, ok := q.cfg.Users[user]; ok {
+		return quota
+	}
+	return q.cfg.Default
+}
+
+// current return the usage of user rolled over to the current day and
+// month, the caller holds mu
+func (q *Quotas) current(user string, now time.Time) *QuotaUsage {
+	u := q.usage[user]
+	if u == nil {
+		u = &QuotaUsage{}
+		q.usage[user] = u
+	}
+	day, month := now.Format("2006-01-02"), now.Format("2006-01")
+	if u.Day != day {
+		u.Day, u.DayBytes = day, 0
+	}
+	if u.Month != month {
+		u.Month, u.MonthBytes = month, 0
+	}
+	return u
+}
+
+// exceeded return the period whose quota u is over, the caller holds mu
+func (q *Quotas) exceeded(user string, u *QuotaUsage) string {
+	quota := q.quota(user)
+	if quota.Daily > 0 && u.DayBytes >= int64(quota.Daily) {
+		return QUOTA_DAILY
+	}
+	if quota.Monthly > 0 && u.MonthBytes >= int64(quota.Monthly) {
+		return QUOTA_MONTHLY
+	}
+	return ""
+}
+
+// check return a quotaError when user is over a quota, anonymous users
+// have none
+func (q *Quotas) check(user string) error {
+	if q == nil || user == "" {
+		return nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if period := q.exceeded(user, q.current(user, time.Now())); period != "" {
+		return &quotaError{user: user, period: period}
+	}
+	return nil
+}
+
+// add account n bytes relayed for user
+func (q *Quotas) add(user string, n int) {
+	if q == nil || user == "" || n <= 0 {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	u := q.current(user, time.Now())
+	wasOver := q.exceeded(user, u) != ""
+	u.DayBytes += int64(n)
+	u.MonthBytes += int64(n)
+	q.dirty = true
+	if period := q.exceeded(user, u); !wasOver && period != "" {
+		logrus.Warningln("user " + user + " is over its " + period + " quota")
+		if q.cfg.CloseSessions && q.registry != nil {
+			go q.registry.CloseUser(user)
+		}
+	}
+}
+
+// Reset clear the usage of user
+func (q *Quotas) Reset(user string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.usage, user)
+	q.dirty = true
+}
+
+// Status list the usage of every user with some traffic
+func (q *Quotas) Status() []QuotaStatus {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := time.Now()
+	status := make([]QuotaStatus, 0, len(q.usage))
+	for user := range q.usage {
+		u := q.current(user, now)
+		status = append(status, QuotaStatus{
+			User:       user,
+			QuotaUsage: *u,
+			Quota:      q.quota(user),
+			Exceeded:   q.exceeded(user, u),
+		})
+	}
+	sort.Slice(status, func(i, j int) bool {
+		return status[i].User < status[j].User
+	})
+	return status
+}
+
+// Save write the usage to the quota file when it changed, through a
+// temporary file so a crash never leaves it truncated
+func (q *Quotas) Save() error {
+	q.mu.Lock()
+	file := q.cfg.File // Update rewrites q.cfg, read it under the lock
+	if file == "" || !q.dirty {
+		q.mu.Unlock()
+		return nil
+	}
+	data, err := json.MarshalIndent(q.usage, "", "  ")
+	q.dirty = false
+	q.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+".*")
+	if err != nil {
+		return errors.New("write quota file error:" + err.Error())
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), file)
+	}
+	if err != nil {
+		q.mu.Lock()
+		q.dirty = true
+		q.mu.Unlock()
+		return errors.New("write quota file error:" + err.Error())
+	}
+	return nil
+}
+
+// saveEvery save the usage every interval until ctx is done
+func (q *Quotas) saveEvery(ctx context.Context) {
+	q.mu.Lock()
+	interval := q.cfg.SaveInterval
+	q.mu.Unlock()
+	if interval <= 0 {
+		interval = DEFAULT_QUOTA_SAVE_INTERVAL
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := q.Save()
+			if err != nil {
+				logrus.Errorln(err)
+			}
+		}
+	}
+}
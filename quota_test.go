@@ -0,0 +1,248 @@
+package proxy
+
+import (
+	"errors"
+	"gopkg.in/yaml.v3"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestQuotaConfigUnmarshal(t *testing.T) {
+	var cfg QuotaConfig
+	err := yaml.Unmarshal([]byte("default: {daily: 1G, monthly: 20G}\nusers: {ci: {monthly: 500M}, admin: {daily: 0}}\n"), &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Default != (UserQuota{Daily: 1 << 30, Monthly: 20 << 30}) || cfg.Users["ci"] != (UserQuota{Monthly: 500 << 20}) || cfg.Users["admin"] != (UserQuota{}) {
+		t.Errorf("config %+v", cfg)
+	}
+	if yaml.Unmarshal([]byte("default: {daily: lots}\n"), &cfg) == nil {
+		t.Error("bad size: no error")
+	}
+}
+
+func TestQuotasCheck(t *testing.T) {
+	cfg := QuotaConfig{
+		Default: UserQuota{Daily: 100, Monthly: 1000},
+		Users:   map[string]UserQuota{"ci": {Monthly: 150}, "admin": {}},
+	}
+	tests := []struct {
+		name  string
+		user  string
+		bytes []int
+		want  string // period over quota, "" for none
+	}{
+		{name: "under", user: "bob", bytes: []int{60, 39}},
+		{name: "daily reached", user: "bob", bytes: []int{60, 40}, want: QUOTA_DAILY},
+		{name: "user quota", user: "ci", bytes: []int{120}},
+		{name: "user monthly", user: "ci", bytes: []int{120, 30}, want: QUOTA_MONTHLY},
+		{name: "unlimited user", user: "admin", bytes: []int{1 << 30}},
+		{name: "anonymous", user: "", bytes: []int{1 << 30}},
+		{name: "negative ignored", user: "bob", bytes: []int{99, -50, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, err := NewQuotas(cfg, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, n := range tt.bytes {
+				q.add(tt.user, n)
+			}
+			err = q.check(tt.user)
+			var quotaErr *quotaError
+			switch {
+			case tt.want == "" && err != nil:
+				t.Errorf("error %v, want none", err)
+			case tt.want != "" && (!errors.As(err, &quotaErr) || quotaErr.period != tt.want):
+				t.Errorf("error %v, want over the %s quota", err, tt.want)
+			case err != nil && !errors.Is(err, errRejected):
+				t.Errorf("%v is not a rejection", err)
+			}
+		})
+	}
+	if (*Quotas)(nil).check("bob") != nil {
+		t.Error("nil quotas refused a request")
+	}
+}
+
+func TestQuotasRollover(t *testing.T) {
+	q, err := NewQuotas(QuotaConfig{Default: UserQuota{Daily: 100, Monthly: 1000}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	yesterday := now.AddDate(0, 0, -1).Format("2006-01-02")
+	lastMonth := now.AddDate(0, -1, 0).Format("2006-01")
+	tests := []struct {
+		name  string
+		usage QuotaUsage
+		day   int64
+		month int64
+	}{
+		{name: "same day", usage: QuotaUsage{Day: now.Format("2006-01-02"), DayBytes: 50, Month: now.Format("2006-01"), MonthBytes: 500}, day: 50, month: 500},
+		{name: "new day", usage: QuotaUsage{Day: yesterday, DayBytes: 150, Month: now.Format("2006-01"), MonthBytes: 500}, day: 0, month: 500},
+		{name: "new month", usage: QuotaUsage{Day: yesterday, DayBytes: 150, Month: lastMonth, MonthBytes: 5000}, day: 0, month: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := tt.usage
+			q.usage["bob"] = &u
+			got := q.current("bob", now)
+			if got.DayBytes != tt.day || got.MonthBytes != tt.month {
+				t.Errorf("usage %d %d, want %d %d", got.DayBytes, got.MonthBytes, tt.day, tt.month)
+			}
+		})
+	}
+}
+
+func TestQuotasPersistence(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "usage.json")
+	cfg := QuotaConfig{File: file, Default: UserQuota{Daily: 100}}
+	q, err := NewQuotas(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = q.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(file); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("file written without usage: %v", err)
+	}
+	q.add("bob", 100)
+	q.add("alice", 10)
+	err = q.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restarted, err := NewQuotas(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := restarted.Status()
+	if len(status) != 2 || status[0].User != "alice" || status[0].DayBytes != 10 || status[1].User != "bob" ||
+		status[1].MonthBytes != 100 || status[1].Exceeded != QUOTA_DAILY || status[1].Quota.Daily != 100 {
+		t.Errorf("status after restart %+v", status)
+	}
+	if restarted.check("bob") == nil {
+		t.Error("bob over quota after restart not refused")
+	}
+	restarted.Reset("bob")
+	if restarted.check("bob") != nil {
+		t.Error("bob refused after reset")
+	}
+	err = restarted.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := NewQuotas(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := again.Status(); len(status) != 2 || status[0].DayBytes != 10 || status[1].DayBytes != 0 || status[1].MonthBytes != 0 {
+		t.Errorf("status after reset %+v", status)
+	}
+	entries, err := os.ReadDir(filepath.Dir(file))
+	if err != nil || len(entries) != 1 {
+		t.Errorf("temporary files left: %v %v", entries, err)
+	}
+
+	err = os.WriteFile(file, []byte("{"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewQuotas(cfg, nil); err == nil {
+		t.Error("bad quota file: no error")
+	}
+	if _, err := NewQuotas(QuotaConfig{File: t.TempDir()}, nil); err == nil {
+		t.Error("unreadable quota file: no error")
+	}
+}
+
+func TestQuotasUpdateKeepsFile(t *testing.T) {
+	q, err := NewQuotas(QuotaConfig{File: "usage.json"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.Update(QuotaConfig{File: "other.json", Default: UserQuota{Daily: 1}})
+	if q.cfg.File != "usage.json" || q.cfg.Default.Daily != 1 {
+		t.Errorf("config %+v, want the new quotas and the first file", q.cfg)
+	}
+}
+
+// TestQuotasSaveDuringUpdate is meant for the race detector, a save
+// runs while a reload changes the quotas
+func TestQuotasSaveDuringUpdate(t *testing.T) {
+	q, err := NewQuotas(QuotaConfig{File: filepath.Join(t.TempDir(), "usage.json")}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			q.Update(QuotaConfig{Default: UserQuota{Daily: ByteSize(i + 1)}})
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		q.add("bob", 1)
+		err = q.Save()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-done
+}
+
+func TestQuotaReplies(t *testing.T) {
+	echo := newEchoServer(t)
+	s := NewSocksServer("127.0.0.1", 0)
+	s.SetDialer(NewDirectDialer())
+	s.SetAuthenticator(StaticAuthenticator{"bob": "pw", "alice": "pw"})
+	quotas, err := NewQuotas(QuotaConfig{Default: UserQuota{Daily: 1 << 20}, CloseSessions: true}, s.registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetQuotas(quotas)
+	startServer(t, s)
+	addr := s.ln.Addr().String()
+	socks5 := func(user string) []byte {
+		return append(append([]byte{5, 1, METHOD_USER_PASS}, userPass(user, "pw")...), socks5Request(CMD_CONNECT, echo)...)
+	}
+
+	alice := proxyExchange(t, addr, socks5("alice"), []byte{5, METHOD_USER_PASS, 1, 0, 5, 0})
+	_, err = io.ReadFull(alice, make([]byte, 8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectEcho(t, alice)
+	quotas.add("bob", 1<<20)
+	tests := []struct {
+		name    string
+		request []byte
+		want    []byte
+	}{
+		{name: "socks5", request: socks5("bob"), want: []byte{5, METHOD_USER_PASS, 1, 0, 5, 2}},
+		{name: "socks4", request: []byte{4, 1, byte(echo.Port >> 8), byte(echo.Port), 127, 0, 0, 1, 'b', 'o', 'b', ':', 'p', 'w', 0}, want: []byte{0, 0x5B}},
+		{
+			name:    "http",
+			request: []byte("CONNECT " + echo.String() + " HTTP/1.1\r\nProxy-Authorization: Basic Ym9iOnB3\r\n\r\n"),
+			want:    []byte("HTTP/1.1 403 Forbidden\r\n"),
+		},
+		{name: "other user", request: socks5("alice"), want: []byte{5, METHOD_USER_PASS, 1, 0, 5, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxyExchange(t, addr, tt.request, tt.want)
+		})
+	}
+
+	// going over the quota closes the live sessions of the user
+	quotas.add("alice", 1<<20)
+	expectClosed(t, alice)
+}
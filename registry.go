@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ConnInfo describe a live relay or udp association
+type ConnInfo struct {
+	ID          uint64    `json:"id"`
+	Listener    string    `json:"listener"`
+	Client      string    `json:"client"`
+	User        string    `json:"user"`
+	Protocol    string    `json:"protocol"`
+	Command     string    `json:"command"`
+	Destination string    `json:"destination"` // last target of an udp association
+	Upstream    string    `json:"upstream"`
+	Start       time.Time `json:"start"`
+	BytesUp     int64     `json:"bytes_up"`
+	BytesDown   int64     `json:"bytes_down"`
+}
+
+// Registry keep the sessions which are relaying, so they can be listed
+// and closed
+type Registry struct {
+	mu       sync.Mutex
+	sessions map[uint64]*session
+}
+
+func NewRegistry() *Registry {
+	return &Registry{sessions: make(map[uint64]*session)}
+}
+
+func (r *Registry) add(sess *session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sessions[sess.id] = sess
+}
+
+func (r *Registry) remove(sess *session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.sessions, sess.id)
+}
+
+// List return the live connections ordered by id
+func (r *Registry) List() []ConnInfo {
+	r.mu.Lock()
+	infos := make([]ConnInfo, 0, len(r.sessions))
+	for _, sess := range r.sessions {
+		infos = append(infos, sess.info())
+	}
+	r.mu.Unlock()
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ID < infos[j].ID
+	})
+	return infos
+}
+
+// Close the connection with id, false when there is none
+func (r *Registry) Close(id uint64) bool {
+	r.mu.Lock()
+	sess := r.sessions[id]
+	r.mu.Unlock()
+	if sess == nil {
+		return false
+	}
+	_ = sess.Close()
+	return true
+}
+
+// CloseUser close every connection of an authenticated user and return
+// how many there were
+func (r *Registry) CloseUser(user string) int {
+	return r.closeMatching(func(sess *session) bool {
+		return sess.user == user
+	})
+}
+
+// CloseIP close every connection from a client ip and return how many
+// there were
+func (r *Registry) CloseIP(ip net.IP) int {
+	return r.closeMatching(func(sess *session) bool {
+		return ip.Equal(addrIP(sess.client.RemoteAddr()))
+	})
+}
+
+func (r *Registry) closeMatching(match func(sess *session) bool) int {
+	r.mu.Lock()
+	var matched []*session
+	for _, sess := range r.sessions {
+		if match(sess) {
+			matched = append(matched, sess)
+		}
+	}
+	r.mu.Unlock()
+	for _, sess := range matched {
+		_ = sess.Close()
+	}
+	return len(matched)
+}
+
+func (sess *session) info() ConnInfo {
+	target, upstream, _ := sess.route()
+	return ConnInfo{
+		ID:          sess.id,
+		Listener:    sess.client.LocalAddr().String(),
+		Client:      sess.client.RemoteAddr().String(),
+		User:        sess.user,
+		Protocol:    sess.protocol,
+		Command:     sess.command,
+		Destination: target,
+		Upstream:    upstream,
+		Start:       sess.start,
+		BytesUp:     sess.bytesUp.Load(),
+		BytesDown:   sess.bytesDown.Load(),
+	}
+}
@@ -0,0 +1,622 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"golang.org/x/net/dns/dnsmessage"
+	"gopkg.in/yaml.v3"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	PREFER_IPV4 = "ipv4"      // ipv4 addresses first, the default
+	PREFER_IPV6 = "ipv6"      // ipv6 addresses first
+	ONLY_IPV4   = "ipv4_only" // never use ipv6
+	ONLY_IPV6   = "ipv6_only" // never use ipv4
+
+	DEFAULT_DNS_TIMEOUT    = 5 * time.Second
+	DEFAULT_DNS_CACHE_SIZE = 4096
+
+	dnsMessageSize = 1232 // edns0 udp payload size, avoids fragmentation
+)
+
+// ResolverConfig choose how the domains of direct connections are
+// resolved, for tcp, http and udp targets
+type ResolverConfig struct {
+	Servers   []string             `yaml:"servers"`    // tried in order, see NewResolver, empty for the system resolver
+	Hosts     map[string]HostAddrs `yaml:"hosts"`      // static addresses, checked first
+	Prefer    string               `yaml:"prefer"`     // ipv4, ipv6, ipv4_only or ipv6_only
+	CacheSize int                  `yaml:"cache_size"` // answers kept until their ttl expires, default 4096, -1 disables
+	Timeout   time.Duration        `yaml:"timeout"`    // per server query, default 5s
+}
+
+// HostAddrs is one address or a list of them
+type HostAddrs []string
+
+func (h *HostAddrs) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*h = HostAddrs{value.Value}
+		return nil
+	}
+	var addrs []string
+	err := value.Decode(&addrs)
+	if err != nil {
+		return err
+	}
+	*h = addrs
+	return nil
+}
+
+// IsZero tell if cfg leaves resolution to the system
+func (cfg *ResolverConfig) IsZero() bool {
+	return len(cfg.Servers) == 0 && len(cfg.Hosts) == 0 && cfg.Prefer == "" &&
+		cfg.CacheSize == 0 && cfg.Timeout == 0
+}
+
+// Resolver lookup the addresses of a domain, in the order they should be
+// tried
+type Resolver interface {
+	LookupIP(ctx context.Context, host string) ([]net.IP, error)
+}
+
+// dnsServer answer the A or AAAA question of a domain, ttl is how long
+// the answer may be cached, 0 for not at all
+type dnsServer interface {
+	lookup(ctx context.Context, host string, qtype dnsmessage.Type) (ips []net.IP, ttl time.Duration, err error)
+}
+
+// DNSResolver resolve with a static hosts map, then the servers in order
+// until one answers, caching the answers for their ttl
+type DNSResolver struct {
+	hosts   map[string][]net.IP
+	servers []dnsServer
+	prefer  string
+	timeout time.Duration
+	cache   *dnsCache
+}
+
+/**
+  NewResolver build the resolver of cfg, the servers are given as:
+
+     system                               the resolver of the host
+     1.1.1.1, udp://1.1.1.1:53            plain dns, over tcp when truncated
+     tcp://8.8.8.8                        plain dns over tcp
+     tls://1.1.1.1, tls://dns.google:853  dns over tls, RFC 7858
+     https://cloudflare-dns.com/dns-query dns over https, RFC 8484
+*/
+
+func NewResolver(cfg ResolverConfig) (*DNSResolver, error) {
+	r := &DNSResolver{
+		hosts:   make(map[string][]net.IP),
+		prefer:  cfg.Prefer,
+		timeout: cfg.Timeout,
+	}
+	switch cfg.Prefer {
+	case "", PREFER_IPV4, PREFER_IPV6, ONLY_IPV4, ONLY_IPV6:
+	default:
+		return nil, errors.New("unknown dns preference " + cfg.Prefer)
+	}
+	if r.timeout <= 0 {
+		r.timeout = DEFAULT_DNS_TIMEOUT
+	}
+	for host, addrs := range cfg.Hosts {
+		for _, addr := range addrs {
+			ip := net.ParseIP(addr)
+			if ip == nil {
+				return nil, errors.New("bad address " + addr + " for host " + host)
+			}
+			name := normalizeHost(host)
+			r.hosts[name] = append(r.hosts[name], ip)
+		}
+	}
+	for _, server := range cfg.Servers {
+		s, err := newDNSServer(server)
+		if err != nil {
+			return nil, err
+		}
+		r.servers = append(r.servers, s)
+	}
+	if len(r.servers) == 0 {
+		r.servers = []dnsServer{systemDNS{}}
+	}
+	size := cfg.CacheSize
+	if size == 0 {
+		size = DEFAULT_DNS_CACHE_SIZE
+	}
+	if size > 0 {
+		r.cache = &dnsCache{size: size, entries: make(map[string]*dnsCacheEntry)}
+	}
+	return r, nil
+}
+
+func (r *DNSResolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	name := normalizeHost(host)
+	if ips, ok := r.hosts[name]; ok {
+		ips = r.order(ips, nil)
+		if len(ips) == 0 {
+			return nil, &net.DNSError{Err: "no suitable address", Name: host, IsNotFound: true}
+		}
+		return ips, nil
+	}
+	var v4, v6 []net.IP
+	var err4, err6 error
+	var wg sync.WaitGroup
+	if r.prefer != ONLY_IPV6 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v4, err4 = r.lookup(ctx, name, dnsmessage.TypeA)
+		}()
+	}
+	if r.prefer != ONLY_IPV4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v6, err6 = r.lookup(ctx, name, dnsmessage.TypeAAAA)
+		}()
+	}
+	wg.Wait()
+	ips := r.order(v4, v6)
+	if len(ips) > 0 {
+		return ips, nil
+	}
+	for _, err := range []error{err4, err6} {
+		if err != nil {
+			return nil, &net.DNSError{Err: err.Error(), Name: host, IsTimeout: isTimeout(err)}
+		}
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+// order put the addresses of the preferred family first and drop the
+// family which is never used
+func (r *DNSResolver) order(v4, v6 []net.IP) []net.IP {
+	var four, six []net.IP
+	for _, ip := range append(append([]net.IP{}, v4...), v6...) {
+		if ip.To4() != nil {
+			four = append(four, ip)
+		} else {
+			six = append(six, ip)
+		}
+	}
+	switch r.prefer {
+	case ONLY_IPV4:
+		return four
+	case ONLY_IPV6:
+		return six
+	case PREFER_IPV6:
+		return append(six, four...)
+	}
+	return append(four, six...)
+}
+
+// lookup ask the servers in order until one answers, an empty answer
+// is an answer
+func (r *DNSResolver) lookup(ctx context.Context, name string, qtype dnsmessage.Type) ([]net.IP, error) {
+	key := name + "/" + qtype.String()
+	if ips, ok := r.cache.get(key); ok {
+		return ips, nil
+	}
+	var lastErr error
+	for _, server := range r.servers {
+		queryCtx, cancel := context.WithTimeout(ctx, r.timeout)
+		ips, ttl, err := server.lookup(queryCtx, name, qtype)
+		cancel()
+		if err == nil {
+			r.cache.put(key, ips, ttl)
+			return ips, nil
+		}
+		lastErr = err
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, lastErr
+}
+
+type dnsCacheEntry struct {
+	ips     []net.IP
+	expires time.Time
+}
+
+// dnsCache keep answers until their ttl expires, when it is full the
+// expired entries are dropped, then arbitrary ones
+type dnsCache struct {
+	mu      sync.Mutex
+	size    int
+	entries map[string]*dnsCacheEntry
+}
+
+func (c *dnsCache) get(key string) ([]net.IP, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := c.entries[key]
+	if e == nil {
+		return nil, false
+	}
+	if time.Now().After(e.expires) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return e.ips, true
+}
+
+func (c *dnsCache) put(key string, ips []net.IP, ttl time.Duration) {
+	if c == nil || ttl <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if len(c.entries) >= c.size {
+		for k, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+	}
+	for k := range c.entries {
+		if len(c.entries) < c.size {
+			break
+		}
+		delete(c.entries, k)
+	}
+	c.entries[key] = &dnsCacheEntry{ips: ips, expires: now.Add(ttl)}
+}
+
+func newDNSServer(server string) (dnsServer, error) {
+	if server == "system" {
+		return systemDNS{}, nil
+	}
+	if !strings.Contains(server, "://") {
+		server = "udp://" + server
+	}
+	u, err := url.Parse(server)
+	if err != nil || u.Host == "" {
+		return nil, errors.New("bad dns server " + server)
+	}
+	withPort := func(port string) string {
+		if u.Port() != "" {
+			return u.Host
+		}
+		return net.JoinHostPort(u.Hostname(), port)
+	}
+	switch u.Scheme {
+	case "udp":
+		return &plainDNS{addr: withPort("53"), udp: true}, nil
+	case "tcp":
+		return &plainDNS{addr: withPort("53")}, nil
+	case "tls":
+		return &plainDNS{addr: withPort("853"), tls: &tls.Config{ServerName: u.Hostname()}}, nil
+	case "https":
+		return &httpsDNS{url: u.String(), client: &http.Client{}}, nil
+	}
+	return nil, errors.New("unsupported dns server scheme " + u.Scheme)
+}
+
+// systemDNS ask the resolver of the host, its answers are not cached
+// as their ttl is unknown
+type systemDNS struct{}
+
+func (systemDNS) lookup(ctx context.Context, host string, qtype dnsmessage.Type) ([]net.IP, time.Duration, error) {
+	network := "ip4"
+	if qtype == dnsmessage.TypeAAAA {
+		network = "ip6"
+	}
+	ips, err := net.DefaultResolver.LookupIP(ctx, network, host)
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return nil, 0, nil
+	}
+	return ips, 0, err
+}
+
+// plainDNS query a server over udp, tcp or tls
+type plainDNS struct {
+	addr string
+	udp  bool
+	tls  *tls.Config
+}
+
+func (s *plainDNS) lookup(ctx context.Context, host string, qtype dnsmessage.Type) ([]net.IP, time.Duration, error) {
+	id, query, err := newDNSQuery(host, qtype)
+	if err != nil {
+		return nil, 0, err
+	}
+	var resp []byte
+	if s.udp {
+		resp, err = s.exchangeUDP(ctx, id, query)
+		if err == nil && truncated(resp) {
+			resp, err = s.exchangeStream(ctx, query)
+		}
+	} else {
+		resp, err = s.exchangeStream(ctx, query)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	return parseDNSResponse(resp, id, host, qtype)
+}
+
+func (s *plainDNS) exchangeUDP(ctx context.Context, id uint16, query []byte) ([]byte, error) {
+	var d net.Dialer
+	con, err := d.DialContext(ctx, "udp", s.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer func(con net.Conn) {
+		_ = con.Close()
+	}(con)
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = con.SetDeadline(deadline)
+	}
+	_, err = con.Write(query)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 65535)
+	for {
+		n, err := con.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// ignore stray datagrams, the answer carries the query id
+		if n >= 2 && binary.BigEndian.Uint16(buf[:2]) == id {
+			return buf[:n], nil
+		}
+	}
+}
+
+// exchangeStream send the query with its two bytes length prefix over tcp
+// or tls, RFC 1035 4.2.2
+func (s *plainDNS) exchangeStream(ctx context.Context, query []byte) ([]byte, error) {
+	var con net.Conn
+	var err error
+	if s.tls != nil {
+		d := &tls.Dialer{Config: s.tls}
+		con, err = d.DialContext(ctx, "tcp", s.addr)
+	} else {
+		var d net.Dialer
+		con, err = d.DialContext(ctx, "tcp", s.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer func(con net.Conn) {
+		_ = con.Close()
+	}(con)
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = con.SetDeadline(deadline)
+	}
+	msg := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(msg, uint16(len(query)))
+	copy(msg[2:], query)
+	_, err = con.Write(msg)
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.ReadFull(con, msg[:2])
+	if err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(msg[:2]))
+	_, err = io.ReadFull(con, resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// httpsDNS post queries in the wire format, RFC 8484
+type httpsDNS struct {
+	url    string
+	client *http.Client
+}
+
+func (s *httpsDNS) lookup(ctx context.Context, host string, qtype dnsmessage.Type) ([]net.IP, time.Duration, error) {
+	_, query, err := newDNSQuery(host, qtype)
+	if err != nil {
+		return nil, 0, err
+	}
+	// the id is 0 so http caches can share answers
+	query[0], query[1] = 0, 0
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(query))
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer func(body io.ReadCloser) {
+		_ = body.Close()
+	}(res.Body)
+	if res.StatusCode != http.StatusOK {
+		return nil, 0, errors.New("dns over https status " + res.Status)
+	}
+	resp, err := io.ReadAll(io.LimitReader(res.Body, 65535))
+	if err != nil {
+		return nil, 0, err
+	}
+	return parseDNSResponse(resp, 0, host, qtype)
+}
+
+// newDNSQuery build a recursive query for the A or AAAA records of host
+func newDNSQuery(host string, qtype dnsmessage.Type) (uint16, []byte, error) {
+	var idBuf [2]byte
+	_, err := rand.Read(idBuf[:])
+	if err != nil {
+		return 0, nil, err
+	}
+	id := binary.BigEndian.Uint16(idBuf[:])
+	name, err := dnsmessage.NewName(host + ".")
+	if err != nil {
+		return 0, nil, errors.New("bad domain name " + host)
+	}
+	b := dnsmessage.NewBuilder(make([]byte, 0, 512), dnsmessage.Header{ID: id, RecursionDesired: true})
+	b.EnableCompression()
+	err = b.StartQuestions()
+	if err == nil {
+		err = b.Question(dnsmessage.Question{Name: name, Type: qtype, Class: dnsmessage.ClassINET})
+	}
+	if err == nil {
+		err = b.StartAdditionals()
+	}
+	if err == nil {
+		var opt dnsmessage.ResourceHeader
+		err = opt.SetEDNS0(dnsMessageSize, dnsmessage.RCodeSuccess, false)
+		if err == nil {
+			err = b.OPTResource(opt, dnsmessage.OPTResource{})
+		}
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	msg, err := b.Finish()
+	return id, msg, err
+}
+
+func truncated(resp []byte) bool {
+	var p dnsmessage.Parser
+	h, err := p.Start(resp)
+	return err == nil && h.Truncated
+}
+
+// parseDNSResponse read the addresses of host in an answer and how long
+// they may be cached, a name without addresses is cached for the negative
+// ttl of its zone. Records of other names than host and its aliases are
+// ignored
+func parseDNSResponse(resp []byte, id uint16, host string, qtype dnsmessage.Type) ([]net.IP, time.Duration, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(resp)
+	if err != nil {
+		return nil, 0, errors.New("bad dns response:" + err.Error())
+	}
+	if h.ID != id || !h.Response {
+		return nil, 0, errors.New("dns response does not match the query")
+	}
+	if h.RCode != dnsmessage.RCodeSuccess && h.RCode != dnsmessage.RCodeNameError {
+		return nil, 0, errors.New("dns server error " + h.RCode.String())
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil, 0, errors.New("bad dns response:" + err.Error())
+	}
+	qname := strings.ToLower(q.Name.String())
+	if qname != strings.ToLower(host)+"." || q.Type != qtype || q.Class != dnsmessage.ClassINET {
+		return nil, 0, errors.New("dns response does not match the query")
+	}
+	err = p.SkipAllQuestions()
+	if err != nil {
+		return nil, 0, errors.New("bad dns response:" + err.Error())
+	}
+	var ttl uint32
+	first := true
+	minTTL := func(t uint32) {
+		if first || t < ttl {
+			ttl, first = t, false
+		}
+	}
+	type record struct {
+		ip  net.IP
+		ttl uint32
+	}
+	type alias struct {
+		target string
+		ttl    uint32
+	}
+	addrs := make(map[string][]record)
+	aliases := make(map[string]alias)
+	for {
+		rh, err := p.AnswerHeader()
+		if errors.Is(err, dnsmessage.ErrSectionDone) {
+			break
+		}
+		if err != nil {
+			return nil, 0, errors.New("bad dns response:" + err.Error())
+		}
+		name := strings.ToLower(rh.Name.String())
+		switch {
+		case rh.Class != dnsmessage.ClassINET:
+			err = p.SkipAnswer()
+		case rh.Type == dnsmessage.TypeCNAME:
+			var cname dnsmessage.CNAMEResource
+			cname, err = p.CNAMEResource()
+			if err == nil {
+				aliases[name] = alias{target: strings.ToLower(cname.CNAME.String()), ttl: rh.TTL}
+			}
+		case rh.Type == qtype && qtype == dnsmessage.TypeA:
+			var a dnsmessage.AResource
+			a, err = p.AResource()
+			if err == nil {
+				addrs[name] = append(addrs[name], record{ip: net.IP(a.A[:]), ttl: rh.TTL})
+			}
+		case rh.Type == qtype && qtype == dnsmessage.TypeAAAA:
+			var aaaa dnsmessage.AAAAResource
+			aaaa, err = p.AAAAResource()
+			if err == nil {
+				addrs[name] = append(addrs[name], record{ip: net.IP(aaaa.AAAA[:]), ttl: rh.TTL})
+			}
+		default:
+			err = p.SkipAnswer()
+		}
+		if err != nil {
+			return nil, 0, errors.New("bad dns response:" + err.Error())
+		}
+	}
+	// follow the aliases of the question, a few hops at most so a loop ends
+	var ips []net.IP
+	name := qname
+	for hop := 0; hop < 8; hop++ {
+		for _, r := range addrs[name] {
+			ips = append(ips, r.ip)
+			minTTL(r.ttl)
+		}
+		a, ok := aliases[name]
+		if !ok || len(ips) > 0 {
+			break
+		}
+		minTTL(a.ttl)
+		name = a.target
+	}
+	if len(ips) == 0 {
+		for {
+			rh, err := p.AuthorityHeader()
+			if err != nil {
+				break
+			}
+			if rh.Type != dnsmessage.TypeSOA {
+				if p.SkipAuthority() != nil {
+					break
+				}
+				continue
+			}
+			soa, err := p.SOAResource()
+			if err != nil {
+				break
+			}
+			minTTL(rh.TTL)
+			minTTL(soa.MinTTL)
+			break
+		}
+	}
+	return ips, time.Duration(ttl) * time.Second, nil
+}
@@ -0,0 +1,409 @@
+package proxy
+
+import (
+	"context"
+	"golang.org/x/net/dns/dnsmessage"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// staticResolver answer every domain with the same addresses and record
+// the ones asked
+type staticResolver struct {
+	ips   []net.IP
+	asked []string
+}
+
+func (r *staticResolver) LookupIP(_ context.Context, host string) ([]net.IP, error) {
+	r.asked = append(r.asked, host)
+	return r.ips, nil
+}
+
+type dnsAnswer struct {
+	name  string
+	ttl   uint32
+	a     string // A or AAAA address
+	cname string
+}
+
+// dnsResponse build the answer to the question name qtype
+func dnsResponse(t *testing.T, id uint16, rcode dnsmessage.RCode, name string, qtype dnsmessage.Type, answers []dnsAnswer, soaTTL uint32) []byte {
+	t.Helper()
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, Response: true, RCode: rcode})
+	must := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	must(b.StartQuestions())
+	must(b.Question(dnsmessage.Question{Name: dnsmessage.MustNewName(name), Type: qtype, Class: dnsmessage.ClassINET}))
+	must(b.StartAnswers())
+	for _, a := range answers {
+		h := dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(a.name), Class: dnsmessage.ClassINET, TTL: a.ttl}
+		ip := net.ParseIP(a.a)
+		switch {
+		case a.cname != "":
+			must(b.CNAMEResource(h, dnsmessage.CNAMEResource{CNAME: dnsmessage.MustNewName(a.cname)}))
+		case ip.To4() != nil:
+			var r dnsmessage.AResource
+			copy(r.A[:], ip.To4())
+			must(b.AResource(h, r))
+		default:
+			var r dnsmessage.AAAAResource
+			copy(r.AAAA[:], ip)
+			must(b.AAAAResource(h, r))
+		}
+	}
+	if soaTTL > 0 {
+		must(b.StartAuthorities())
+		must(b.SOAResource(dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("test."), Class: dnsmessage.ClassINET, TTL: 3600},
+			dnsmessage.SOAResource{NS: dnsmessage.MustNewName("ns.test."), MBox: dnsmessage.MustNewName("admin.test."), MinTTL: soaTTL}))
+	}
+	msg, err := b.Finish()
+	must(err)
+	return msg
+}
+
+func TestParseDNSResponse(t *testing.T) {
+	A, AAAA := dnsmessage.TypeA, dnsmessage.TypeAAAA
+	success := dnsmessage.RCodeSuccess
+	tests := []struct {
+		name    string
+		resp    func(t *testing.T) []byte
+		host    string
+		qtype   dnsmessage.Type
+		ips     []string
+		ttl     time.Duration
+		wantErr bool
+	}{
+		{
+			name: "a records",
+			resp: func(t *testing.T) []byte {
+				return dnsResponse(t, 7, success, "a.test.", A, []dnsAnswer{
+					{name: "a.test.", ttl: 60, a: "192.0.2.1"},
+					{name: "a.test.", ttl: 30, a: "192.0.2.2"},
+				}, 0)
+			},
+			host: "a.test", qtype: A, ips: []string{"192.0.2.1", "192.0.2.2"}, ttl: 30 * time.Second,
+		},
+		{
+			name: "aaaa record",
+			resp: func(t *testing.T) []byte {
+				return dnsResponse(t, 7, success, "a.test.", AAAA, []dnsAnswer{{name: "a.test.", ttl: 60, a: "2001:db8::1"}}, 0)
+			},
+			host: "a.test", qtype: AAAA, ips: []string{"2001:db8::1"}, ttl: time.Minute,
+		},
+		{
+			name: "name case differs",
+			resp: func(t *testing.T) []byte {
+				return dnsResponse(t, 7, success, "A.Test.", A, []dnsAnswer{{name: "a.TEST.", ttl: 60, a: "192.0.2.1"}}, 0)
+			},
+			host: "a.test", qtype: A, ips: []string{"192.0.2.1"}, ttl: time.Minute,
+		},
+		{
+			name: "cname chain",
+			resp: func(t *testing.T) []byte {
+				return dnsResponse(t, 7, success, "www.test.", A, []dnsAnswer{
+					{name: "www.test.", ttl: 300, cname: "edge.test."},
+					{name: "edge.test.", ttl: 100, cname: "node.cdn.test."},
+					{name: "node.cdn.test.", ttl: 200, a: "192.0.2.9"},
+				}, 0)
+			},
+			host: "www.test", qtype: A, ips: []string{"192.0.2.9"}, ttl: 100 * time.Second,
+		},
+		{
+			name: "records of other names ignored",
+			resp: func(t *testing.T) []byte {
+				return dnsResponse(t, 7, success, "a.test.", A, []dnsAnswer{
+					{name: "bank.test.", ttl: 60, a: "203.0.113.66"},
+					{name: "a.test.", ttl: 60, a: "192.0.2.1"},
+				}, 0)
+			},
+			host: "a.test", qtype: A, ips: []string{"192.0.2.1"}, ttl: time.Minute,
+		},
+		{
+			name: "only other names",
+			resp: func(t *testing.T) []byte {
+				return dnsResponse(t, 7, success, "a.test.", A, []dnsAnswer{{name: "bank.test.", ttl: 60, a: "203.0.113.66"}}, 0)
+			},
+			host: "a.test", qtype: A,
+		},
+		{
+			name: "cname to a name not answered",
+			resp: func(t *testing.T) []byte {
+				return dnsResponse(t, 7, success, "a.test.", A, []dnsAnswer{
+					{name: "a.test.", ttl: 60, cname: "b.test."},
+					{name: "c.test.", ttl: 60, a: "203.0.113.66"},
+				}, 0)
+			},
+			host: "a.test", qtype: A, ttl: time.Minute,
+		},
+		{
+			name: "cname loop",
+			resp: func(t *testing.T) []byte {
+				return dnsResponse(t, 7, success, "a.test.", A, []dnsAnswer{
+					{name: "a.test.", ttl: 60, cname: "b.test."},
+					{name: "b.test.", ttl: 60, cname: "a.test."},
+				}, 0)
+			},
+			host: "a.test", qtype: A, ttl: time.Minute,
+		},
+		{
+			name: "other type ignored",
+			resp: func(t *testing.T) []byte {
+				return dnsResponse(t, 7, success, "a.test.", A, []dnsAnswer{{name: "a.test.", ttl: 60, a: "2001:db8::1"}}, 0)
+			},
+			host: "a.test", qtype: A,
+		},
+		{
+			name: "nxdomain negative ttl",
+			resp: func(t *testing.T) []byte {
+				return dnsResponse(t, 7, dnsmessage.RCodeNameError, "a.test.", A, nil, 120)
+			},
+			host: "a.test", qtype: A, ttl: 2 * time.Minute,
+		},
+		{
+			name: "wrong id",
+			resp: func(t *testing.T) []byte {
+				return dnsResponse(t, 8, success, "a.test.", A, []dnsAnswer{{name: "a.test.", ttl: 60, a: "192.0.2.1"}}, 0)
+			},
+			host: "a.test", qtype: A, wantErr: true,
+		},
+		{
+			name: "other question",
+			resp: func(t *testing.T) []byte {
+				return dnsResponse(t, 7, success, "b.test.", A, []dnsAnswer{{name: "b.test.", ttl: 60, a: "192.0.2.1"}}, 0)
+			},
+			host: "a.test", qtype: A, wantErr: true,
+		},
+		{
+			name: "other question type",
+			resp: func(t *testing.T) []byte {
+				return dnsResponse(t, 7, success, "a.test.", AAAA, nil, 0)
+			},
+			host: "a.test", qtype: A, wantErr: true,
+		},
+		{
+			name: "server failure",
+			resp: func(t *testing.T) []byte {
+				return dnsResponse(t, 7, dnsmessage.RCodeServerFailure, "a.test.", A, nil, 0)
+			},
+			host: "a.test", qtype: A, wantErr: true,
+		},
+		{
+			name: "truncated message",
+			resp: func(t *testing.T) []byte {
+				return dnsResponse(t, 7, success, "a.test.", A, []dnsAnswer{{name: "a.test.", ttl: 60, a: "192.0.2.1"}}, 0)[:30]
+			},
+			host: "a.test", qtype: A, wantErr: true,
+		},
+		{name: "garbage", resp: func(*testing.T) []byte { return []byte{1, 2, 3} }, host: "a.test", qtype: A, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ips, ttl, err := parseDNSResponse(tt.resp(t), 7, tt.host, tt.qtype)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error %v, want error %v", err, tt.wantErr)
+			}
+			var got []string
+			for _, ip := range ips {
+				got = append(got, ip.String())
+			}
+			if !reflect.DeepEqual(got, tt.ips) || ttl != tt.ttl {
+				t.Errorf("got %v ttl %v, want %v ttl %v", got, ttl, tt.ips, tt.ttl)
+			}
+		})
+	}
+}
+
+func TestResolverConfigIsZero(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  ResolverConfig
+		want bool
+	}{
+		{name: "empty", want: true},
+		{name: "servers", cfg: ResolverConfig{Servers: []string{"1.1.1.1"}}},
+		{name: "hosts", cfg: ResolverConfig{Hosts: map[string]HostAddrs{"a": {"192.0.2.1"}}}},
+		{name: "prefer", cfg: ResolverConfig{Prefer: PREFER_IPV6}},
+		{name: "cache size", cfg: ResolverConfig{CacheSize: 10}},
+		{name: "cache disabled", cfg: ResolverConfig{CacheSize: -1}},
+		{name: "timeout", cfg: ResolverConfig{Timeout: time.Second}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.cfg.IsZero(); got != tt.want {
+				t.Errorf("IsZero %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewDNSServer(t *testing.T) {
+	tests := []struct {
+		server  string
+		want    dnsServer
+		wantErr bool
+	}{
+		{server: "system", want: systemDNS{}},
+		{server: "1.1.1.1", want: &plainDNS{addr: "1.1.1.1:53", udp: true}},
+		{server: "udp://1.1.1.1:5353", want: &plainDNS{addr: "1.1.1.1:5353", udp: true}},
+		{server: "tcp://8.8.8.8", want: &plainDNS{addr: "8.8.8.8:53"}},
+		{server: "udp://[2606:4700::1111]", want: &plainDNS{addr: "[2606:4700::1111]:53", udp: true}},
+		{server: "ftp://1.1.1.1", wantErr: true},
+		{server: "udp://", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.server, func(t *testing.T) {
+			got, err := newDNSServer(tt.server)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+	for _, server := range []string{"tls://dns.google", "https://cloudflare-dns.com/dns-query"} {
+		if _, err := newDNSServer(server); err != nil {
+			t.Errorf("%s: %v", server, err)
+		}
+	}
+}
+
+func TestNewResolverErrors(t *testing.T) {
+	for _, cfg := range []ResolverConfig{
+		{Prefer: "ipv5"},
+		{Hosts: map[string]HostAddrs{"a.test": {"not an ip"}}},
+		{Servers: []string{"ftp://1.1.1.1"}},
+	} {
+		if _, err := NewResolver(cfg); err == nil {
+			t.Errorf("%+v: no error", cfg)
+		}
+	}
+}
+
+func TestResolverHostsOrder(t *testing.T) {
+	hosts := map[string]HostAddrs{"Dual.Test": {"2001:db8::1", "192.0.2.1"}}
+	tests := []struct {
+		prefer string
+		want   []string
+	}{
+		{prefer: "", want: []string{"192.0.2.1", "2001:db8::1"}},
+		{prefer: PREFER_IPV4, want: []string{"192.0.2.1", "2001:db8::1"}},
+		{prefer: PREFER_IPV6, want: []string{"2001:db8::1", "192.0.2.1"}},
+		{prefer: ONLY_IPV4, want: []string{"192.0.2.1"}},
+		{prefer: ONLY_IPV6, want: []string{"2001:db8::1"}},
+	}
+	for _, tt := range tests {
+		t.Run("prefer "+tt.prefer, func(t *testing.T) {
+			r, err := NewResolver(ResolverConfig{Hosts: hosts, Prefer: tt.prefer})
+			if err != nil {
+				t.Fatal(err)
+			}
+			ips, err := r.LookupIP(context.Background(), "dual.test.")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, ip := range ips {
+				got = append(got, ip.String())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDNSCache(t *testing.T) {
+	ip := []net.IP{net.IPv4(192, 0, 2, 1)}
+	c := &dnsCache{size: 2, entries: make(map[string]*dnsCacheEntry)}
+	c.put("a/A", ip, time.Minute)
+	if got, ok := c.get("a/A"); !ok || !reflect.DeepEqual(got, ip) {
+		t.Fatalf("get %v %v, want the entry", got, ok)
+	}
+	c.put("nottl/A", ip, 0)
+	if _, ok := c.get("nottl/A"); ok {
+		t.Error("answer without ttl cached")
+	}
+	c.put("old/A", ip, time.Minute)
+	c.entries["old/A"].expires = time.Now().Add(-time.Second)
+	if _, ok := c.get("old/A"); ok {
+		t.Error("expired entry returned")
+	}
+	if _, ok := c.entries["old/A"]; ok {
+		t.Error("expired entry kept")
+	}
+	for _, key := range []string{"b/A", "c/A", "d/A"} {
+		c.put(key, ip, time.Minute)
+		if len(c.entries) > c.size {
+			t.Fatalf("%d entries in a cache of %d", len(c.entries), c.size)
+		}
+	}
+	if _, ok := c.get("d/A"); !ok {
+		t.Error("newest entry evicted")
+	}
+	var disabled *dnsCache
+	disabled.put("a/A", ip, time.Minute)
+	if _, ok := disabled.get("a/A"); ok {
+		t.Error("nil cache returned an entry")
+	}
+}
+
+func TestResolveIPUsesResolver(t *testing.T) {
+	r := &staticResolver{ips: []net.IP{net.ParseIP("2001:db8::1"), net.IPv4(192, 0, 2, 1)}}
+	ip, err := resolveIP(context.Background(), r, "a.test", false)
+	if err != nil || !ip.Equal(net.ParseIP("2001:db8::1")) {
+		t.Errorf("resolveIP %v %v, want the first address", ip, err)
+	}
+	ip, err = resolveIP(context.Background(), r, "a.test", true)
+	if err != nil || !ip.Equal(net.IPv4(192, 0, 2, 1)) {
+		t.Errorf("resolveIP want4 %v %v, want the ipv4 address", ip, err)
+	}
+	ip, err = resolveIP(context.Background(), r, "192.0.2.7", false)
+	if err != nil || !ip.Equal(net.IPv4(192, 0, 2, 7)) {
+		t.Errorf("resolveIP of an ip %v %v", ip, err)
+	}
+	if !reflect.DeepEqual(r.asked, []string{"a.test", "a.test"}) {
+		t.Errorf("resolver asked %v", r.asked)
+	}
+	_, err = resolveIP(context.Background(), &staticResolver{ips: []net.IP{net.ParseIP("2001:db8::1")}}, "a.test", true)
+	if err == nil {
+		t.Error("no ipv4 address: no error")
+	}
+}
+
+func TestBindPeerIPsUsesResolver(t *testing.T) {
+	r := &staticResolver{ips: []net.IP{net.IPv4(192, 0, 2, 1)}}
+	ips, err := bindPeerIPs(context.Background(), r, "peer.test")
+	if err != nil || !reflect.DeepEqual(ips, r.ips) {
+		t.Errorf("bindPeerIPs %v %v, want %v", ips, err, r.ips)
+	}
+	ips, err = bindPeerIPs(context.Background(), r, "0.0.0.0")
+	if err != nil || ips != nil {
+		t.Errorf("bindPeerIPs of any address %v %v, want nil", ips, err)
+	}
+	if len(r.asked) != 1 {
+		t.Errorf("resolver asked %v", r.asked)
+	}
+}
+
+func TestUpstreamChainResolver(t *testing.T) {
+	r := &staticResolver{}
+	dialer, err := newChainDialer(&DirectDialer{Resolver: r}, "socks5h://127.0.0.1:1", "socks5://127.0.0.1:2", "socks4://127.0.0.1:3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	socks4, ok := dialer.(*Socks4Dialer)
+	if !ok || socks4.resolver != r {
+		t.Fatalf("last hop %#v does not resolve with the config resolver", dialer)
+	}
+	socks5, ok := socks4.forward.(*Socks5Dialer)
+	if !ok || socks5.resolver != r {
+		t.Fatalf("middle hop %#v does not resolve with the config resolver", socks4.forward)
+	}
+}
@@ -0,0 +1,241 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	ROUTE_DIRECT  = "DIRECT"
+	ROUTE_REJECT  = "REJECT"
+	ROUTE_DEFAULT = "default"
+)
+
+var errRejected = errors.New("connection rejected by rule")
+
+// RouteRequest describe an outbound connection waiting for a route
+type RouteRequest struct {
+	Protocol string // socks4, socks5 or http
+	Source   net.Addr
+	User     string
+	Host     string // domain or ip
+	Port     uint16
+}
+
+// Route is the outcome of a routing decision, Dialer is nil for REJECT
+type Route struct {
+	Name   string
+	Rule   string
+	Dialer Dialer
+}
+
+/**
+  Router pick the outbound of a connection with the first matching rule,
+  a rule is a line of the form TYPE,VALUE,TARGET where TARGET is DIRECT,
+  REJECT or the name of an upstream added with AddUpstream:
+
+     DOMAIN,www.example.com,corp       exact domain
+     DOMAIN-SUFFIX,example.com,corp    domain and its sub domains
+     DOMAIN-KEYWORD,example,corp       domain containing the keyword
+     DOMAIN-REGEX,^ad[0-9]+\.,REJECT   domain matching the regexp
+     IP-CIDR,10.0.0.0/8,DIRECT         ip destination in the network
+     DST-PORT,8000-9000,corp           destination port or port range
+     SRC-IP-CIDR,192.168.1.0/24,corp   client address in the network
+     USER,alice,corp                   authenticated user
+     PROTOCOL,socks4,REJECT            inbound protocol socks4, socks5 or http
+     MATCH,DIRECT                      anything
+
+  Lines starting with # are comments.
+*/
+
+type Router struct {
+	rules     []*rule
+	upstreams map[string]Dialer
+}
+
+type rule struct {
+	raw    string
+	target string
+	match  func(req *RouteRequest) bool
+}
+
+// NewRouter return a router without rules, its DIRECT outbound refuses
+// the private addresses like the default dialer of NewSocksServer
+func NewRouter() *Router {
+	return &Router{
+		upstreams: map[string]Dialer{ROUTE_DIRECT: newGuardedDialer("")},
+	}
+}
+
+// AddUpstream register a named outbound rules can refer to
+func (r *Router) AddUpstream(name string, dialer Dialer) {
+	r.upstreams[name] = dialer
+}
+
+// LoadRules append the rules of a file
+func (r *Router) LoadRules(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func(f *os.File) {
+		_ = f.Close()
+	}(f)
+	scanner := bufio.NewScanner(f)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		err = r.AddRule(line)
+		if err != nil {
+			return errors.New(path + ":" + strconv.Itoa(lineNo) + " " + err.Error())
+		}
+	}
+	return scanner.Err()
+}
+
+// AddRule append a rule, its target must be DIRECT, REJECT or a known upstream
+func (r *Router) AddRule(line string) error {
+	kind, rest, ok := strings.Cut(line, ",")
+	if !ok {
+		return errors.New("bad rule " + line)
+	}
+	kind = strings.ToUpper(strings.TrimSpace(kind))
+	value, target := "", strings.TrimSpace(rest)
+	if kind != "MATCH" {
+		i := strings.LastIndex(rest, ",")
+		if i == -1 {
+			return errors.New("bad rule " + line)
+		}
+		value, target = strings.TrimSpace(rest[:i]), strings.TrimSpace(rest[i+1:])
+	}
+	if target != ROUTE_REJECT && r.upstreams[target] == nil {
+		return errors.New("unknown upstream " + target + " in rule " + line)
+	}
+	match, err := newRuleMatcher(kind, value)
+	if err != nil {
+		return errors.New(err.Error() + " in rule " + line)
+	}
+	r.rules = append(r.rules, &rule{raw: line, target: target, match: match})
+	return nil
+}
+
+// Route return the outbound of the first matching rule,
+// nil when no rule matches
+func (r *Router) Route(req *RouteRequest) *Route {
+	for _, rl := range r.rules {
+		if rl.match(req) {
+			return &Route{Name: rl.target, Rule: rl.raw, Dialer: r.upstreams[rl.target]}
+		}
+	}
+	return nil
+}
+
+func newRuleMatcher(kind, value string) (func(req *RouteRequest) bool, error) {
+	lower := normalizeHost(value)
+	switch kind {
+	case "MATCH":
+		return func(req *RouteRequest) bool {
+			return true
+		}, nil
+	case "DOMAIN":
+		return func(req *RouteRequest) bool {
+			return normalizeHost(req.Host) == lower
+		}, nil
+	case "DOMAIN-SUFFIX":
+		return func(req *RouteRequest) bool {
+			host := normalizeHost(req.Host)
+			return host == lower || strings.HasSuffix(host, "."+lower)
+		}, nil
+	case "DOMAIN-KEYWORD":
+		return func(req *RouteRequest) bool {
+			return strings.Contains(normalizeHost(req.Host), lower)
+		}, nil
+	case "DOMAIN-REGEX":
+		re, err := regexp.Compile(value)
+		if err != nil {
+			return nil, err
+		}
+		return func(req *RouteRequest) bool {
+			return net.ParseIP(req.Host) == nil && re.MatchString(normalizeHost(req.Host))
+		}, nil
+	case "IP-CIDR", "IP-CIDR6":
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, err
+		}
+		return func(req *RouteRequest) bool {
+			ip := net.ParseIP(req.Host)
+			return ip != nil && network.Contains(ip)
+		}, nil
+	case "SRC-IP-CIDR":
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, err
+		}
+		return func(req *RouteRequest) bool {
+			ip := addrIP(req.Source)
+			return ip != nil && network.Contains(ip)
+		}, nil
+	case "DST-PORT":
+		low, high, err := parsePortRange(value)
+		if err != nil {
+			return nil, err
+		}
+		return func(req *RouteRequest) bool {
+			return req.Port >= low && req.Port <= high
+		}, nil
+	case "USER":
+		return func(req *RouteRequest) bool {
+			return strings.ToLower(req.User) == lower
+		}, nil
+	case "PROTOCOL":
+		if lower != PROTOCOL_SOCKS4 && lower != PROTOCOL_SOCKS5 && lower != PROTOCOL_HTTP {
+			return nil, errors.New("unknown protocol " + value)
+		}
+		return func(req *RouteRequest) bool {
+			return req.Protocol == lower
+		}, nil
+	}
+	return nil, errors.New("unknown rule type " + kind)
+}
+
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// parsePortRange parse 443 or 8000-9000
+func parsePortRange(value string) (uint16, uint16, error) {
+	lowStr, highStr, isRange := strings.Cut(value, "-")
+	low, err := strconv.ParseUint(strings.TrimSpace(lowStr), 10, 16)
+	if err != nil {
+		return 0, 0, errors.New("bad port " + value)
+	}
+	high := low
+	if isRange {
+		high, err = strconv.ParseUint(strings.TrimSpace(highStr), 10, 16)
+		if err != nil || high < low {
+			return 0, 0, errors.New("bad port range " + value)
+		}
+	}
+	return uint16(low), uint16(high), nil
+}
+
+// addrIP return the ip of a tcp or udp address
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	return nil
+}
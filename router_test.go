@@ -0,0 +1,229 @@
+package proxy
+
+import (
+	"context"
+	"mixed-socks/socks"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestRouterRoute(t *testing.T) {
+	client := &net.TCPAddr{IP: net.IPv4(192, 168, 1, 10), Port: 40000}
+	tests := []struct {
+		name  string
+		rules []string
+		req   RouteRequest
+		want  string // route name, "" for no match
+	}{
+		{name: "domain", rules: []string{"DOMAIN,www.example.com,corp"}, req: RouteRequest{Host: "WWW.example.com."}, want: "corp"},
+		{name: "domain other", rules: []string{"DOMAIN,www.example.com,corp"}, req: RouteRequest{Host: "example.com"}},
+		{name: "suffix itself", rules: []string{"DOMAIN-SUFFIX,example.com,corp"}, req: RouteRequest{Host: "example.com"}, want: "corp"},
+		{name: "suffix sub domain", rules: []string{"DOMAIN-SUFFIX,example.com,corp"}, req: RouteRequest{Host: "a.b.example.com"}, want: "corp"},
+		{name: "suffix not a label", rules: []string{"DOMAIN-SUFFIX,example.com,corp"}, req: RouteRequest{Host: "badexample.com"}},
+		{name: "keyword", rules: []string{"DOMAIN-KEYWORD,example,corp"}, req: RouteRequest{Host: "badexample.com"}, want: "corp"},
+		{name: "regex", rules: []string{`DOMAIN-REGEX,^ad[0-9]+\.,REJECT`}, req: RouteRequest{Host: "ad12.example.com"}, want: ROUTE_REJECT},
+		{name: "regex with comma", rules: []string{`DOMAIN-REGEX,^a{1,2}\.,REJECT`}, req: RouteRequest{Host: "aa.example.com"}, want: ROUTE_REJECT},
+		{name: "regex not on ips", rules: []string{`DOMAIN-REGEX,^10\.,REJECT`}, req: RouteRequest{Host: "10.0.0.1"}},
+		{name: "cidr", rules: []string{"IP-CIDR,10.0.0.0/8,DIRECT"}, req: RouteRequest{Host: "10.1.2.3"}, want: ROUTE_DIRECT},
+		{name: "cidr outside", rules: []string{"IP-CIDR,10.0.0.0/8,DIRECT"}, req: RouteRequest{Host: "11.1.2.3"}},
+		{name: "cidr not on domains", rules: []string{"IP-CIDR,10.0.0.0/8,DIRECT"}, req: RouteRequest{Host: "10.example.com"}},
+		{name: "cidr6", rules: []string{"IP-CIDR6,2001:db8::/32,corp"}, req: RouteRequest{Host: "2001:db8::1"}, want: "corp"},
+		{name: "port", rules: []string{"DST-PORT,443,corp"}, req: RouteRequest{Port: 443}, want: "corp"},
+		{name: "port range", rules: []string{"DST-PORT,8000-9000,corp"}, req: RouteRequest{Port: 9000}, want: "corp"},
+		{name: "port outside range", rules: []string{"DST-PORT,8000-9000,corp"}, req: RouteRequest{Port: 9001}},
+		{name: "source", rules: []string{"SRC-IP-CIDR,192.168.1.0/24,corp"}, req: RouteRequest{Source: client}, want: "corp"},
+		{name: "udp source", rules: []string{"SRC-IP-CIDR,192.168.1.0/24,corp"}, req: RouteRequest{Source: &net.UDPAddr{IP: client.IP}}, want: "corp"},
+		{name: "other source", rules: []string{"SRC-IP-CIDR,192.168.2.0/24,corp"}, req: RouteRequest{Source: client}},
+		{name: "user", rules: []string{"USER,Alice,corp"}, req: RouteRequest{User: "alice"}, want: "corp"},
+		{name: "anonymous", rules: []string{"USER,alice,corp"}, req: RouteRequest{}},
+		{name: "protocol", rules: []string{"PROTOCOL,socks4,REJECT"}, req: RouteRequest{Protocol: PROTOCOL_SOCKS4}, want: ROUTE_REJECT},
+		{name: "other protocol", rules: []string{"PROTOCOL,socks4,REJECT"}, req: RouteRequest{Protocol: PROTOCOL_HTTP}},
+		{name: "match", rules: []string{"MATCH,DIRECT"}, req: RouteRequest{Host: "example.com"}, want: ROUTE_DIRECT},
+		{
+			name:  "first match",
+			rules: []string{"DOMAIN-SUFFIX,example.com,REJECT", "DOMAIN,www.example.com,corp", "MATCH,DIRECT"},
+			req:   RouteRequest{Host: "www.example.com"},
+			want:  ROUTE_REJECT,
+		},
+		{
+			name:  "falls through",
+			rules: []string{"DOMAIN,www.example.com,corp", "USER,bob,REJECT", "MATCH,DIRECT"},
+			req:   RouteRequest{Host: "example.org", User: "alice"},
+			want:  ROUTE_DIRECT,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewRouter()
+			corp := NewDirectDialer()
+			r.AddUpstream("corp", corp)
+			for _, line := range tt.rules {
+				if err := r.AddRule(line); err != nil {
+					t.Fatal(err)
+				}
+			}
+			route := r.Route(&tt.req)
+			if tt.want == "" {
+				if route != nil {
+					t.Errorf("routed to %s by %s, want no match", route.Name, route.Rule)
+				}
+				return
+			}
+			if route == nil {
+				t.Fatalf("no match, want %s", tt.want)
+			}
+			if route.Name != tt.want {
+				t.Errorf("routed to %s by %s, want %s", route.Name, route.Rule, tt.want)
+			}
+			if (route.Dialer == nil) != (tt.want == ROUTE_REJECT) || (tt.want == "corp" && route.Dialer != corp) {
+				t.Errorf("route %s with dialer %#v", route.Name, route.Dialer)
+			}
+		})
+	}
+}
+
+func TestAddRuleErrors(t *testing.T) {
+	for _, line := range []string{
+		"MATCH",
+		"DOMAIN,example.com",
+		"DOMAIN,example.com,nowhere",
+		"UNKNOWN,example.com,DIRECT",
+		"DOMAIN-REGEX,(,DIRECT",
+		"IP-CIDR,10.0.0.0,DIRECT",
+		"SRC-IP-CIDR,10.0.0.0/33,DIRECT",
+		"DST-PORT,http,DIRECT",
+		"DST-PORT,9000-8000,DIRECT",
+		"DST-PORT,65536,DIRECT",
+		"PROTOCOL,socks6,DIRECT",
+	} {
+		if err := NewRouter().AddRule(line); err == nil {
+			t.Errorf("%q: no error", line)
+		}
+	}
+}
+
+func TestParsePortRange(t *testing.T) {
+	tests := []struct {
+		value     string
+		low, high uint16
+		err       bool
+	}{
+		{value: "443", low: 443, high: 443},
+		{value: "8000-9000", low: 8000, high: 9000},
+		{value: " 8000 - 9000 ", low: 8000, high: 9000},
+		{value: "0-65535", low: 0, high: 65535},
+		{value: "", err: true},
+		{value: "8000-", err: true},
+		{value: "-9000", err: true},
+		{value: "9000-8000", err: true},
+		{value: "70000", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			low, high, err := parsePortRange(tt.value)
+			if (err != nil) != tt.err {
+				t.Fatalf("error %v, want error %v", err, tt.err)
+			}
+			if low != tt.low || high != tt.high {
+				t.Errorf("got %d-%d, want %d-%d", low, high, tt.low, tt.high)
+			}
+		})
+	}
+}
+
+func TestLoadRules(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "rules.txt")
+	err := os.WriteFile(path, []byte("# corp first\n\nDOMAIN-SUFFIX,corp.example,corp\n  USER,eve,REJECT  \nMATCH,DIRECT\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewRouter()
+	r.AddUpstream("corp", NewDirectDialer())
+	err = r.LoadRules(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.rules) != 3 {
+		t.Fatalf("%d rules loaded, want 3", len(r.rules))
+	}
+	if route := r.Route(&RouteRequest{User: "eve"}); route == nil || route.Rule != "USER,eve,REJECT" {
+		t.Errorf("route %+v, want the USER rule", route)
+	}
+
+	bad := filepath.Join(dir, "bad.txt")
+	err = os.WriteFile(bad, []byte("MATCH,DIRECT\n# comment\nDOMAIN,example.com,nowhere\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = NewRouter().LoadRules(bad)
+	if err == nil || !strings.Contains(err.Error(), bad+":3 ") {
+		t.Errorf("error %v, want the line of the bad rule", err)
+	}
+	if err := NewRouter().LoadRules(filepath.Join(dir, "missing.txt")); err == nil {
+		t.Error("missing file: no error")
+	}
+}
+
+// failDialer refuse every connection, an upstream whose use is visible
+type failDialer struct{}
+
+func (failDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return nil, &net.OpError{Op: "dial", Net: network, Err: os.ErrPermission}
+}
+
+// TestRouterConnect check the server dials through the route of the
+// first matching rule
+func TestRouterConnect(t *testing.T) {
+	echo := newEchoServer(t)
+	s := newTestServer(t)
+	r := NewRouter()
+	r.AddUpstream("broken", failDialer{})
+	r.AddUpstream("loopback", NewDirectDialer())
+	for _, line := range []string{
+		"DOMAIN,blocked.test,REJECT",
+		"DST-PORT," + strconv.Itoa(echo.Port) + ",loopback",
+		"IP-CIDR,127.0.0.0/8,DIRECT",
+		"MATCH,broken",
+	} {
+		if err := r.AddRule(line); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.SetRouter(r)
+	addr := s.ln.Addr().String()
+	blockedAddr, err := socks.NewAddr("blocked.test", 80)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocked, _ := (&socks.Request{Command: CMD_CONNECT, Addr: blockedAddr}).Append(nil)
+	tests := []struct {
+		name    string
+		request []byte
+		want    []byte
+	}{
+		{name: "named upstream", request: append([]byte{5, 1, 0}, socks5Request(CMD_CONNECT, echo)...), want: []byte{5, 0, 5, 0}},
+		{
+			// DIRECT refuses the private addresses like the default dialer
+			name:    "direct loopback",
+			request: append([]byte{5, 1, 0}, socks5Request(CMD_CONNECT, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1})...),
+			want:    []byte{5, 0, 5, 2},
+		},
+		{name: "reject", request: append([]byte{5, 1, 0}, blocked...), want: []byte{5, 0, 5, 2}},
+		{
+			name:    "upstream",
+			request: append([]byte{5, 1, 0}, socks5Request(CMD_CONNECT, &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1})...),
+			want:    []byte{5, 0, 5, 1},
+		},
+		{name: "http reject", request: []byte("CONNECT blocked.test:80 HTTP/1.1\r\n\r\n"), want: []byte("HTTP/1.1 403 Forbidden\r\n")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxyExchange(t, addr, tt.request, tt.want)
+		})
+	}
+}
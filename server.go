@@ -3,47 +3,351 @@ package proxy
 import (
 	"context"
 	"github.com/sirupsen/logrus"
+	"mixed-socks/socks"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
-	CMD_CONNECT      = 0x01
-	CMD_BIND         = 0x02
-	CMD_UDP          = 0x03
-	ATYPE_IPV4       = 0x01
-	ATYPE_DOMAINNAME = 0x03
-	ATYPE_IPV6       = 0x04
+	CMD_CONNECT      = socks.CMD_CONNECT
+	CMD_BIND         = socks.CMD_BIND
+	CMD_UDP          = socks.CMD_UDP
+	ATYPE_IPV4       = socks.ATYPE_IPV4
+	ATYPE_DOMAINNAME = socks.ATYPE_DOMAINNAME
+	ATYPE_IPV6       = socks.ATYPE_IPV6
+
+	METHOD_NO_AUTH       = 0x00
+	METHOD_USER_PASS     = 0x02
+	METHOD_NO_ACCEPTABLE = 0xFF
+
+	COMMAND_CONNECT = "connect"
+	COMMAND_BIND    = "bind"
+	COMMAND_UDP     = "udp"
+
+	DEFAULT_SHUTDOWN_GRACE = 10 * time.Second
 )
 
 type SocksServer struct {
-	sockIp  string
-	port    int
-	udpIp   string // udp associate ip
-	udpPort int    // udp associate address
+	sockIp    string
+	port      int
+	ln        net.Listener
+	udpServer *UdpServer
+	registry  *Registry
+	accessLog *AccessLog
+	shaper    *Shaper
+	quotas    *Quotas
+	limits    *ConnLimits
+	settings  atomic.Pointer[serverSettings]
+	mu        sync.Mutex // serialize settings updates
+
+	sessions sessionSet
+}
+
+// serverSettings is the reloadable part of a SocksServer, it is replaced
+// as a whole and every session keeps the one it was accepted with
+type serverSettings struct {
+	name          string // listener name, keys its bandwidth limit
+	udpIp         string // udp associate ip announced to clients, empty for the address they reached
+	authenticator Authenticator
+	dialer        Dialer
+	outbound      string   // name of dialer, for logs and metrics
+	resolver      Resolver // of the BIND peers, nil for the system resolver
+	router        *Router
+	protocols     map[string]bool // nil for every protocol
+	access        *AccessList     // clients served, nil for everyone
+
+	handshakeTimeout time.Duration
+	dialTimeout      time.Duration
+	idleTimeout      time.Duration // relays with no traffic for this long are closed, 0 for never
+	shutdownGrace    time.Duration
 }
 
 func NewSocksServer(host string, port int) *SocksServer {
-	socksServer := SocksServer{
-		sockIp:  host,
-		port:    port,
-		udpIp:   host,
-		udpPort: port,
-	}
-	return &socksServer
-}
-
-// ListenAndServe socks4 socks5 server
-func (s *SocksServer) ListenAndServe(ctx context.Context) {
-	go func() {
-		udpServer := NewUdpServer()
-		err := udpServer.Listen()
-		if err != nil {
-			logrus.Fatalln(err)
+	socksServer := &SocksServer{
+		sockIp:   host,
+		port:     port,
+		registry: NewRegistry(),
+	}
+	socksServer.settings.Store(&serverSettings{
+		dialer:           newGuardedDialer(net.JoinHostPort(host, strconv.Itoa(port))),
+		outbound:         ROUTE_DIRECT,
+		handshakeTimeout: DEFAULT_HANDSHAKE_TIMEOUT,
+		dialTimeout:      DEFAULT_DIAL_TIMEOUT,
+		shutdownGrace:    DEFAULT_SHUTDOWN_GRACE,
+	})
+	socksServer.udpServer = NewUdpServer(socksServer.dial)
+	socksServer.udpServer.allow = socksServer.allowClient
+	return socksServer
+}
+
+// newGuardedDialer connect the targets directly except the private
+// addresses and the proxy at selfAddr
+func newGuardedDialer(selfAddr string) Dialer {
+	cfg := DestinationConfig{BlockPrivate: true}
+	policy, err := NewDestinationPolicy(cfg, selfAddr)
+	if err != nil {
+		// a listen host not resolving, the private ranges are still refused
+		policy, _ = NewDestinationPolicy(cfg)
+	}
+	direct := &DirectDialer{}
+	direct.Dialer.Control = policy.Control
+	return direct
+}
+
+// update apply fn to a copy of the settings and swap it in, clients
+// accepted from now on use the new settings
+func (s *SocksServer) update(fn func(st *serverSettings)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := *s.settings.Load()
+	fn(&st)
+	s.settings.Store(&st)
+}
+
+// SetRegistry list the relays and udp associations of the server in
+// registry, so several servers can share one. Unlike the settings it is
+// read without lock by the sessions, call it before Listen
+func (s *SocksServer) SetRegistry(registry *Registry) {
+	s.registry = registry
+}
+
+// SetAccessLog write one record per client session to accessLog, call it
+// before Listen
+func (s *SocksServer) SetAccessLog(accessLog *AccessLog) {
+	s.accessLog = accessLog
+}
+
+// SetShaper hold the outbound connections to the bandwidth limits of
+// shaper, call it before Listen
+func (s *SocksServer) SetShaper(shaper *Shaper) {
+	s.shaper = shaper
+}
+
+// SetQuotas account the traffic of the users in quotas and refuse the
+// requests of the ones over their quota, call it before Listen
+func (s *SocksServer) SetQuotas(quotas *Quotas) {
+	s.quotas = quotas
+}
+
+// SetConnLimits bound the concurrent clients of the server with limits,
+// so several servers can share one, call it before Listen
+func (s *SocksServer) SetConnLimits(limits *ConnLimits) {
+	s.limits = limits
+}
+
+// Registry return the live connections of the server
+func (s *SocksServer) Registry() *Registry {
+	return s.registry
+}
+
+// reload swap in the settings built from a new config
+func (s *SocksServer) reload(st *serverSettings) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.settings.Store(st)
+}
+
+// SetAuthenticator require every client to authenticate, socks5 clients with
+// RFC 1929, http clients with Proxy-Authorization Basic and socks4 clients
+// with a user:password USERID
+func (s *SocksServer) SetAuthenticator(authenticator Authenticator) {
+	s.update(func(st *serverSettings) {
+		st.authenticator = authenticator
+	})
+}
+
+// SetDialer route every outbound connection through dialer
+func (s *SocksServer) SetDialer(dialer Dialer) {
+	s.update(func(st *serverSettings) {
+		st.dialer = dialer
+		st.outbound = ROUTE_DEFAULT
+	})
+}
+
+// SetRouter pick the outbound of every connection with the router rules,
+// connections matching no rule use the default dialer
+func (s *SocksServer) SetRouter(router *Router) {
+	s.update(func(st *serverSettings) {
+		st.router = router
+	})
+}
+
+// SetProtocols restrict the listener to some of socks4, socks5 and http,
+// none means every protocol
+func (s *SocksServer) SetProtocols(protocols ...string) {
+	var allowed map[string]bool
+	if len(protocols) > 0 {
+		allowed = make(map[string]bool)
+	}
+	for _, p := range protocols {
+		allowed[p] = true
+	}
+	s.update(func(st *serverSettings) {
+		st.protocols = allowed
+	})
+}
+
+// SetAccessList serve only the clients allowed by access, for tcp
+// connections and udp datagrams
+func (s *SocksServer) SetAccessList(access *AccessList) {
+	s.update(func(st *serverSettings) {
+		st.access = access
+	})
+}
+
+// SetHandshakeTimeout bound the time a client has to send its request
+func (s *SocksServer) SetHandshakeTimeout(timeout time.Duration) {
+	s.update(func(st *serverSettings) {
+		st.handshakeTimeout = timeout
+	})
+}
+
+// SetDialTimeout bound the time to open an outbound connection
+func (s *SocksServer) SetDialTimeout(timeout time.Duration) {
+	s.update(func(st *serverSettings) {
+		st.dialTimeout = timeout
+	})
+}
+
+// SetIdleTimeout close the relays with no traffic in either direction
+// for timeout, 0 keeps them open
+func (s *SocksServer) SetIdleTimeout(timeout time.Duration) {
+	s.update(func(st *serverSettings) {
+		st.idleTimeout = timeout
+	})
+}
+
+// SetShutdownGrace bound the time live sessions have to end once the
+// server is stopped, the remaining ones are closed
+func (s *SocksServer) SetShutdownGrace(grace time.Duration) {
+	s.update(func(st *serverSettings) {
+		st.shutdownGrace = grace
+	})
+}
+
+// SetUDPAdvertiseAddr set the address announced in UDP ASSOCIATE replies,
+// needed when clients reach the proxy through NAT
+func (s *SocksServer) SetUDPAdvertiseAddr(host string) {
+	s.update(func(st *serverSettings) {
+		st.udpIp = host
+	})
+}
+
+// ListenAndServe socks4 socks5 server, see Listen and Serve
+func (s *SocksServer) ListenAndServe(ctx context.Context) error {
+	err := s.Listen(ctx)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ctx)
+}
+
+// Listen bind the tcp listener and the udp relay to the same address
+// and port
+func (s *SocksServer) Listen(ctx context.Context) error {
+	ln, err := s.listenTcpServer(ctx)
+	if err != nil {
+		return err
+	}
+	tcpAddr := ln.Addr().(*net.TCPAddr)
+	err = s.udpServer.Listen(&net.UDPAddr{IP: tcpAddr.IP, Port: tcpAddr.Port, Zone: tcpAddr.Zone})
+	if err != nil {
+		_ = ln.Close()
+		return err
+	}
+	s.ln = ln
+	return nil
+}
+
+// Serve accept clients on the address bound by Listen. When ctx is done
+// the listener is closed and the live sessions are drained before it
+// returns nil
+func (s *SocksServer) Serve(ctx context.Context) error {
+	go s.udpServer.Serve()
+	return s.serveTcp(ctx, s.ln)
+}
+
+// Close stop accepting clients and relaying udp so the address can be
+// bound again, the live tcp sessions go on until they end or the ctx
+// given to Serve is done
+func (s *SocksServer) Close() error {
+	err := s.ln.Close()
+	s.udpServer.Close()
+	return err
+}
+
+// dial open the outbound connection of a request through the
+// route picked by the router, or the default dialer. The connection
+// counts the bytes relayed and the route name is kept in sess
+func (s *SocksServer) dial(sess *session, network, addr string, port uint16) (net.Conn, error) {
+	st := sess.settings
+	dialer, upstream, rule := st.dialer, st.outbound, ""
+	protocol := sess.protocol
+	if network == "udp" {
+		protocol = PROTOCOL_UDP
+	}
+	if err := s.quotas.check(sess.user); err != nil {
+		metricDialErrors.WithLabelValues(protocol, ROUTE_REJECT, dialErrorType(err)).Inc()
+		if network != "udp" {
+			sess.setRoute(net.JoinHostPort(addr, strconv.Itoa(int(port))), ROUTE_REJECT, "")
+			sess.dialErr = err
 		}
-		s.udpIp = udpServer.udpIp
-		s.udpPort = udpServer.udpPort
-	}()
-	err := s.listenTcpServer(ctx)
+		return nil, err
+	}
+	if st.router != nil {
+		route := st.router.Route(&RouteRequest{
+			Protocol: sess.protocol,
+			Source:   sess.conn.RemoteAddr(),
+			User:     sess.user,
+			Host:     addr,
+			Port:     port,
+		})
+		if route == nil {
+			route = &Route{Name: st.outbound, Rule: "none", Dialer: st.dialer}
+		}
+		logrus.Debugln(sess.conn.RemoteAddr().String() + " " + network + " " + net.JoinHostPort(addr, strconv.Itoa(int(port))) +
+			" match rule " + route.Rule + " route " + route.Name)
+		if route.Dialer == nil {
+			metricDialErrors.WithLabelValues(protocol, route.Name, dialErrorType(errRejected)).Inc()
+			if network != "udp" {
+				sess.setRoute(net.JoinHostPort(addr, strconv.Itoa(int(port))), route.Name, route.Rule)
+				sess.dialErr = errRejected
+			}
+			return nil, errRejected
+		}
+		dialer, upstream, rule = route.Dialer, route.Name, route.Rule
+	}
+	target := net.JoinHostPort(addr, strconv.Itoa(int(port)))
+	sess.setRoute(target, upstream, rule)
+	ctx := sess.ctx
+	if st.dialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, st.dialTimeout)
+		defer cancel()
+	}
+	start := time.Now()
+	dest, err := dialer.DialContext(ctx, network, target)
 	if err != nil {
-		logrus.Fatalln(err)
+		metricDialErrors.WithLabelValues(protocol, upstream, dialErrorType(err)).Inc()
+		if network != "udp" {
+			sess.dialErr = err
+		}
+		return nil, err
+	}
+	metricDialDuration.WithLabelValues(protocol, upstream).Observe(time.Since(start).Seconds())
+	if _, direct := dialer.(*DirectDialer); direct && network != "udp" {
+		sess.resolved = addrIP(dest.RemoteAddr()).String()
 	}
+	return s.outboundConn(sess, dest, protocol, upstream), nil
+}
+
+// outboundConn wrap a connection to a target so its bytes are counted
+// and shaped
+func (s *SocksServer) outboundConn(sess *session, dest net.Conn, protocol, upstream string) net.Conn {
+	metered := newMeteredConn(sess, dest, protocol, upstream)
+	metered.quotas = s.quotas
+	return s.shaper.shape(sess, metered)
 }
@@ -0,0 +1,292 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"github.com/sirupsen/logrus"
+	"strings"
+	"sync"
+)
+
+// Service serve every listener of a Config in one process
+type Service struct {
+	mu        sync.Mutex
+	ctx       context.Context // set by Run
+	wg        sync.WaitGroup
+	listeners map[string]*serviceListener // by listener name
+	order     []string
+
+	registry    *Registry // live connections of every listener
+	shaper      *Shaper   // bandwidth limits of every listener
+	quotas      *Quotas   // traffic quotas of every user
+	limits      *ConnLimits
+	accessLog   *AccessLog
+	metricsAddr string
+	admin       AdminConfig
+	reload      func() error  // served as POST /reload, nil for none
+	ready       chan struct{} // closed by Run once every listener is bound
+}
+
+type serviceListener struct {
+	cfg    ListenerConfig
+	server *SocksServer
+}
+
+func NewService(cfg *Config) (*Service, error) {
+	settings, err := cfg.newSettings()
+	if err != nil {
+		return nil, err
+	}
+	service := &Service{
+		listeners:   make(map[string]*serviceListener),
+		registry:    NewRegistry(),
+		shaper:      NewShaper(),
+		limits:      NewConnLimits(cfg.Limits),
+		metricsAddr: cfg.Metrics.Addr,
+		admin:       cfg.Admin,
+		ready:       make(chan struct{}),
+	}
+	service.quotas, err = NewQuotas(cfg.Quotas, service.registry)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.AccessLog.Path != "" {
+		service.accessLog, err = OpenAccessLog(cfg.AccessLog)
+		if err != nil {
+			return nil, err
+		}
+	}
+	service.updateBandwidth(cfg)
+	for i, l := range cfg.Listeners {
+		server, err := service.newListenerServer(&l, settings[i])
+		if err != nil {
+			return nil, err
+		}
+		service.listeners[l.Name] = &serviceListener{cfg: l, server: server}
+		service.order = append(service.order, l.Name)
+	}
+	return service, nil
+}
+
+// newSettings validate cfg and build the settings of every listener
+func (c *Config) newSettings() ([]*serverSettings, error) {
+	err := c.Validate()
+	if err != nil {
+		return nil, err
+	}
+	resolver, err := c.newResolver()
+	if err != nil {
+		return nil, err
+	}
+	upstreams, err := c.newUpstreams(resolver)
+	if err != nil {
+		return nil, err
+	}
+	router, err := c.newRouter(upstreams)
+	if err != nil {
+		return nil, err
+	}
+	settings := make([]*serverSettings, len(c.Listeners))
+	for i := range c.Listeners {
+		settings[i], err = c.Listeners[i].newSettings(upstreams, router, resolver, c.ShutdownGrace)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return settings, nil
+}
+
+func (s *Service) newListenerServer(l *ListenerConfig, settings *serverSettings) (*SocksServer, error) {
+	host, port, err := splitListenAddr(l.Addr)
+	if err != nil {
+		return nil, err
+	}
+	server := NewSocksServer(host, port)
+	server.settings.Store(settings)
+	server.SetRegistry(s.registry)
+	server.SetAccessLog(s.accessLog)
+	server.SetShaper(s.shaper)
+	server.SetQuotas(s.quotas)
+	server.SetConnLimits(s.limits)
+	return server, nil
+}
+
+// updateBandwidth apply the bandwidth limits of a validated config and
+// drop the ones of the listeners it removes, the caller holds mu
+func (s *Service) updateBandwidth(cfg *Config) {
+	_ = s.shaper.Update(cfg.Bandwidth)
+	names := make(map[string]bool)
+	for _, l := range cfg.Listeners {
+		s.shaper.SetListener(l.Name, l.Bandwidth)
+		names[l.Name] = true
+	}
+	for name := range s.listeners {
+		if !names[name] {
+			s.shaper.RemoveListener(name)
+		}
+	}
+}
+
+// Run bind every listener and serve them until ctx is done and their
+// sessions are drained, a listener failing to bind stops the others.
+// The metrics and admin endpoints are served along when configured
+func (s *Service) Run(ctx context.Context) error {
+	if s.metricsAddr != "" {
+		err := serveMetrics(ctx, s.metricsAddr)
+		if err != nil {
+			return err
+		}
+	}
+	if s.admin.Addr != "" {
+		err := serveAdmin(ctx, s.admin.Addr, s.registry, s.shaper, s.quotas, s.reload, s.admin.Token)
+		if err != nil {
+			return err
+		}
+	}
+	s.mu.Lock()
+	s.ctx = ctx
+	for _, name := range s.order {
+		err := s.start(s.listeners[name])
+		if err != nil {
+			s.mu.Unlock()
+			s.stopAll()
+			s.wg.Wait()
+			return err
+		}
+	}
+	s.mu.Unlock()
+	close(s.ready)
+	go s.quotas.saveEvery(ctx)
+	<-ctx.Done()
+	s.wg.Wait()
+	err := s.quotas.Save()
+	if err != nil {
+		logrus.Errorln(err)
+	}
+	if s.accessLog != nil {
+		_ = s.accessLog.Close()
+	}
+	return nil
+}
+
+// start bind a listener and serve it in the background, the caller holds mu
+func (s *Service) start(l *serviceListener) error {
+	err := l.server.Listen(s.ctx)
+	if err != nil {
+		return errors.New("listener " + l.cfg.Name + ":" + err.Error())
+	}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		err := l.server.Serve(s.ctx)
+		if err != nil {
+			logrus.Errorln("listener " + l.cfg.Name + " stopped:" + err.Error())
+		}
+	}()
+	return nil
+}
+
+// Registry return the live connections of every listener
+func (s *Service) Registry() *Registry {
+	return s.registry
+}
+
+// Quotas return the traffic accounting of every user
+func (s *Service) Quotas() *Quotas {
+	return s.quotas
+}
+
+// SetReloader serve POST /reload on the admin api, reload reads the config
+// again and applies it with Reload. Call it before Run
+func (s *Service) SetReloader(reload func() error) {
+	s.reload = reload
+}
+
+// SetBandwidth change the global, per connection, user and cidr bandwidth
+// limits until the next reload, live connections follow the new limits
+func (s *Service) SetBandwidth(cfg BandwidthConfig) error {
+	return s.shaper.Update(cfg)
+}
+
+func (s *Service) stopAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, l := range s.listeners {
+		if l.server.ln != nil {
+			_ = l.server.Close()
+		}
+	}
+}
+
+/**
+  Reload apply a new config. Listeners keeping their name and address get
+  the new settings for the clients accepted from now on, the live sessions
+  keep the settings they were accepted with. Removed listeners stop
+  accepting and their sessions go on until they end, new listeners are
+  bound and served. An invalid config is rejected as a whole, listeners
+  failing to bind are reported and skipped. The bandwidth limits and the
+  quotas apply to the live sessions too, new connection limits to the
+  clients accepted from now on. The metrics, admin, access log
+  and quota file settings are only read at start.
+*/
+
+func (s *Service) Reload(cfg *Config) error {
+	settings, err := cfg.newSettings()
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.updateBandwidth(cfg)
+	s.quotas.Update(cfg.Quotas)
+	s.limits.Update(cfg.Limits)
+
+	keep := make(map[string]bool)
+	for _, l := range cfg.Listeners {
+		if old, ok := s.listeners[l.Name]; ok && old.cfg.Addr == l.Addr {
+			keep[l.Name] = true
+		}
+	}
+	for name, l := range s.listeners {
+		if keep[name] {
+			continue
+		}
+		if l.server.ln != nil {
+			_ = l.server.Close()
+		}
+		delete(s.listeners, name)
+		logrus.Infoln("listener " + name + " removed")
+	}
+
+	var failed []string
+	s.order = nil
+	for i, l := range cfg.Listeners {
+		if keep[l.Name] {
+			old := s.listeners[l.Name]
+			old.cfg = l
+			old.server.reload(settings[i])
+			s.order = append(s.order, l.Name)
+			continue
+		}
+		server, err := s.newListenerServer(&cfg.Listeners[i], settings[i])
+		if err != nil {
+			failed = append(failed, err.Error())
+			continue
+		}
+		nl := &serviceListener{cfg: l, server: server}
+		if s.ctx != nil {
+			err = s.start(nl)
+			if err != nil {
+				failed = append(failed, err.Error())
+				continue
+			}
+		}
+		s.listeners[l.Name] = nl
+		s.order = append(s.order, l.Name)
+		logrus.Infoln("listener " + l.Name + " added")
+	}
+	if len(failed) > 0 {
+		return errors.New(strings.Join(failed, "; "))
+	}
+	return nil
+}
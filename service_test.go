@@ -0,0 +1,219 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// freePort return a port free on the loopback for tcp and udp
+func freePort(t *testing.T) string {
+	t.Helper()
+	for i := 0; i < 10; i++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr := ln.Addr().String()
+		pc, err := net.ListenPacket("udp", addr)
+		_ = ln.Close()
+		if err == nil {
+			_ = pc.Close()
+			return addr
+		}
+	}
+	t.Fatal("no free port")
+	return ""
+}
+
+// udpAssociate open a socks5 UDP ASSOCIATE on addr and return its control
+// connection
+func udpAssociate(t *testing.T, addr string) net.Conn {
+	t.Helper()
+	con, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = con.SetDeadline(time.Now().Add(2 * time.Second))
+	_, err = con.Write([]byte{5, 1, 0, 5, 3, 0, 1, 0, 0, 0, 0, 0, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 12)
+	_, err = io.ReadFull(con, reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply[3] != 0 {
+		t.Fatalf("udp associate reply %x", reply)
+	}
+	_ = con.SetDeadline(time.Time{})
+	return con
+}
+
+func TestServiceReloadSameAddress(t *testing.T) {
+	addr := freePort(t)
+	cfg := func(name string) *Config {
+		return &Config{Listeners: []ListenerConfig{{Name: name, Addr: addr}}}
+	}
+	service, err := NewService(cfg("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		_ = service.Run(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	waitReady(t, service, done)
+
+	for _, name := range []string{"b", "a"} {
+		control := udpAssociate(t, addr)
+		// the listener holding the association is replaced by another
+		// one on the same address
+		err = service.Reload(cfg(name))
+		if err != nil {
+			t.Fatalf("reload to listener %s: %v", name, err)
+		}
+		_ = control.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, err = control.Read(make([]byte, 1))
+		if err != io.EOF {
+			t.Errorf("control connection of the removed listener: %v, want closed", err)
+		}
+		_ = control.Close()
+	}
+	_ = udpAssociate(t, addr).Close()
+}
+
+// runService run a service of cfg until the end of the test
+func runService(t *testing.T, cfg *Config) *Service {
+	t.Helper()
+	service, err := NewService(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		_ = service.Run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	waitReady(t, service, done)
+	return service
+}
+
+// waitReady wait for Run to bind the listeners of service, done is closed
+// when Run returns
+func waitReady(t *testing.T, service *Service, done chan struct{}) {
+	t.Helper()
+	select {
+	case <-service.ready:
+	case <-done:
+		t.Fatal("service stopped before its listeners were bound")
+	case <-time.After(2 * time.Second):
+		t.Fatal("listeners not bound")
+	}
+}
+
+func TestServiceListenerProtocols(t *testing.T) {
+	echo := newEchoServer(t)
+	socks5Addr, httpAddr, mixedAddr := freePort(t), freePort(t), freePort(t)
+	runService(t, &Config{
+		Destinations: DestinationConfig{Allow: []string{"127.0.0.1"}},
+		Listeners: []ListenerConfig{
+			{Name: "socks5", Addr: socks5Addr, Protocols: []string{PROTOCOL_SOCKS5}},
+			{Name: "http", Addr: httpAddr, Protocols: []string{PROTOCOL_HTTP}, Auth: AuthConfig{Users: map[string]string{"bob": "pw"}}},
+			{Name: "mixed", Addr: mixedAddr},
+		},
+	})
+	socks5 := append([]byte{5, 1, 0}, socks5Request(CMD_CONNECT, echo)...)
+	socks4 := []byte{4, 1, byte(echo.Port >> 8), byte(echo.Port), 127, 0, 0, 1, 0}
+	connect := []byte("CONNECT " + echo.String() + " HTTP/1.1\r\n\r\n")
+	tests := []struct {
+		name    string
+		addr    string
+		request []byte
+		want    []byte // nil when the listener closes the connection
+	}{
+		{name: "socks5 on socks5", addr: socks5Addr, request: socks5, want: []byte{5, 0, 5, 0}},
+		{name: "socks4 on socks5", addr: socks5Addr, request: socks4},
+		{name: "http on socks5", addr: socks5Addr, request: connect},
+		{name: "http on http", addr: httpAddr, request: connect, want: []byte("HTTP/1.1 407 ")},
+		{name: "socks5 on http", addr: httpAddr, request: socks5},
+		{name: "socks5 on mixed", addr: mixedAddr, request: socks5, want: []byte{5, 0, 5, 0}},
+		{name: "socks4 on mixed", addr: mixedAddr, request: socks4, want: []byte{0, 0x5A}},
+		{name: "http on mixed", addr: mixedAddr, request: connect, want: []byte("HTTP/1.1 200 ")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			con := proxyExchange(t, tt.addr, tt.request, tt.want)
+			if tt.want == nil {
+				expectClosed(t, con)
+			}
+		})
+	}
+}
+
+func TestServiceReload(t *testing.T) {
+	echo := newEchoServer(t)
+	addrA, addrB := freePort(t), freePort(t)
+	cfg := func(users map[string]string, listeners ...ListenerConfig) *Config {
+		return &Config{
+			Destinations: DestinationConfig{Allow: []string{"127.0.0.1"}},
+			Listeners:    append([]ListenerConfig{{Name: "a", Addr: addrA, Auth: AuthConfig{Users: users}}}, listeners...),
+		}
+	}
+	service := runService(t, cfg(map[string]string{"bob": "pw"}))
+	connect := func(addr, user, pass string, want byte) net.Conn {
+		request := append(append([]byte{5, 1, METHOD_USER_PASS}, userPass(user, pass)...), socks5Request(CMD_CONNECT, echo)...)
+		return proxyExchange(t, addr, request, []byte{5, METHOD_USER_PASS, 1, want})
+	}
+	relay := connect(addrA, "bob", "pw", 0)
+
+	err := service.Reload(cfg(map[string]string{"eve": "pw2"}, ListenerConfig{Name: "b", Addr: addrB}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the relay accepted with the old settings goes on
+	_, err = io.ReadFull(relay, make([]byte, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectEcho(t, relay)
+	expectClosed(t, connect(addrA, "bob", "pw", 1))
+	connect(addrA, "eve", "pw2", 0)
+	proxyExchange(t, addrB, append([]byte{5, 1, METHOD_NO_AUTH}, socks5Request(CMD_CONNECT, echo)...), []byte{5, METHOD_NO_AUTH, 5, 0})
+	if service.shaper.listeners["b"] == nil {
+		t.Error("no bandwidth limiter for the added listener")
+	}
+
+	err = service.Reload(&Config{})
+	if err == nil {
+		t.Fatal("config without listener: no error")
+	}
+	connect(addrA, "eve", "pw2", 0)
+
+	err = service.Reload(cfg(map[string]string{"eve": "pw2"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if con, err := net.Dial("tcp", addrB); err == nil {
+		_ = con.Close()
+		t.Error("removed listener still accepting")
+	}
+	if service.shaper.listeners["b"] != nil {
+		t.Error("bandwidth limiter of the removed listener kept")
+	}
+	expectEcho(t, relay)
+}
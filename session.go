@@ -0,0 +1,168 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var lastSessionID atomic.Uint64
+
+// session is the state of one client connection shared by the protocol handlers
+type session struct {
+	id         uint64
+	start      time.Time
+	conn       net.Conn // replaced by wrappers of the handlers as they read
+	client     net.Conn // the accepted connection, for the other goroutines
+	protocol   string
+	command    string          // connect, bind, udp or the method of a forwarded http request
+	user       string          // authenticated principal, empty for anonymous clients
+	settings   *serverSettings // listener settings when the client was accepted
+	handshaked bool            // the client request is read
+	reply      int             // last socks reply code or http status sent, -1 for none
+	resolved   string          // ip of the target of a direct tcp connection
+	dialErr    error           // failure of the tcp outbound connection
+	limitErr   error           // connection limit hit when the client was accepted
+	connSlot   string          // client ip counted in the connection limits
+	userSlot   string          // user counted in the connection limits
+
+	bytesUp    atomic.Int64 // client to target
+	bytesDown  atomic.Int64 // target to client
+	lastActive atomic.Int64 // unix nanoseconds of the last byte relayed
+
+	ctx      context.Context // done once the session is closed
+	cancel   context.CancelFunc
+	mu       sync.Mutex
+	target   string      // host:port of the last outbound connection
+	upstream string      // route of the last outbound connection
+	rule     string      // router rule choosing upstream, empty without router
+	closers  []io.Closer // outbound connections and listeners opened for the client
+	closed   bool
+}
+
+func newSession(con net.Conn, settings *serverSettings) *session {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &session{
+		id:       lastSessionID.Add(1),
+		start:    time.Now(),
+		conn:     con,
+		client:   con,
+		settings: settings,
+		reply:    -1,
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+}
+
+// setRoute record the target, the route and the rule choosing it of an
+// outbound connection
+func (sess *session) setRoute(target, upstream, rule string) {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	sess.target, sess.upstream, sess.rule = target, upstream, rule
+}
+
+func (sess *session) route() (string, string, string) {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	return sess.target, sess.upstream, sess.rule
+}
+
+// addCloser close c along with the session, at once when the session is
+// already closed
+func (sess *session) addCloser(c io.Closer) {
+	sess.mu.Lock()
+	closed := sess.closed
+	if !closed {
+		sess.closers = append(sess.closers, c)
+	}
+	sess.mu.Unlock()
+	if closed {
+		_ = c.Close()
+	}
+}
+
+// Close the client connection and everything opened for it
+func (sess *session) Close() error {
+	sess.mu.Lock()
+	closers := sess.closers
+	sess.closers = nil
+	sess.closed = true
+	sess.mu.Unlock()
+	sess.cancel()
+	for _, c := range closers {
+		_ = c.Close()
+	}
+	return sess.client.Close()
+}
+
+// sessionSet track the live sessions of a listener so they can be
+// drained on shutdown
+type sessionSet struct {
+	mu       sync.Mutex
+	sessions map[*session]struct{}
+	empty    chan struct{} // closed once the last session is removed
+}
+
+func (ss *sessionSet) add(sess *session) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if ss.sessions == nil {
+		ss.sessions = make(map[*session]struct{})
+	}
+	if len(ss.sessions) == 0 {
+		ss.empty = make(chan struct{})
+	}
+	ss.sessions[sess] = struct{}{}
+}
+
+func (ss *sessionSet) remove(sess *session) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if _, ok := ss.sessions[sess]; ok {
+		delete(ss.sessions, sess)
+		if len(ss.sessions) == 0 {
+			close(ss.empty)
+		}
+	}
+}
+
+func (ss *sessionSet) len() int {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return len(ss.sessions)
+}
+
+// closeAll force close every live session
+func (ss *sessionSet) closeAll() {
+	ss.mu.Lock()
+	sessions := make([]*session, 0, len(ss.sessions))
+	for sess := range ss.sessions {
+		sessions = append(sessions, sess)
+	}
+	ss.mu.Unlock()
+	for _, sess := range sessions {
+		_ = sess.Close()
+	}
+}
+
+// wait return true once every session is gone, false when ctx is done
+// first
+func (ss *sessionSet) wait(ctx context.Context) bool {
+	ss.mu.Lock()
+	if len(ss.sessions) == 0 {
+		ss.mu.Unlock()
+		return true
+	}
+	empty := ss.empty
+	ss.mu.Unlock()
+	select {
+	case <-empty:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
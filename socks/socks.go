@@ -0,0 +1,240 @@
+// Package socks parse and encode the messages of the socks4, socks4a and
+// socks5 protocols: the client requests, the server replies and the
+// headers of socks5 udp datagrams. Malformed messages are refused with an
+// *Error telling the socks5 reply code answering them
+package socks
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"unicode/utf8"
+)
+
+const (
+	VERSION4 = 0x04
+	VERSION5 = 0x05
+
+	CMD_CONNECT = 0x01
+	CMD_BIND    = 0x02
+	CMD_UDP     = 0x03 // socks5 only
+
+	ATYPE_IPV4       = 0x01
+	ATYPE_DOMAINNAME = 0x03
+	ATYPE_IPV6       = 0x04
+
+	REPLY_SUCCEEDED             = 0x00
+	REPLY_GENERAL_FAILURE       = 0x01
+	REPLY_NOT_ALLOWED           = 0x02
+	REPLY_NETWORK_UNREACHABLE   = 0x03
+	REPLY_HOST_UNREACHABLE      = 0x04
+	REPLY_CONNECTION_REFUSED    = 0x05
+	REPLY_TTL_EXPIRED           = 0x06
+	REPLY_COMMAND_NOT_SUPPORTED = 0x07
+	REPLY_ADDRESS_NOT_SUPPORTED = 0x08
+
+	REPLY4_GRANTED    = 0x5A
+	REPLY4_REJECTED   = 0x5B
+	REPLY4_NO_IDENTD  = 0x5C
+	REPLY4_BAD_USERID = 0x5D
+
+	MAX_DOMAIN_LENGTH = 255
+	MAX_USERID_LENGTH = 255
+)
+
+// Error is a message refused by the parser or the encoder, Reply is the
+// socks5 reply code answering it, socks4 answers every one with
+// REPLY4_REJECTED
+type Error struct {
+	Reply byte
+	msg   string
+}
+
+func (e *Error) Error() string {
+	return "socks: " + e.msg
+}
+
+var (
+	ErrVersion     = &Error{Reply: REPLY_GENERAL_FAILURE, msg: "bad version"}
+	ErrReserved    = &Error{Reply: REPLY_GENERAL_FAILURE, msg: "reserved field is not zero"}
+	ErrCommand     = &Error{Reply: REPLY_COMMAND_NOT_SUPPORTED, msg: "command not supported"}
+	ErrAddressType = &Error{Reply: REPLY_ADDRESS_NOT_SUPPORTED, msg: "address type not supported"}
+	ErrAddress     = &Error{Reply: REPLY_HOST_UNREACHABLE, msg: "bad address"}
+	ErrTooLong     = &Error{Reply: REPLY_GENERAL_FAILURE, msg: "field too long"}
+	ErrShort       = &Error{Reply: REPLY_GENERAL_FAILURE, msg: "message too short"}
+)
+
+// ReplyCode is the socks5 reply code answering err, REPLY_GENERAL_FAILURE
+// when err is no *Error
+func ReplyCode(err error) byte {
+	var socksErr *Error
+	if errors.As(err, &socksErr) {
+		return socksErr.Reply
+	}
+	return REPLY_GENERAL_FAILURE
+}
+
+// Addr is the ATYP, ADDR and PORT fields of socks5 messages
+type Addr struct {
+	Type byte   // ATYPE_IPV4, ATYPE_DOMAINNAME or ATYPE_IPV6
+	IP   net.IP // the ip of the ipv4 and ipv6 types
+	Name string // the name of the domain type
+	Port uint16
+}
+
+// NewAddr build the address of host:port, host being an ip or a domain
+func NewAddr(host string, port uint16) (Addr, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			return Addr{Type: ATYPE_IPV4, IP: ip4, Port: port}, nil
+		}
+		return Addr{Type: ATYPE_IPV6, IP: ip.To16(), Port: port}, nil
+	}
+	if err := checkDomain(host); err != nil {
+		return Addr{}, err
+	}
+	return Addr{Type: ATYPE_DOMAINNAME, Name: host, Port: port}, nil
+}
+
+// AddrFromNet build the address of a *net.TCPAddr or *net.UDPAddr, any
+// other addr is 0.0.0.0:0
+func AddrFromNet(addr net.Addr) Addr {
+	ip, port := net.IPv4zero, 0
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return Addr{Type: ATYPE_IPV4, IP: ip4, Port: uint16(port)}
+	}
+	if len(ip) != net.IPv6len {
+		return Addr{Type: ATYPE_IPV4, IP: net.IPv4zero.To4(), Port: uint16(port)}
+	}
+	return Addr{Type: ATYPE_IPV6, IP: ip, Port: uint16(port)}
+}
+
+// Host is the ip or the domain name of a
+func (a Addr) Host() string {
+	if a.Type == ATYPE_DOMAINNAME {
+		return a.Name
+	}
+	return a.IP.String()
+}
+
+// String is host:port, ipv6 addresses in brackets
+func (a Addr) String() string {
+	return net.JoinHostPort(a.Host(), strconv.Itoa(int(a.Port)))
+}
+
+// Append append ATYP, ADDR and PORT to b
+func (a Addr) Append(b []byte) ([]byte, error) {
+	switch a.Type {
+	case ATYPE_IPV4:
+		ip4 := a.IP.To4()
+		if ip4 == nil {
+			return nil, ErrAddress
+		}
+		b = append(b, ATYPE_IPV4)
+		b = append(b, ip4...)
+	case ATYPE_IPV6:
+		if len(a.IP) != net.IPv6len {
+			return nil, ErrAddress
+		}
+		b = append(b, ATYPE_IPV6)
+		b = append(b, a.IP...)
+	case ATYPE_DOMAINNAME:
+		if err := checkDomain(a.Name); err != nil {
+			return nil, err
+		}
+		b = append(b, ATYPE_DOMAINNAME, byte(len(a.Name)))
+		b = append(b, a.Name...)
+	default:
+		return nil, ErrAddressType
+	}
+	return binary.BigEndian.AppendUint16(b, a.Port), nil
+}
+
+// ReadAddr read ATYP, ADDR and PORT from r, read errors are returned as is
+func ReadAddr(r io.Reader) (Addr, error) {
+	var buf [MAX_DOMAIN_LENGTH]byte
+	_, err := io.ReadFull(r, buf[:1])
+	if err != nil {
+		return Addr{}, err
+	}
+	a := Addr{Type: buf[0]}
+	switch a.Type {
+	case ATYPE_IPV4:
+		_, err = io.ReadFull(r, buf[:net.IPv4len])
+		a.IP = net.IP(append([]byte{}, buf[:net.IPv4len]...))
+	case ATYPE_IPV6:
+		_, err = io.ReadFull(r, buf[:net.IPv6len])
+		a.IP = net.IP(append([]byte{}, buf[:net.IPv6len]...))
+	case ATYPE_DOMAINNAME:
+		_, err = io.ReadFull(r, buf[:1])
+		if err == nil {
+			n := int(buf[0])
+			_, err = io.ReadFull(r, buf[:n])
+			a.Name = string(buf[:n])
+		}
+	default:
+		return Addr{}, ErrAddressType
+	}
+	if err != nil {
+		return Addr{}, err
+	}
+	_, err = io.ReadFull(r, buf[:2])
+	if err != nil {
+		return Addr{}, err
+	}
+	a.Port = binary.BigEndian.Uint16(buf[:2])
+	if a.Type == ATYPE_DOMAINNAME {
+		if err := checkDomain(a.Name); err != nil {
+			return Addr{}, err
+		}
+	}
+	return a, nil
+}
+
+// ParseAddr parse ATYP, ADDR and PORT at the start of b, returning the
+// number of bytes they take
+func ParseAddr(b []byte) (Addr, int, error) {
+	r := bytes.NewReader(b)
+	a, err := ReadAddr(r)
+	if err != nil {
+		return Addr{}, 0, shortError(err)
+	}
+	return a, len(b) - r.Len(), nil
+}
+
+// checkDomain refuse empty and overlong names and names holding control
+// characters, spaces or invalid utf-8
+func checkDomain(name string) error {
+	if len(name) == 0 {
+		return ErrAddress
+	}
+	if len(name) > MAX_DOMAIN_LENGTH {
+		return ErrTooLong
+	}
+	if !utf8.ValidString(name) {
+		return ErrAddress
+	}
+	for i := 0; i < len(name); i++ {
+		if c := name[i]; c <= ' ' || c == 0x7F {
+			return ErrAddress
+		}
+	}
+	return nil
+}
+
+// shortError turn the end of a buffer into ErrShort
+func shortError(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return ErrShort
+	}
+	return err
+}
@@ -0,0 +1,184 @@
+package socks
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+/**
+
+  The socks4 request is formed as follows:
+
+  		+----+----+----+----+----+----+----+----+----+----+....+----+
+  		| VN | CD | DSTPORT |      DSTIP        | USERID       |NULL|
+  		+----+----+----+----+----+----+----+----+----+----+....+----+
+  # of bytes:	   1    1      2              4           variable       1
+
+  socks4a clients unable to resolve the target send the DSTIP 0.0.0.x,
+  with x nonzero, and the domain name terminated by another NULL after the
+  USERID. The reply is:
+
+  		+----+----+----+----+----+----+----+----+
+  		| VN | CD | DSTPORT |      DSTIP        |
+  		+----+----+----+----+----+----+----+----+
+  # of bytes:	   1    1      2              4
+*/
+
+// Request4 is a socks4 or socks4a request
+type Request4 struct {
+	Command byte   // CMD_CONNECT or CMD_BIND
+	Port    uint16 // DSTPORT
+	IP      net.IP // DSTIP, 0.0.0.x with x nonzero for socks4a
+	UserID  string
+	Domain  string // socks4a target name
+}
+
+// IsSocks4a tell if ip is the DSTIP of a socks4a request
+func IsSocks4a(ip net.IP) bool {
+	ip4 := ip.To4()
+	return ip4 != nil && ip4[0] == 0 && ip4[1] == 0 && ip4[2] == 0 && ip4[3] != 0
+}
+
+// ReadRequest4 read a socks4 request from r, VN included. It is read one
+// byte at a time past DSTIP so nothing after the request is consumed. An
+// unknown command is reported with ErrCommand once the whole request is
+// read, the request being returned too
+func ReadRequest4(r io.Reader) (*Request4, error) {
+	var buf [8]byte
+	_, err := io.ReadFull(r, buf[:])
+	if err != nil {
+		return nil, err
+	}
+	if buf[0] != VERSION4 {
+		return nil, ErrVersion
+	}
+	req := &Request4{
+		Command: buf[1],
+		Port:    binary.BigEndian.Uint16(buf[2:4]),
+		IP:      net.IP(append([]byte{}, buf[4:8]...)),
+	}
+	userid, err := readString(r, MAX_USERID_LENGTH)
+	if err != nil {
+		return nil, err
+	}
+	req.UserID = userid
+	if IsSocks4a(req.IP) {
+		req.Domain, err = readString(r, MAX_DOMAIN_LENGTH)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkDomain(req.Domain); err != nil {
+			return nil, err
+		}
+	}
+	if req.Command != CMD_CONNECT && req.Command != CMD_BIND {
+		return req, ErrCommand
+	}
+	return req, nil
+}
+
+// Host is the domain of a socks4a request, or its ip
+func (req *Request4) Host() string {
+	if req.Domain != "" {
+		return req.Domain
+	}
+	return req.IP.String()
+}
+
+// String is host:port
+func (req *Request4) String() string {
+	return net.JoinHostPort(req.Host(), strconv.Itoa(int(req.Port)))
+}
+
+// Append append the encoded request to b, a request with a Domain and no
+// IP is sent as socks4a with the DSTIP 0.0.0.1
+func (req *Request4) Append(b []byte) ([]byte, error) {
+	if req.Command != CMD_CONNECT && req.Command != CMD_BIND {
+		return nil, ErrCommand
+	}
+	if len(req.UserID) > MAX_USERID_LENGTH {
+		return nil, ErrTooLong
+	}
+	if strings.IndexByte(req.UserID, 0) >= 0 {
+		return nil, ErrAddress
+	}
+	ip := req.IP
+	if ip == nil && req.Domain != "" {
+		ip = net.IPv4(0, 0, 0, 1)
+	}
+	ip4 := ip.To4()
+	if ip4 == nil || IsSocks4a(ip4) != (req.Domain != "") {
+		return nil, ErrAddress
+	}
+	b = append(b, VERSION4, req.Command)
+	b = binary.BigEndian.AppendUint16(b, req.Port)
+	b = append(b, ip4...)
+	b = append(append(b, req.UserID...), 0x00)
+	if req.Domain != "" {
+		if err := checkDomain(req.Domain); err != nil {
+			return nil, err
+		}
+		b = append(append(b, req.Domain...), 0x00)
+	}
+	return b, nil
+}
+
+// Reply4 is a socks4 reply
+type Reply4 struct {
+	Code byte   // REPLY4_*
+	Port uint16 // DSTPORT
+	IP   net.IP // DSTIP
+}
+
+// ReadReply4 read a socks4 reply from r
+func ReadReply4(r io.Reader) (*Reply4, error) {
+	var buf [8]byte
+	_, err := io.ReadFull(r, buf[:])
+	if err != nil {
+		return nil, err
+	}
+	if buf[0] != 0x00 {
+		return nil, ErrVersion
+	}
+	return &Reply4{
+		Code: buf[1],
+		Port: binary.BigEndian.Uint16(buf[2:4]),
+		IP:   net.IP(append([]byte{}, buf[4:8]...)),
+	}, nil
+}
+
+// Append append the encoded reply to b, a nil IP is sent as 0.0.0.0
+func (rep *Reply4) Append(b []byte) ([]byte, error) {
+	ip4 := net.IPv4zero.To4()
+	if rep.IP != nil {
+		ip4 = rep.IP.To4()
+		if ip4 == nil {
+			return nil, ErrAddress
+		}
+	}
+	b = append(b, 0x00, rep.Code)
+	b = binary.BigEndian.AppendUint16(b, rep.Port)
+	return append(b, ip4...), nil
+}
+
+// readString read a NULL terminated string of at most max bytes
+func readString(r io.Reader, max int) (string, error) {
+	var buf [1]byte
+	var s []byte
+	for {
+		_, err := io.ReadFull(r, buf[:])
+		if err != nil {
+			return "", err
+		}
+		if buf[0] == 0x00 {
+			return string(s), nil
+		}
+		if len(s) == max {
+			return "", ErrTooLong
+		}
+		s = append(s, buf[0])
+	}
+}
@@ -0,0 +1,163 @@
+package socks
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestReadRequest4(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []byte
+		want *Request4
+		addr string
+		err  error
+	}{
+		{
+			name: "connect",
+			in:   append([]byte{4, 1, 0, 80, 10, 0, 0, 1}, "bob\x00"...),
+			want: &Request4{Command: CMD_CONNECT, Port: 80, IP: net.IP{10, 0, 0, 1}, UserID: "bob"},
+			addr: "10.0.0.1:80",
+		},
+		{
+			name: "bind no userid",
+			in:   []byte{4, 2, 0x1F, 0x40, 10, 0, 0, 1, 0},
+			want: &Request4{Command: CMD_BIND, Port: 8000, IP: net.IP{10, 0, 0, 1}},
+			addr: "10.0.0.1:8000",
+		},
+		{
+			name: "socks4a",
+			in:   append([]byte{4, 1, 1, 0xBB, 0, 0, 0, 7}, "bob:pw\x00example.com\x00"...),
+			want: &Request4{Command: CMD_CONNECT, Port: 443, IP: net.IP{0, 0, 0, 7}, UserID: "bob:pw", Domain: "example.com"},
+			addr: "example.com:443",
+		},
+		{
+			name: "0.0.0.0 is not socks4a",
+			in:   []byte{4, 1, 0, 80, 0, 0, 0, 0, 0},
+			want: &Request4{Command: CMD_CONNECT, Port: 80, IP: net.IP{0, 0, 0, 0}},
+			addr: "0.0.0.0:80",
+		},
+		{name: "bad version", in: []byte{5, 1, 0, 80, 10, 0, 0, 1, 0}, err: ErrVersion},
+		{
+			name: "udp command",
+			in:   []byte{4, 3, 0, 80, 10, 0, 0, 1, 0},
+			want: &Request4{Command: CMD_UDP, Port: 80, IP: net.IP{10, 0, 0, 1}},
+			addr: "10.0.0.1:80",
+			err:  ErrCommand,
+		},
+		{name: "userid too long", in: append(append([]byte{4, 1, 0, 80, 10, 0, 0, 1}, bytes.Repeat([]byte{'a'}, 256)...), 0), err: ErrTooLong},
+		{name: "domain too long", in: append(append([]byte{4, 1, 0, 80, 0, 0, 0, 1, 0}, bytes.Repeat([]byte{'a'}, 256)...), 0), err: ErrTooLong},
+		{name: "empty domain", in: []byte{4, 1, 0, 80, 0, 0, 0, 1, 0, 0}, err: ErrAddress},
+		{name: "domain with space", in: append([]byte{4, 1, 0, 80, 0, 0, 0, 1, 0}, "a b\x00"...), err: ErrAddress},
+		{name: "empty", in: nil, err: io.EOF},
+		{name: "short header", in: []byte{4, 1, 0, 80, 10}, err: io.ErrUnexpectedEOF},
+		{name: "unterminated userid", in: append([]byte{4, 1, 0, 80, 10, 0, 0, 1}, "bob"...), err: io.EOF},
+		{name: "unterminated domain", in: append([]byte{4, 1, 0, 80, 0, 0, 0, 1, 0}, "example.com"...), err: io.EOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := ReadRequest4(bytes.NewReader(tt.in))
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("error %v, want %v", err, tt.err)
+			}
+			if !reflect.DeepEqual(req, tt.want) {
+				t.Fatalf("request %+v, want %+v", req, tt.want)
+			}
+			if req == nil {
+				return
+			}
+			if got := req.String(); got != tt.addr {
+				t.Errorf("addr %s, want %s", got, tt.addr)
+			}
+			if err != nil {
+				return
+			}
+			out, err := req.Append(nil)
+			if err != nil {
+				t.Fatalf("append error %v", err)
+			}
+			if !bytes.Equal(out, tt.in) {
+				t.Errorf("encoded %x, want %x", out, tt.in)
+			}
+		})
+	}
+}
+
+func TestRequest4Append(t *testing.T) {
+	tests := []struct {
+		name string
+		req  *Request4
+		want []byte
+		err  error
+	}{
+		{
+			name: "domain without ip",
+			req:  &Request4{Command: CMD_CONNECT, Port: 80, Domain: "example.com"},
+			want: append([]byte{4, 1, 0, 80, 0, 0, 0, 1, 0}, "example.com\x00"...),
+		},
+		{name: "ipv6", req: &Request4{Command: CMD_CONNECT, Port: 80, IP: net.ParseIP("::1")}, err: ErrAddress},
+		{name: "no target", req: &Request4{Command: CMD_CONNECT, Port: 80}, err: ErrAddress},
+		{name: "socks4a ip without domain", req: &Request4{Command: CMD_CONNECT, Port: 80, IP: net.IP{0, 0, 0, 1}}, err: ErrAddress},
+		{name: "userid with nul", req: &Request4{Command: CMD_CONNECT, Port: 80, IP: net.IP{10, 0, 0, 1}, UserID: "a\x00b"}, err: ErrAddress},
+		{name: "udp", req: &Request4{Command: CMD_UDP, Port: 80, IP: net.IP{10, 0, 0, 1}}, err: ErrCommand},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := tt.req.Append(nil)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("error %v, want %v", err, tt.err)
+			}
+			if !bytes.Equal(out, tt.want) {
+				t.Errorf("encoded %x, want %x", out, tt.want)
+			}
+		})
+	}
+}
+
+func TestReply4(t *testing.T) {
+	rep := &Reply4{Code: REPLY4_GRANTED, Port: 1080, IP: net.IP{192, 0, 2, 1}}
+	out, err := rep.Append(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{0, 0x5A, 0x04, 0x38, 192, 0, 2, 1}; !bytes.Equal(out, want) {
+		t.Fatalf("encoded %x, want %x", out, want)
+	}
+	got, err := ReadReply4(bytes.NewReader(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, rep) {
+		t.Errorf("%+v, want %+v", got, rep)
+	}
+	out, _ = (&Reply4{Code: REPLY4_REJECTED}).Append(nil)
+	if want := []byte{0, 0x5B, 0, 0, 0, 0, 0, 0}; !bytes.Equal(out, want) {
+		t.Errorf("encoded %x, want %x", out, want)
+	}
+}
+
+// FuzzReadRequest4 check the parser never panics and that every request
+// it accepts encodes back to the bytes it read
+func FuzzReadRequest4(f *testing.F) {
+	f.Add(append([]byte{4, 1, 0, 80, 10, 0, 0, 1}, "bob\x00"...))
+	f.Add(append([]byte{4, 1, 1, 0xBB, 0, 0, 0, 7}, "bob:pw\x00example.com\x00"...))
+	f.Add([]byte{4, 2, 0, 0, 0, 0, 0, 1, 0, 0})
+	f.Fuzz(func(t *testing.T, in []byte) {
+		r := bytes.NewReader(in)
+		req, err := ReadRequest4(r)
+		if err != nil {
+			return
+		}
+		out, err := req.Append(nil)
+		if err != nil {
+			t.Fatalf("accepted request %+v does not encode: %v", req, err)
+		}
+		if read := in[:len(in)-r.Len()]; !bytes.Equal(out, read) {
+			t.Fatalf("encoded %x, read %x", out, read)
+		}
+	})
+}
@@ -0,0 +1,98 @@
+package socks
+
+import (
+	"io"
+)
+
+/**
+
+  The SOCKS request is formed as follows:
+
+       +----+-----+-------+------+----------+----------+
+       |VER | CMD |  RSV  | ATYP | DST.ADDR | DST.PORT |
+       +----+-----+-------+------+----------+----------+
+       | 1  |  1  | X'00' |  1   | Variable |    2     |
+       +----+-----+-------+------+----------+----------+
+
+  and the reply:
+
+       +----+-----+-------+------+----------+----------+
+       |VER | REP |  RSV  | ATYP | BND.ADDR | BND.PORT |
+       +----+-----+-------+------+----------+----------+
+       | 1  |  1  | X'00' |  1   | Variable |    2     |
+       +----+-----+-------+------+----------+----------+
+*/
+
+// Request is a socks5 request
+type Request struct {
+	Command byte // CMD_CONNECT, CMD_BIND or CMD_UDP
+	Addr    Addr // DST.ADDR and DST.PORT
+}
+
+// ReadRequest read a socks5 request from r, VER included. An unknown
+// command is reported with ErrCommand once the whole request is read, the
+// request being returned too
+func ReadRequest(r io.Reader) (*Request, error) {
+	var buf [3]byte
+	_, err := io.ReadFull(r, buf[:])
+	if err != nil {
+		return nil, err
+	}
+	if buf[0] != VERSION5 {
+		return nil, ErrVersion
+	}
+	if buf[2] != 0x00 {
+		return nil, ErrReserved
+	}
+	addr, err := ReadAddr(r)
+	if err != nil {
+		return nil, err
+	}
+	req := &Request{Command: buf[1], Addr: addr}
+	switch req.Command {
+	case CMD_CONNECT, CMD_BIND, CMD_UDP:
+		return req, nil
+	}
+	return req, ErrCommand
+}
+
+// Append append the encoded request to b
+func (req *Request) Append(b []byte) ([]byte, error) {
+	switch req.Command {
+	case CMD_CONNECT, CMD_BIND, CMD_UDP:
+	default:
+		return nil, ErrCommand
+	}
+	return req.Addr.Append(append(b, VERSION5, req.Command, 0x00))
+}
+
+// Reply is a socks5 reply
+type Reply struct {
+	Code byte // REPLY_*
+	Addr Addr // BND.ADDR and BND.PORT
+}
+
+// ReadReply read a socks5 reply from r
+func ReadReply(r io.Reader) (*Reply, error) {
+	var buf [3]byte
+	_, err := io.ReadFull(r, buf[:])
+	if err != nil {
+		return nil, err
+	}
+	if buf[0] != VERSION5 {
+		return nil, ErrVersion
+	}
+	if buf[2] != 0x00 {
+		return nil, ErrReserved
+	}
+	addr, err := ReadAddr(r)
+	if err != nil {
+		return nil, err
+	}
+	return &Reply{Code: buf[1], Addr: addr}, nil
+}
+
+// Append append the encoded reply to b
+func (rep *Reply) Append(b []byte) ([]byte, error) {
+	return rep.Addr.Append(append(b, VERSION5, rep.Code, 0x00))
+}
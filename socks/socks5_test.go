@@ -0,0 +1,232 @@
+package socks
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestReadRequest(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []byte
+		want *Request
+		addr string
+		err  error
+	}{
+		{
+			name: "connect ipv4",
+			in:   []byte{5, 1, 0, 1, 127, 0, 0, 1, 0x1F, 0x40},
+			want: &Request{Command: CMD_CONNECT, Addr: Addr{Type: ATYPE_IPV4, IP: net.IP{127, 0, 0, 1}, Port: 8000}},
+			addr: "127.0.0.1:8000",
+		},
+		{
+			name: "connect ipv6",
+			in:   append(append([]byte{5, 1, 0, 4}, net.ParseIP("2001:db8::1")...), 0x01, 0xBB),
+			want: &Request{Command: CMD_CONNECT, Addr: Addr{Type: ATYPE_IPV6, IP: net.ParseIP("2001:db8::1"), Port: 443}},
+			addr: "[2001:db8::1]:443",
+		},
+		{
+			name: "udp domain",
+			in:   append(append([]byte{5, 3, 0, 3, 11}, "example.com"...), 0, 53),
+			want: &Request{Command: CMD_UDP, Addr: Addr{Type: ATYPE_DOMAINNAME, Name: "example.com", Port: 53}},
+			addr: "example.com:53",
+		},
+		{
+			name: "bind",
+			in:   []byte{5, 2, 0, 1, 0, 0, 0, 0, 0, 0},
+			want: &Request{Command: CMD_BIND, Addr: Addr{Type: ATYPE_IPV4, IP: net.IP{0, 0, 0, 0}}},
+			addr: "0.0.0.0:0",
+		},
+		{name: "bad version", in: []byte{4, 1, 0, 1, 127, 0, 0, 1, 0, 80}, err: ErrVersion},
+		{name: "bad reserved", in: []byte{5, 1, 1, 1, 127, 0, 0, 1, 0, 80}, err: ErrReserved},
+		{name: "bad address type", in: []byte{5, 1, 0, 2, 127, 0, 0, 1, 0, 80}, err: ErrAddressType},
+		{
+			name: "unknown command",
+			in:   []byte{5, 9, 0, 1, 127, 0, 0, 1, 0, 80},
+			want: &Request{Command: 9, Addr: Addr{Type: ATYPE_IPV4, IP: net.IP{127, 0, 0, 1}, Port: 80}},
+			addr: "127.0.0.1:80",
+			err:  ErrCommand,
+		},
+		{name: "empty domain", in: []byte{5, 1, 0, 3, 0, 0, 80}, err: ErrAddress},
+		{name: "domain with space", in: append(append([]byte{5, 1, 0, 3, 3}, "a b"...), 0, 80), err: ErrAddress},
+		{name: "domain with nul", in: append(append([]byte{5, 1, 0, 3, 3}, "a\x00b"...), 0, 80), err: ErrAddress},
+		{name: "domain not utf8", in: append(append([]byte{5, 1, 0, 3, 2}, 0xC3, 0x28), 0, 80), err: ErrAddress},
+		{name: "empty", in: nil, err: io.EOF},
+		{name: "short header", in: []byte{5, 1}, err: io.ErrUnexpectedEOF},
+		{name: "no address type", in: []byte{5, 1, 0}, err: io.EOF},
+		{name: "short ipv4", in: []byte{5, 1, 0, 1, 127, 0}, err: io.ErrUnexpectedEOF},
+		{name: "short ipv6", in: []byte{5, 1, 0, 4, 0, 0, 0, 0}, err: io.ErrUnexpectedEOF},
+		{name: "short domain", in: []byte{5, 1, 0, 3, 10, 'a'}, err: io.ErrUnexpectedEOF},
+		{name: "no port", in: []byte{5, 1, 0, 1, 127, 0, 0, 1}, err: io.EOF},
+		{name: "short port", in: []byte{5, 1, 0, 1, 127, 0, 0, 1, 0}, err: io.ErrUnexpectedEOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := ReadRequest(bytes.NewReader(tt.in))
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("error %v, want %v", err, tt.err)
+			}
+			if !reflect.DeepEqual(req, tt.want) {
+				t.Fatalf("request %+v, want %+v", req, tt.want)
+			}
+			if req == nil {
+				return
+			}
+			if got := req.Addr.String(); got != tt.addr {
+				t.Errorf("addr %s, want %s", got, tt.addr)
+			}
+			if err != nil {
+				return
+			}
+			out, err := req.Append(nil)
+			if err != nil {
+				t.Fatalf("append error %v", err)
+			}
+			if !bytes.Equal(out, tt.in) {
+				t.Errorf("encoded %x, want %x", out, tt.in)
+			}
+		})
+	}
+}
+
+func TestReadRequestLeavesTrailingBytes(t *testing.T) {
+	r := bytes.NewReader([]byte{5, 1, 0, 1, 127, 0, 0, 1, 0, 80, 'G', 'E', 'T'})
+	_, err := ReadRequest(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Len() != 3 {
+		t.Errorf("%d bytes left, want 3", r.Len())
+	}
+}
+
+func TestNewAddr(t *testing.T) {
+	tests := []struct {
+		host string
+		want Addr
+		err  error
+	}{
+		{host: "10.0.0.1", want: Addr{Type: ATYPE_IPV4, IP: net.IP{10, 0, 0, 1}, Port: 80}},
+		{host: "::1", want: Addr{Type: ATYPE_IPV6, IP: net.ParseIP("::1"), Port: 80}},
+		{host: "::ffff:10.0.0.1", want: Addr{Type: ATYPE_IPV4, IP: net.IP{10, 0, 0, 1}, Port: 80}},
+		{host: "example.com", want: Addr{Type: ATYPE_DOMAINNAME, Name: "example.com", Port: 80}},
+		{host: "", err: ErrAddress},
+		{host: string(bytes.Repeat([]byte{'a'}, 256)), err: ErrTooLong},
+	}
+	for _, tt := range tests {
+		got, err := NewAddr(tt.host, 80)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%q: error %v, want %v", tt.host, err, tt.err)
+			continue
+		}
+		if err == nil && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: %+v, want %+v", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestAddrFromNet(t *testing.T) {
+	tests := []struct {
+		addr net.Addr
+		want []byte
+	}{
+		{addr: nil, want: []byte{1, 0, 0, 0, 0, 0, 0}},
+		{addr: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1080}, want: []byte{1, 192, 0, 2, 1, 0x04, 0x38}},
+		{addr: &net.UDPAddr{IP: net.ParseIP("::1"), Port: 53}, want: []byte{4, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 53}},
+		{addr: &net.TCPAddr{Port: 80}, want: []byte{1, 0, 0, 0, 0, 0, 80}},
+	}
+	for _, tt := range tests {
+		got, err := AddrFromNet(tt.addr).Append(nil)
+		if err != nil {
+			t.Errorf("%v: %v", tt.addr, err)
+			continue
+		}
+		if !bytes.Equal(got, tt.want) {
+			t.Errorf("%v: %x, want %x", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestReply(t *testing.T) {
+	rep := &Reply{Code: REPLY_CONNECTION_REFUSED, Addr: AddrFromNet(&net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 40000})}
+	out, err := rep.Append(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadReply(bytes.NewReader(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, rep) {
+		t.Errorf("%+v, want %+v", got, rep)
+	}
+	_, err = ReadReply(bytes.NewReader([]byte{4, 0, 0, 1, 0, 0, 0, 0, 0, 0}))
+	if !errors.Is(err, ErrVersion) {
+		t.Errorf("error %v, want %v", err, ErrVersion)
+	}
+}
+
+func TestReplyCode(t *testing.T) {
+	tests := []struct {
+		err  error
+		want byte
+	}{
+		{err: ErrCommand, want: REPLY_COMMAND_NOT_SUPPORTED},
+		{err: ErrAddressType, want: REPLY_ADDRESS_NOT_SUPPORTED},
+		{err: ErrAddress, want: REPLY_HOST_UNREACHABLE},
+		{err: ErrVersion, want: REPLY_GENERAL_FAILURE},
+		{err: io.EOF, want: REPLY_GENERAL_FAILURE},
+	}
+	for _, tt := range tests {
+		if got := ReplyCode(tt.err); got != tt.want {
+			t.Errorf("%v: %#x, want %#x", tt.err, got, tt.want)
+		}
+	}
+}
+
+// FuzzReadRequest check the parser never panics and that every request
+// it accepts encodes back to the bytes it read
+func FuzzReadRequest(f *testing.F) {
+	f.Add([]byte{5, 1, 0, 1, 127, 0, 0, 1, 0, 80})
+	f.Add(append(append([]byte{5, 1, 0, 4}, net.ParseIP("::1")...), 0, 80))
+	f.Add(append(append([]byte{5, 3, 0, 3, 11}, "example.com"...), 0, 53))
+	f.Add([]byte{5, 1, 0, 3, 0, 0, 80})
+	f.Add([]byte{5, 1, 0})
+	f.Fuzz(func(t *testing.T, in []byte) {
+		r := bytes.NewReader(in)
+		req, err := ReadRequest(r)
+		if err != nil {
+			return
+		}
+		out, err := req.Append(nil)
+		if err != nil {
+			t.Fatalf("accepted request %+v does not encode: %v", req, err)
+		}
+		if read := in[:len(in)-r.Len()]; !bytes.Equal(out, read) {
+			t.Fatalf("encoded %x, read %x", out, read)
+		}
+	})
+}
+
+func FuzzReadReply(f *testing.F) {
+	f.Add([]byte{5, 0, 0, 1, 127, 0, 0, 1, 0, 80})
+	f.Add([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+	f.Fuzz(func(t *testing.T, in []byte) {
+		r := bytes.NewReader(in)
+		rep, err := ReadReply(r)
+		if err != nil {
+			return
+		}
+		out, err := rep.Append(nil)
+		if err != nil {
+			t.Fatalf("accepted reply %+v does not encode: %v", rep, err)
+		}
+		if read := in[:len(in)-r.Len()]; !bytes.Equal(out, read) {
+			t.Fatalf("encoded %x, read %x", out, read)
+		}
+	})
+}
@@ -0,0 +1,39 @@
+package socks
+
+/**
+
+  Each socks5 udp datagram carries a header:
+
+      +----+------+------+----------+----------+----------+
+      |RSV | FRAG | ATYP | DST.ADDR | DST.PORT |   DATA   |
+      +----+------+------+----------+----------+----------+
+      | 2  |  1   |  1   | Variable |    2     | Variable |
+      +----+------+------+----------+----------+----------+
+*/
+
+// UDPHeader is the header of a socks5 udp datagram
+type UDPHeader struct {
+	Frag byte // fragment number, 0 for a whole datagram
+	Addr Addr // DST.ADDR and DST.PORT
+}
+
+// ParseUDPHeader parse the header at the start of a datagram, returning
+// the number of bytes it takes, DATA follows
+func ParseUDPHeader(b []byte) (*UDPHeader, int, error) {
+	if len(b) < 3 {
+		return nil, 0, ErrShort
+	}
+	if b[0] != 0x00 || b[1] != 0x00 {
+		return nil, 0, ErrReserved
+	}
+	addr, n, err := ParseAddr(b[3:])
+	if err != nil {
+		return nil, 0, err
+	}
+	return &UDPHeader{Frag: b[2], Addr: addr}, 3 + n, nil
+}
+
+// Append append the encoded header to b
+func (h *UDPHeader) Append(b []byte) ([]byte, error) {
+	return h.Addr.Append(append(b, 0x00, 0x00, h.Frag))
+}
@@ -0,0 +1,96 @@
+package socks
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestParseUDPHeader(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []byte
+		want *UDPHeader
+		n    int
+		err  error
+	}{
+		{
+			name: "ipv4",
+			in:   []byte{0, 0, 0, 1, 127, 0, 0, 1, 0x27, 0x0F, 'h', 'i'},
+			want: &UDPHeader{Addr: Addr{Type: ATYPE_IPV4, IP: net.IP{127, 0, 0, 1}, Port: 9999}},
+			n:    10,
+		},
+		{
+			name: "ipv6 fragment",
+			in:   append(append([]byte{0, 0, 2, 4}, net.ParseIP("::1")...), 0, 53),
+			want: &UDPHeader{Frag: 2, Addr: Addr{Type: ATYPE_IPV6, IP: net.ParseIP("::1"), Port: 53}},
+			n:    22,
+		},
+		{
+			name: "domain no data",
+			in:   append([]byte{0, 0, 0, 3, 4}, "a.bc\x00\x35"...),
+			want: &UDPHeader{Addr: Addr{Type: ATYPE_DOMAINNAME, Name: "a.bc", Port: 53}},
+			n:    11,
+		},
+		{name: "empty", in: nil, err: ErrShort},
+		{name: "one byte", in: []byte{0}, err: ErrShort},
+		{name: "no address type", in: []byte{0, 0, 0}, err: ErrShort},
+		{name: "bad reserved", in: []byte{0, 1, 0, 1, 127, 0, 0, 1, 0, 80}, err: ErrReserved},
+		{name: "bad address type", in: []byte{0, 0, 0, 5, 127, 0, 0, 1, 0, 80}, err: ErrAddressType},
+		{name: "short ipv4", in: []byte{0, 0, 0, 1, 127, 0}, err: ErrShort},
+		{name: "short ipv6", in: []byte{0, 0, 0, 4, 0, 0, 0, 0, 0, 0, 0, 0}, err: ErrShort},
+		{name: "short domain", in: []byte{0, 0, 0, 3, 200, 'a', 'b'}, err: ErrShort},
+		{name: "no domain length", in: []byte{0, 0, 0, 3}, err: ErrShort},
+		{name: "short port", in: []byte{0, 0, 0, 1, 127, 0, 0, 1, 0}, err: ErrShort},
+		{name: "empty domain", in: []byte{0, 0, 0, 3, 0, 0, 53}, err: ErrAddress},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, n, err := ParseUDPHeader(tt.in)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("error %v, want %v", err, tt.err)
+			}
+			if !reflect.DeepEqual(h, tt.want) || n != tt.n {
+				t.Fatalf("header %+v %d, want %+v %d", h, n, tt.want, tt.n)
+			}
+			if err != nil {
+				return
+			}
+			out, err := h.Append(nil)
+			if err != nil {
+				t.Fatalf("append error %v", err)
+			}
+			if !bytes.Equal(out, tt.in[:n]) {
+				t.Errorf("encoded %x, want %x", out, tt.in[:n])
+			}
+		})
+	}
+}
+
+// FuzzParseUDPHeader check the parser never panics on datagrams, never
+// claims more bytes than it got and that every header it accepts encodes
+// back to the bytes it parsed
+func FuzzParseUDPHeader(f *testing.F) {
+	f.Add([]byte{0, 0, 0, 1, 127, 0, 0, 1, 0x27, 0x0F, 'h', 'i'})
+	f.Add(append(append([]byte{0, 0, 1, 4}, net.ParseIP("::1")...), 0, 53))
+	f.Add(append([]byte{0, 0, 0, 3, 4}, "a.bc\x00\x35"...))
+	f.Add([]byte{0, 0, 0, 3, 255})
+	f.Fuzz(func(t *testing.T, in []byte) {
+		h, n, err := ParseUDPHeader(in)
+		if err != nil {
+			return
+		}
+		if n > len(in) {
+			t.Fatalf("header of %d bytes in a datagram of %d", n, len(in))
+		}
+		out, err := h.Append(nil)
+		if err != nil {
+			t.Fatalf("accepted header %+v does not encode: %v", h, err)
+		}
+		if !bytes.Equal(out, in[:n]) {
+			t.Fatalf("encoded %x, parsed %x", out, in[:n])
+		}
+	})
+}
@@ -1,77 +1,64 @@
 package proxy
 
 import (
-	"encoding/binary"
+	"bytes"
 	"errors"
-	"fmt"
 	"github.com/sirupsen/logrus"
 	"io"
+	"mixed-socks/socks"
 	"net"
+	"strconv"
+	"strings"
 )
 
-func (s *SocksServer) handleSocks4(con net.Conn) error {
-	buf := make([]byte, 256)
-	n, err := io.ReadFull(con, buf[:1])
-	if n != 1 {
-		return errors.New("read header :err" + err.Error())
-	}
-	cmd := int(buf[0])
-
-	n, err = io.ReadFull(con, buf[:2])
-	port := binary.BigEndian.Uint16(buf[:2])
-
-	n, err = io.ReadFull(con, buf[:4])
-	addr := net.IP(buf[:4]).String()
-
-	/**
-	    IP address 0.0.0.x, with x nonzero,
-	  an inadmissible destination address and
-	  thus should never occur if the client can resolve the domain name.)
-	  Following the NULL byte terminating USERID,
-	  the client must send the destination domain name
-	  and terminate it with another NULL byte.
-	  This is used for both "connect" and "bind" requests.
-	*/
-	var useDomain = false
-	if buf[0] == 0x00 && buf[1] == 0x00 && buf[2] == 0x00 && buf[3] != 0x00 {
-		useDomain = true
-	}
-
-	for {
-		n, err = io.ReadFull(con, buf[:1])
-		if err != nil {
-			return errors.New("read userid error :" + err.Error())
+func (s *SocksServer) handleSocks4(sess *session) error {
+	con := sess.conn
+	// VN was read to tell the protocol
+	req, err := socks.ReadRequest4(io.MultiReader(bytes.NewReader([]byte{socks.VERSION4}), con))
+	if err != nil {
+		var socksErr *socks.Error
+		if errors.As(err, &socksErr) {
+			sess.reply = socks.REPLY4_REJECTED
+			_, _ = con.Write(socks4Reply(socks.REPLY4_REJECTED, nil))
 		}
-		if buf[0] == 0x00 {
-			break
+		if errors.Is(err, socks.ErrCommand) {
+			return errors.New("not support cmd " + strconv.Itoa(int(req.Command)))
 		}
+		return errors.New("read request error:" + err.Error())
 	}
-	if useDomain {
-		var i = 0
-		for {
-			n, err = io.ReadFull(con, buf[i:i+1])
-			if err != nil {
-				return errors.New("read userid error :" + err.Error())
-			}
-			if buf[i] == 0x00 {
-				break
-			}
-			i++
-		}
-		addr = string(buf[:i])
+	cmd, addr, port, userid := req.Command, req.Host(), req.Port, req.UserID
+
+	username, password, _ := strings.Cut(userid, ":")
+	err = s.authenticate(sess, &AuthRequest{UserID: userid, Username: username, Password: password})
+	if err != nil {
+		sess.reply = 0x5D
+		_, _ = con.Write([]byte{0x00, 0x5D, 0x00, 0x00, 0, 0, 0, 0})
+		return authError(errors.New("authentication failed for userid " + username + ":" + err.Error()))
 	}
 
+	s.handshakeDone(sess)
+	err = s.admit(sess)
+	if err != nil {
+		sess.reply = 0x5B
+		_, _ = con.Write(socks4Reply(0x5B, nil))
+		return err
+	}
 	if cmd == CMD_CONNECT {
-		return s.handleSock4ConnectCmd(con, addr, port)
+		sess.command = COMMAND_CONNECT
+		return s.handleSock4ConnectCmd(sess, addr, port)
+	} else if cmd == CMD_BIND {
+		sess.command = COMMAND_BIND
+		return s.handleSock4BindCmd(sess, addr)
 	} else {
+		sess.reply = 0x5B
+		_, _ = con.Write(socks4Reply(0x5B, nil))
 		return errors.New("not support cmd")
 	}
 }
 
-func (s *SocksServer) handleSock4ConnectCmd(con net.Conn, addr string, port uint16) error {
-
-	destAddrPort := fmt.Sprintf("%s:%d", addr, port)
-	dest, err := net.Dial("tcp", destAddrPort)
+func (s *SocksServer) handleSock4ConnectCmd(sess *session, addr string, port uint16) error {
+	con := sess.conn
+	dest, err := s.dial(sess, "tcp", addr, port)
 
 	/**
 	  The SOCKS server uses the client information to decide whether the
@@ -101,6 +88,7 @@ func (s *SocksServer) handleSock4ConnectCmd(con net.Conn, addr string, port uint
 	*/
 
 	if err != nil {
+		sess.reply = 0x5B
 		_, _err := con.Write([]byte{0x00, 0x5B, 0x00, 0x00, 0, 0, 0, 0})
 		if _err != nil {
 			return err
@@ -108,20 +96,93 @@ func (s *SocksServer) handleSock4ConnectCmd(con net.Conn, addr string, port uint
 		return errors.New("connect dist error :" + err.Error())
 	}
 
+	sess.reply = 0x5A
 	_, err = con.Write([]byte{0x00, 0x5A, 0x00, 0x00, 0, 0, 0, 0})
 	if err != nil {
 		return errors.New("write  response error:" + err.Error())
 	}
 
-	forward := func(src net.Conn, dest net.Conn) {
-		defer func(src, dest net.Conn) {
-			_ = dest.Close()
-			_ = src.Close()
-		}(src, dest)
-		_, _ = io.Copy(dest, src)
+	logrus.Debugln(con.RemoteAddr().String() + "<->" + dest.LocalAddr().String() + "-" + dest.RemoteAddr().String() + " connect established!")
+	s.relay(sess, dest)
+	return nil
+}
+
+/**
+  The client connects to the SOCKS server and sends a BIND request when
+  it wants to prepare for an inbound connection from an application server.
+
+  The SOCKS server sends a first reply to the client after it has created
+  a socket and bound it to a local port, DSTPORT and DSTIP carry the
+  address the application server has to connect to. If DSTIP is 0.0.0.0
+  the client should replace it by the IP address of the SOCKS server.
+
+  When the anticipated connection from the application server is
+  established the SOCKS server checks the IP address of the originating
+  host against the value of DSTIP specified in the client's BIND request.
+  Connections from any other host are dropped while the server keeps
+  waiting, when nothing matches before the bind timeout a reply with
+  CD 0x5B is sent, otherwise a second reply with CD 0x5A is sent and
+  the relay starts.
+*/
+
+func (s *SocksServer) handleSock4BindCmd(sess *session, addr string) error {
+	con := sess.conn
+	err := s.quotas.check(sess.user)
+	if err != nil {
+		sess.dialErr = err
+		sess.reply = 0x5B
+		_, _ = con.Write(socks4Reply(0x5B, nil))
+		return err
+	}
+	expect, err := bindPeerIPs(sess.ctx, sess.settings.resolver, addr)
+	if err != nil {
+		sess.reply = 0x5B
+		_, _ = con.Write(socks4Reply(0x5B, nil))
+		return errors.New("resolve bind address error:" + err.Error())
+	}
+	ln, err := listenBind(con, "tcp4")
+	if err != nil {
+		sess.reply = 0x5B
+		_, _ = con.Write(socks4Reply(0x5B, nil))
+		return errors.New("bind listen error:" + err.Error())
+	}
+	sess.addCloser(ln)
+	defer func(ln net.Listener) {
+		_ = ln.Close()
+	}(ln)
+	sess.reply = 0x5A
+	_, err = con.Write(socks4Reply(0x5A, ln.Addr()))
+	if err != nil {
+		return errors.New("write response error:" + err.Error())
+	}
+
+	dest, err := acceptBind(ln, expect)
+	if err != nil {
+		sess.reply = 0x5B
+		_, _ = con.Write(socks4Reply(0x5B, nil))
+		return errors.New("bind accept error:" + err.Error())
+	}
+	sess.reply = 0x5A
+	_, err = con.Write(socks4Reply(0x5A, dest.RemoteAddr()))
+	if err != nil {
+		_ = dest.Close()
+		return errors.New("write response error:" + err.Error())
 	}
-	logrus.Infoln(con.RemoteAddr().String() + "<->" + dest.LocalAddr().String() + "-" + dest.RemoteAddr().String() + " connect established!")
-	go forward(con, dest)
-	go forward(dest, con)
+
+	logrus.Debugln(con.RemoteAddr().String() + "<->" + dest.LocalAddr().String() + "-" + dest.RemoteAddr().String() + " bind established!")
+	sess.setRoute(dest.RemoteAddr().String(), ROUTE_DIRECT, "")
+	s.relay(sess, s.outboundConn(sess, dest, sess.protocol, ROUTE_DIRECT))
 	return nil
 }
+
+// socks4Reply build a reply carrying addr as DSTPORT and DSTIP,
+// a nil or non ipv4 addr is sent as 0.0.0.0:0
+func socks4Reply(cd byte, addr net.Addr) []byte {
+	rep := &socks.Reply4{Code: cd}
+	if a, ok := addr.(*net.TCPAddr); ok {
+		rep.Port = uint16(a.Port)
+		rep.IP = a.IP.To4()
+	}
+	buf, _ := rep.Append(nil)
+	return buf
+}
@@ -1,15 +1,19 @@
 package proxy
 
 import (
-	"encoding/binary"
+	"bytes"
+	"context"
 	"errors"
-	"fmt"
 	"github.com/sirupsen/logrus"
 	"io"
+	"mixed-socks/socks"
 	"net"
+	"strconv"
+	"syscall"
 )
 
-func (s *SocksServer) handleAuth(con net.Conn) error {
+func (s *SocksServer) handleAuth(sess *session) error {
+	con := sess.conn
 	buf := make([]byte, 256)
 	n, err := io.ReadFull(con, buf[:1])
 	if n != 1 {
@@ -21,10 +25,87 @@ func (s *SocksServer) handleAuth(con net.Conn) error {
 		return errors.New("read methods error:" + err.Error())
 	}
 
-	n, err = con.Write([]byte{0x05, 0x00})
+	method := byte(METHOD_NO_AUTH)
+	if sess.settings.authenticator != nil {
+		method = METHOD_USER_PASS
+	}
+	if bytes.IndexByte(buf[:nmethods], method) == -1 {
+		_, _ = con.Write([]byte{0x05, METHOD_NO_ACCEPTABLE})
+		return authError(errors.New("no acceptable auth method"))
+	}
+
+	n, err = con.Write([]byte{0x05, method})
 	if n != 2 || err != nil {
 		return errors.New("write auth response error:" + err.Error())
 	}
+	if method == METHOD_USER_PASS {
+		return s.handleUserPassAuth(sess)
+	}
+	return nil
+}
+
+/**
+  Once the SOCKS V5 server has started, and the client has selected the
+  Username/Password Authentication protocol, the Username/Password
+  subnegotiation begins.  This begins with the client producing a
+  Username/Password request:
+
+          +----+------+----------+------+----------+
+          |VER | ULEN |  UNAME   | PLEN |  PASSWD  |
+          +----+------+----------+------+----------+
+          | 1  |  1   | 1 to 255 |  1   | 1 to 255 |
+          +----+------+----------+------+----------+
+
+  The server verifies the supplied UNAME and PASSWD, and sends the
+  following response:
+
+                       +----+--------+
+                       |VER | STATUS |
+                       +----+--------+
+                       | 1  |   1    |
+                       +----+--------+
+
+  A STATUS field of X'00' indicates success. If the server returns a
+  `failure' (STATUS value other than X'00') status, it MUST close the
+  connection.
+*/
+
+func (s *SocksServer) handleUserPassAuth(sess *session) error {
+	con := sess.conn
+	buf := make([]byte, 256)
+	_, err := io.ReadFull(con, buf[:2])
+	if err != nil {
+		return errors.New("read auth header error:" + err.Error())
+	}
+	if buf[0] != 0x01 {
+		return errors.New("bad auth version")
+	}
+	ulen := int(buf[1])
+	_, err = io.ReadFull(con, buf[:ulen])
+	if err != nil {
+		return errors.New("read username error:" + err.Error())
+	}
+	username := string(buf[:ulen])
+	_, err = io.ReadFull(con, buf[:1])
+	if err != nil {
+		return errors.New("read password length error:" + err.Error())
+	}
+	plen := int(buf[0])
+	_, err = io.ReadFull(con, buf[:plen])
+	if err != nil {
+		return errors.New("read password error:" + err.Error())
+	}
+	password := string(buf[:plen])
+
+	err = s.authenticate(sess, &AuthRequest{Username: username, Password: password})
+	if err != nil {
+		_, _ = con.Write([]byte{0x01, 0x01})
+		return authError(errors.New("authentication failed for user " + username + ":" + err.Error()))
+	}
+	_, err = con.Write([]byte{0x01, 0x00})
+	if err != nil {
+		return errors.New("write auth status error:" + err.Error())
+	}
 	return nil
 }
 
@@ -55,47 +136,43 @@ func (s *SocksServer) handleAuth(con net.Conn) error {
             order
 */
 
-func (s *SocksServer) handleSocks5(con net.Conn) error {
-	buf := make([]byte, 256)
-	n, err := io.ReadFull(con, buf[:3])
-	if n != 3 {
-		return errors.New("read connect header :err" + err.Error())
-	}
-	ver, cmd := int(buf[0]), int(buf[1])
-	if ver != 5 {
-		return errors.New("bad version")
-	}
-	addr := ""
-	n, err = io.ReadFull(con, buf[:1])
-	atype := buf[0]
-	if atype == ATYPE_IPV4 {
-		n, err = io.ReadFull(con, buf[:4])
-		addr = net.IP(buf[:4]).String()
-	} else if atype == ATYPE_DOMAINNAME {
-		n, err = io.ReadFull(con, buf[:1])
-		addrLen := int(buf[0])
-		n, err = io.ReadFull(con, buf[:addrLen])
-		addr = string(buf[:addrLen])
-	} else if atype == ATYPE_IPV6 {
-		n, err = io.ReadFull(con, buf[:16])
-		addr = string('[') + (net.IP(buf[:16]).String()) + string(']')
-		logrus.Infoln("ipv6:" + addr)
-	}
-
-	n, err = io.ReadFull(con, buf[:2])
-	port := binary.BigEndian.Uint16(buf[:2])
+func (s *SocksServer) handleSocks5(sess *session) error {
+	con := sess.conn
+	req, err := socks.ReadRequest(con)
+	if err != nil {
+		var socksErr *socks.Error
+		if errors.As(err, &socksErr) {
+			sess.reply = int(socksErr.Reply)
+			_, _ = con.Write(socks5Reply(socksErr.Reply, nil))
+		}
+		if errors.Is(err, socks.ErrCommand) {
+			return errors.New("not support cmd " + strconv.Itoa(int(req.Command)))
+		}
+		return errors.New("read request error:" + err.Error())
+	}
+	cmd, addr, port := req.Command, req.Addr.Host(), req.Addr.Port
+	s.handshakeDone(sess)
+	err = s.admit(sess)
+	if err != nil {
+		sess.reply = 0x02
+		_, _ = con.Write(socks5Reply(0x02, nil))
+		return err
+	}
 	if cmd == CMD_CONNECT {
-		return s.handleConnectCmd(con, addr, port)
-	} else if cmd == CMD_UDP {
-		return s.handleUdpCmd(con, addr, port)
-	} else {
-		return errors.New("not support cmd")
+		sess.command = COMMAND_CONNECT
+		return s.handleConnectCmd(sess, addr, port)
+	} else if cmd == CMD_BIND {
+		sess.command = COMMAND_BIND
+		return s.handleBindCmd(sess, addr, port)
 	}
+	// ReadRequest refused the unknown commands, this is UDP ASSOCIATE
+	sess.command = COMMAND_UDP
+	return s.handleUdpCmd(sess, addr, port)
 }
 
-func (s *SocksServer) handleConnectCmd(con net.Conn, addr string, port uint16) error {
-	destAddrPort := fmt.Sprintf("%s:%d", addr, port)
-	dest, err := net.Dial("tcp", destAddrPort)
+func (s *SocksServer) handleConnectCmd(sess *session, addr string, port uint16) error {
+	con := sess.conn
+	dest, err := s.dial(sess, "tcp", addr, port)
 
 	/**
 	  The SOCKS request information is sent by the client as soon as it has
@@ -135,7 +212,9 @@ func (s *SocksServer) handleConnectCmd(con net.Conn, addr string, port uint16) e
 	*/
 
 	if err != nil {
-		_, _err := con.Write([]byte{0x05, 0x05, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+		rep := socks5ReplyCode(err)
+		sess.reply = int(rep)
+		_, _err := con.Write(socks5Reply(rep, nil))
 		if _err != nil {
 			logrus.Errorln(err)
 			return err
@@ -143,26 +222,96 @@ func (s *SocksServer) handleConnectCmd(con net.Conn, addr string, port uint16) e
 		return errors.New("connect dist error :" + err.Error())
 	}
 
-	_, err = con.Write([]byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+	sess.reply = 0x00
+	// BND.ADDR and BND.PORT of the outbound socket
+	_, err = con.Write(socks5Reply(0x00, dest.LocalAddr()))
 	if err != nil {
 		return errors.New("write  response error:" + err.Error())
 	}
 
-	forward := func(src net.Conn, dest net.Conn) {
-		defer func(src, dest net.Conn) {
-			_ = dest.Close()
-			_ = src.Close()
-		}(src, dest)
-		_, _ = io.Copy(dest, src)
+	logrus.Debugln(con.RemoteAddr().String() + "<->" + dest.LocalAddr().String() + "-" + dest.RemoteAddr().String() + " connect established!")
+	s.relay(sess, dest)
+	return nil
+}
+
+/**
+  The BIND request is used in protocols which require the client to
+     accept connections from the server.  FTP is a well-known example,
+     which uses the primary client-to-server connection for commands and
+     status reports, but may use a server-to-client connection for
+     transferring data on demand (e.g. LS, GET, PUT).
+
+     Two replies are sent from the SOCKS server to the client during a
+     BIND operation.  The first is sent after the server creates and binds
+     a new socket.  The BND.PORT field contains the port number that the
+     SOCKS server assigned to listen for an incoming connection.  The
+     BND.ADDR field contains the associated IP address.  The client will
+     typically use these pieces of information to notify (via the primary
+     or control connection) the application server of the rendezvous
+     address.  The second reply occurs only after the anticipated incoming
+     connection succeeds or fails.
+
+     In the second reply, the BND.PORT and BND.ADDR fields contain the
+     address and port number of the connecting host.
+*/
+
+func (s *SocksServer) handleBindCmd(sess *session, addr string, port uint16) error {
+	con := sess.conn
+	err := s.quotas.check(sess.user)
+	if err != nil {
+		sess.dialErr = err
+		sess.reply = 0x02
+		_, _ = con.Write(socks5Reply(0x02, nil))
+		return err
+	}
+	expect, err := bindPeerIPs(sess.ctx, sess.settings.resolver, addr)
+	if err != nil {
+		sess.reply = 0x04
+		_, _ = con.Write(socks5Reply(0x04, nil))
+		return errors.New("resolve bind address error:" + err.Error())
+	}
+	ln, err := listenBind(con, "tcp")
+	if err != nil {
+		sess.reply = 0x01
+		_, _ = con.Write(socks5Reply(0x01, nil))
+		return errors.New("bind listen error:" + err.Error())
+	}
+	sess.addCloser(ln)
+	defer func(ln net.Listener) {
+		_ = ln.Close()
+	}(ln)
+	sess.reply = 0x00
+	_, err = con.Write(socks5Reply(0x00, ln.Addr()))
+	if err != nil {
+		return errors.New("write response error:" + err.Error())
+	}
+
+	dest, err := acceptBind(ln, expect)
+	if err != nil {
+		rep := byte(0x01)
+		if isTimeout(err) {
+			rep = 0x06
+		}
+		sess.reply = int(rep)
+		_, _ = con.Write(socks5Reply(rep, nil))
+		return errors.New("bind accept error:" + err.Error())
 	}
-	logrus.Infoln(con.RemoteAddr().String() + "<->" + dest.LocalAddr().String() + "-" + dest.RemoteAddr().String() + " connect established!")
-	go forward(con, dest)
-	go forward(dest, con)
+	sess.reply = 0x00
+	_, err = con.Write(socks5Reply(0x00, dest.RemoteAddr()))
+	if err != nil {
+		_ = dest.Close()
+		return errors.New("write response error:" + err.Error())
+	}
+
+	logrus.Debugln(con.RemoteAddr().String() + "<->" + dest.LocalAddr().String() + "-" + dest.RemoteAddr().String() + " bind established!")
+	sess.setRoute(dest.RemoteAddr().String(), ROUTE_DIRECT, "")
+	s.relay(sess, s.outboundConn(sess, dest, sess.protocol, ROUTE_DIRECT))
 	return nil
 }
 
-func (s *SocksServer) handleUdpCmd(con net.Conn, addr string, port uint16) error {
-	logrus.Infof("udp ASSOCIATE request %s:%d\n", addr, port)
+func (s *SocksServer) handleUdpCmd(sess *session, addr string, port uint16) error {
+	con := sess.conn
+	logrus.Debugf("udp ASSOCIATE request %s:%d\n", addr, port)
 	/**
 	  The SOCKS request information is sent by the client as soon as it has
 	     established a connection to the SOCKS server, and completed the
@@ -215,30 +364,76 @@ func (s *SocksServer) handleUdpCmd(con net.Conn, addr string, port uint16) error
 	     fields indicate the port number/address where the client MUST send
 	     UDP request messages to be relayed.
 	*/
-	udpAddr, _ := net.ResolveIPAddr("ip", s.udpIp)
-	hostByte := udpAddr.IP.To4()
-	portByte := make([]byte, 2)
-	binary.BigEndian.PutUint16(portByte, uint16(s.udpPort))
-	buf := append([]byte{0x05, 0x00, 0x00, 0x01}, hostByte...)
-	buf = append(buf, portByte...)
-	_, err := con.Write(buf)
-	//_,err := con.Write([]byte{0x05,0x00,0x00,0x01,0x0a,0x14,0xb,0x71,0x0f,0xa0})
+	err := s.quotas.check(sess.user)
+	if err != nil {
+		sess.dialErr = err
+		sess.reply = 0x02
+		_, _ = con.Write(socks5Reply(0x02, nil))
+		return err
+	}
+	info := s.udpServer.associate(sess, addr, port)
+	defer s.udpServer.release(info)
+	// listed before the reply, the client may ask for it right away
+	s.registry.add(sess)
+	defer s.registry.remove(sess)
+	sess.reply = 0x00
+	_, err = con.Write(socks5Reply(0x00, s.udpAdvertiseAddr(sess)))
 	if err != nil {
 		return errors.New("write response error:" + err.Error())
 	}
+	// the association lives as long as the control connection
+	_, _ = io.Copy(io.Discard, con)
+	return nil
+}
+
+// socks5Reply build a reply carrying addr as BND.ADDR and BND.PORT,
+// a nil addr is sent as 0.0.0.0:0
+func socks5Reply(rep byte, addr net.Addr) []byte {
+	buf, _ := (&socks.Reply{Code: rep, Addr: socks.AddrFromNet(addr)}).Append(nil)
+	return buf
+}
+
+// socks5ReplyCode is the reply telling why a connection to the target
+// failed, a code sent by an upstream socks5 proxy is passed on
+func socks5ReplyCode(err error) byte {
+	var replyErr *socks5ReplyError
+	var dnsErr *net.DNSError
+	switch {
+	case errors.Is(err, errRejected):
+		return 0x02
+	case errors.As(err, &replyErr):
+		return replyErr.rep
+	case errors.As(err, &dnsErr):
+		return 0x04
+	case errors.Is(err, syscall.ENETUNREACH) || errors.Is(err, syscall.ENETDOWN):
+		return 0x03
+	case errors.Is(err, syscall.EHOSTUNREACH) || errors.Is(err, syscall.EHOSTDOWN):
+		return 0x04
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return 0x05
+	case errors.Is(err, context.DeadlineExceeded) || errors.Is(err, syscall.ETIMEDOUT) || isTimeout(err):
+		return 0x06
+	}
+	return 0x01
+}
 
-	forward := func(src net.Conn) {
-		defer func(src net.Conn) {
-			_ = src.Close()
-		}(src)
-		for {
-			_, err := io.ReadFull(src, make([]byte, 100))
-			if err != nil {
-				break
-			}
+// udpAdvertiseAddr is the BND.ADDR and BND.PORT of UDP ASSOCIATE replies,
+// a relay bound to every interface is announced with the address the
+// client used to reach the proxy
+func (s *SocksServer) udpAdvertiseAddr(sess *session) *net.UDPAddr {
+	addr := &net.UDPAddr{IP: s.udpServer.udpAddr.IP, Port: s.udpServer.udpAddr.Port}
+	if udpIp := sess.settings.udpIp; udpIp != "" {
+		ipAddr, err := net.ResolveIPAddr("ip", udpIp)
+		if err == nil {
+			addr.IP = ipAddr.IP
+			return addr
 		}
+		logrus.Warningln("resolve udp advertise address error", err)
 	}
-
-	go forward(con)
-	return nil
+	if addr.IP == nil || addr.IP.IsUnspecified() {
+		if local, ok := sess.conn.LocalAddr().(*net.TCPAddr); ok {
+			addr.IP = local.IP
+		}
+	}
+	return addr
 }
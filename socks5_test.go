@@ -0,0 +1,355 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"mixed-socks/socks"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// newEchoServer start a tcp server on the loopback writing back what it
+// reads, closed with the test
+func newEchoServer(t *testing.T) *net.TCPAddr {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = ln.Close()
+	})
+	go func() {
+		for {
+			con, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(con, con)
+				_ = con.Close()
+			}()
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr)
+}
+
+// socks5Request is a socks5 request of cmd to addr
+func socks5Request(cmd byte, addr net.Addr) []byte {
+	b, _ := (&socks.Request{Command: cmd, Addr: socks.AddrFromNet(addr)}).Append(nil)
+	return b
+}
+
+// proxyExchange send request to the proxy at addr and read len(want)
+// bytes of reply, the connection is returned for more
+func proxyExchange(t *testing.T, addr string, request, want []byte) net.Conn {
+	t.Helper()
+	con, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = con.Close()
+	})
+	_ = con.SetDeadline(time.Now().Add(2 * time.Second))
+	_, err = con.Write(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(want))
+	n, err := io.ReadFull(con, got)
+	if err != nil {
+		t.Fatalf("reply %x: %v, want %x", got[:n], err, want)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("reply %x, want %x", got, want)
+	}
+	return con
+}
+
+// expectClosed check the proxy closed con without sending more
+func expectClosed(t *testing.T, con net.Conn) {
+	t.Helper()
+	_ = con.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := con.Read(make([]byte, 1))
+	if n != 0 || !(errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) || isConnReset(err)) {
+		t.Errorf("connection still open: %d %v", n, err)
+	}
+}
+
+func isConnReset(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && !opErr.Timeout()
+}
+
+func userPass(user, pass string) []byte {
+	return append(append(append([]byte{1, byte(len(user))}, user...), byte(len(pass))), pass...)
+}
+
+func TestSocks5UserPassAuth(t *testing.T) {
+	echo := newEchoServer(t)
+	withAuth := newTestServer(t)
+	withAuth.SetAuthenticator(StaticAuthenticator{"bob": "pw"})
+	open := newTestServer(t)
+	tests := []struct {
+		name    string
+		server  *SocksServer
+		request []byte
+		want    []byte
+		relay   bool // the connection then relays to the echo server
+	}{
+		{
+			name:    "user pass",
+			server:  withAuth,
+			request: append(append([]byte{5, 2, METHOD_NO_AUTH, METHOD_USER_PASS}, userPass("bob", "pw")...), socks5Request(CMD_CONNECT, echo)...),
+			want:    []byte{5, METHOD_USER_PASS, 1, 0, 5, 0},
+			relay:   true,
+		},
+		{
+			name:    "wrong password",
+			server:  withAuth,
+			request: append([]byte{5, 1, METHOD_USER_PASS}, userPass("bob", "guess")...),
+			want:    []byte{5, METHOD_USER_PASS, 1, 1},
+		},
+		{
+			name:    "unknown user",
+			server:  withAuth,
+			request: append([]byte{5, 1, METHOD_USER_PASS}, userPass("eve", "pw")...),
+			want:    []byte{5, METHOD_USER_PASS, 1, 1},
+		},
+		{
+			name:    "empty user",
+			server:  withAuth,
+			request: append([]byte{5, 1, METHOD_USER_PASS}, userPass("", "")...),
+			want:    []byte{5, METHOD_USER_PASS, 1, 1},
+		},
+		{
+			name:    "bad subnegotiation version",
+			server:  withAuth,
+			request: []byte{5, 1, METHOD_USER_PASS, 5, 3, 'b', 'o', 'b', 2, 'p', 'w'},
+			want:    []byte{5, METHOD_USER_PASS},
+		},
+		{
+			name:    "no auth offered",
+			server:  withAuth,
+			request: []byte{5, 1, METHOD_NO_AUTH},
+			want:    []byte{5, METHOD_NO_ACCEPTABLE},
+		},
+		{
+			name:    "no methods",
+			server:  withAuth,
+			request: []byte{5, 0},
+			want:    []byte{5, METHOD_NO_ACCEPTABLE},
+		},
+		{
+			name:    "no auth needed",
+			server:  open,
+			request: append([]byte{5, 2, METHOD_USER_PASS, METHOD_NO_AUTH}, socks5Request(CMD_CONNECT, echo)...),
+			want:    []byte{5, METHOD_NO_AUTH, 5, 0},
+			relay:   true,
+		},
+		{
+			name:    "only user pass offered to an open server",
+			server:  open,
+			request: []byte{5, 1, METHOD_USER_PASS},
+			want:    []byte{5, METHOD_NO_ACCEPTABLE},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			con := proxyExchange(t, tt.server.ln.Addr().String(), tt.request, tt.want)
+			if !tt.relay {
+				expectClosed(t, con)
+				return
+			}
+			// rest of the CONNECT reply, BND.ADDR and BND.PORT
+			_, err := io.ReadFull(con, make([]byte, 8))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = con.Write([]byte("ping"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make([]byte, 4)
+			_, err = io.ReadFull(con, got)
+			if err != nil || string(got) != "ping" {
+				t.Errorf("relayed %q %v, want ping", got, err)
+			}
+		})
+	}
+}
+
+func TestUdpAdvertiseAddr(t *testing.T) {
+	tests := []struct {
+		name      string
+		bound     string
+		advertise string
+		want      string
+	}{
+		{name: "bound address", bound: "192.0.2.1", want: "192.0.2.1"},
+		{name: "any address", bound: "0.0.0.0", want: "127.0.0.1"},
+		{name: "ipv6 any address", bound: "::", want: "127.0.0.1"},
+		{name: "ipv6 bound address", bound: "2001:db8::1", want: "2001:db8::1"},
+		{name: "advertised", bound: "0.0.0.0", advertise: "203.0.113.9", want: "203.0.113.9"},
+		{name: "advertised ipv6", bound: "192.0.2.1", advertise: "2001:db8::9", want: "2001:db8::9"},
+		{name: "advertised unresolvable", bound: "0.0.0.0", advertise: "host.invalid", want: "127.0.0.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewSocksServer("127.0.0.1", 0)
+			s.udpServer.udpAddr = &net.UDPAddr{IP: net.ParseIP(tt.bound), Port: 1080}
+			sess := newTestSession(t)
+			sess.settings = &serverSettings{udpIp: tt.advertise}
+			got := s.udpAdvertiseAddr(sess)
+			if !got.IP.Equal(net.ParseIP(tt.want)) || got.Port != 1080 {
+				t.Errorf("advertised %v, want %s port 1080", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestUdpAssociateReplyIPv6 check a relay on an ipv6 address is announced
+// with an ipv6 BND.ADDR
+func TestUdpAssociateReplyIPv6(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := NewSocksServer("::1", 0)
+	err := s.Listen(ctx)
+	if err != nil {
+		cancel()
+		t.Skip("no ipv6 loopback:", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		_ = s.Serve(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	con := proxyExchange(t, s.ln.Addr().String(), []byte{5, 1, 0, 5, 3, 0, 1, 0, 0, 0, 0, 0, 0}, []byte{5, 0})
+	defer con.Close()
+	reply, err := socks.ReadReply(con)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Code != 0 || reply.Addr.Type != socks.ATYPE_IPV6 || reply.Addr.String() != s.udpServer.udpAddr.String() {
+		t.Errorf("reply %d %d %v, want relay %v", reply.Code, reply.Addr.Type, reply.Addr, s.udpServer.udpAddr)
+	}
+}
+
+func TestSocks5ReplyCode(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want byte
+	}{
+		{name: "rejected", err: errRejected, want: 0x02},
+		{name: "quota", err: &quotaError{user: "bob", period: QUOTA_DAILY}, want: 0x02},
+		{name: "connection limit", err: &limitError{limit: LIMIT_USER, max: 1}, want: 0x02},
+		{name: "upstream reply", err: &net.OpError{Op: "dial", Err: &socks5ReplyError{rep: 0x03}}, want: 0x03},
+		{name: "dns", err: &net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", Name: "a.test", IsNotFound: true}}, want: 0x04},
+		{name: "network unreachable", err: &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ENETUNREACH)}, want: 0x03},
+		{name: "network down", err: os.NewSyscallError("connect", syscall.ENETDOWN), want: 0x03},
+		{name: "host unreachable", err: &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.EHOSTUNREACH)}, want: 0x04},
+		{name: "host down", err: syscall.EHOSTDOWN, want: 0x04},
+		{name: "refused", err: &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, want: 0x05},
+		{name: "deadline", err: context.DeadlineExceeded, want: 0x06},
+		{name: "timed out", err: &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ETIMEDOUT)}, want: 0x06},
+		{name: "io timeout", err: &net.OpError{Op: "dial", Err: os.ErrDeadlineExceeded}, want: 0x06},
+		{name: "other", err: errors.New("upstream http proxy replied 502"), want: 0x01},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := socks5ReplyCode(tt.err); got != tt.want {
+				t.Errorf("reply %#x, want %#x", got, tt.want)
+			}
+		})
+	}
+}
+
+// acceptServer start a tcp server on addr sending the remote address of
+// each client it accepts to the returned channel
+func acceptServer(t *testing.T, addr string) (*net.TCPAddr, chan net.Addr) {
+	t.Helper()
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Skip("cannot listen on", addr, err)
+	}
+	t.Cleanup(func() {
+		_ = ln.Close()
+	})
+	clients := make(chan net.Addr, 1)
+	go func() {
+		for {
+			con, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			clients <- con.RemoteAddr()
+			_ = con.Close()
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr), clients
+}
+
+func TestSocks5ConnectBndAddr(t *testing.T) {
+	tests := []struct {
+		name   string
+		listen string
+		atyp   byte
+	}{
+		{name: "ipv4", listen: "127.0.0.1:0", atyp: socks.ATYPE_IPV4},
+		{name: "ipv6", listen: "[::1]:0", atyp: socks.ATYPE_IPV6},
+	}
+	s := newTestServer(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target, clients := acceptServer(t, tt.listen)
+			con := proxyExchange(t, s.ln.Addr().String(), append([]byte{5, 1, METHOD_NO_AUTH}, socks5Request(CMD_CONNECT, target)...), []byte{5, METHOD_NO_AUTH})
+			reply := readSocks5Reply(t, con)
+			var outbound net.Addr
+			select {
+			case outbound = <-clients:
+			case <-time.After(2 * time.Second):
+				t.Fatal("target not reached")
+			}
+			if reply.Code != socks.REPLY_SUCCEEDED || reply.Addr.Type != tt.atyp || reply.Addr.String() != outbound.String() {
+				t.Errorf("reply %d %d %v, want BND %v", reply.Code, reply.Addr.Type, reply.Addr, outbound)
+			}
+		})
+	}
+}
+
+func TestSocks5ErrorReplies(t *testing.T) {
+	echo := newEchoServer(t)
+	closed, _ := net.ResolveTCPAddr("tcp", freePort(t))
+	s := newTestServer(t)
+	s.SetDialer(&DirectDialer{Resolver: &staticResolver{}})
+	missing, err := socks.NewAddr("missing.test", 80)
+	if err != nil {
+		t.Fatal(err)
+	}
+	domain, _ := (&socks.Request{Command: CMD_CONNECT, Addr: missing}).Append(nil)
+	tests := []struct {
+		name    string
+		request []byte
+		want    byte
+	}{
+		{name: "refused", request: socks5Request(CMD_CONNECT, closed), want: socks.REPLY_CONNECTION_REFUSED},
+		{name: "dns failure", request: domain, want: socks.REPLY_HOST_UNREACHABLE},
+		{name: "command not supported", request: append([]byte{5, 9}, socks5Request(CMD_CONNECT, echo)[2:]...), want: socks.REPLY_COMMAND_NOT_SUPPORTED},
+		{name: "address type not supported", request: []byte{5, CMD_CONNECT, 0, 2, 127, 0, 0, 1, 0, 80}, want: socks.REPLY_ADDRESS_NOT_SUPPORTED},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxyExchange(t, s.ln.Addr().String(), append([]byte{5, 1, METHOD_NO_AUTH}, tt.request...), []byte{5, METHOD_NO_AUTH, 5, tt.want})
+		})
+	}
+}
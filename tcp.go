@@ -5,76 +5,189 @@ import (
 	"errors"
 	"github.com/sirupsen/logrus"
 	"io"
-	"log"
 	"mixed-socks/mux"
 	"net"
 	"strconv"
+	"time"
 )
 
-func (s *SocksServer) listenTcpServer(ctx context.Context) error {
-	conn, err := mux.Listen(ctx, "tcp", s.sockIp+":"+strconv.Itoa(s.port))
+func (s *SocksServer) listenTcpServer(ctx context.Context) (net.Listener, error) {
+	conn, err := mux.Listen(ctx, "tcp", net.JoinHostPort(s.sockIp, strconv.Itoa(s.port)))
 	if err != nil {
 		logrus.Infoln("connect error", err)
-		return err
+		return nil, err
 	}
 	logrus.Infoln("listen tcp:" + conn.Addr().String())
+	return conn, nil
+}
+
+// serveTcp accept clients until ctx is done or the listener is closed,
+// then drain the live sessions. Other Accept errors are retried with a
+// backoff
+func (s *SocksServer) serveTcp(ctx context.Context, conn net.Listener) error {
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.Close()
+		case <-stop:
+		}
+	}()
+	var retry time.Duration // wait before the next Accept, 0 after a success
 	for {
 		c, err := conn.Accept()
 		if err != nil {
-			logrus.Errorln("accept error", err)
-			break
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				// the udp relay stops along with the listener, not after
+				// the sessions are drained, so a listener added back on
+				// the same address can bind it
+				s.udpServer.Close()
+				s.drain(ctx)
+				return nil
+			}
+			// out of file descriptors or another failure of this client
+			// only, the listener is still usable
+			retry *= 2
+			if retry == 0 {
+				retry = 5 * time.Millisecond
+			} else if retry > time.Second {
+				retry = time.Second
+			}
+			logrus.Errorln("accept error", err, "retrying in", retry)
+			select {
+			case <-ctx.Done():
+			case <-time.After(retry):
+			}
+			continue
 		}
-		go s.handleConnection(c)
-
+		retry = 0
+		if !s.allowClient("tcp", c.RemoteAddr()) {
+			logrus.Warningln(c.RemoteAddr().String() + " denied by the access list of " + conn.Addr().String())
+			_ = c.Close()
+			continue
+		}
+		sess := newSession(c, s.settings.Load())
+		sess.limitErr = s.limits.acquireConn(sess)
+		s.sessions.add(sess)
+		go func() {
+			defer s.sessions.remove(sess)
+			defer s.limits.release(sess)
+			defer func() {
+				_ = sess.Close()
+			}()
+			s.handleConnection(sess)
+		}()
 	}
-	defer func(conn net.Listener) {
-		err := conn.Close()
-		if err != nil {
-			logrus.Error(err)
+}
+
+// drain wait for the live sessions to end. A listener closed by Close
+// leaves them to end by themselves until ctx is done, then the ones still
+// running after the shutdown grace period are closed
+func (s *SocksServer) drain(ctx context.Context) {
+	name := net.JoinHostPort(s.sockIp, strconv.Itoa(s.port))
+	if ctx.Err() == nil && s.sessions.len() > 0 {
+		logrus.Infoln("listener " + name + " closed, waiting for " + strconv.Itoa(s.sessions.len()) + " sessions")
+		if s.sessions.wait(ctx) {
+			return
 		}
-	}(conn)
-	return errors.New("socks server stop")
+	}
+	n := s.sessions.len()
+	if n == 0 {
+		return
+	}
+	logrus.Infoln("listener " + name + " draining " + strconv.Itoa(n) + " sessions")
+	graceCtx, cancel := context.WithTimeout(context.Background(), s.settings.Load().shutdownGrace)
+	defer cancel()
+	if s.sessions.wait(graceCtx) {
+		return
+	}
+	logrus.Warningln("listener " + name + " closing " + strconv.Itoa(s.sessions.len()) + " sessions after the shutdown grace period")
+	s.sessions.closeAll()
+	s.sessions.wait(context.Background())
 }
 
-func (s *SocksServer) handleConnection(con net.Conn) {
+func (s *SocksServer) handleConnection(sess *session) {
+	var err error
+	defer func() {
+		s.logAccess(sess, err)
+	}()
+	con := sess.conn
+	if timeout := sess.settings.handshakeTimeout; timeout > 0 {
+		_ = con.SetDeadline(sess.start.Add(timeout))
+	}
 	ver, err := s.handleVersion(con)
 	if err != nil {
 		_ = con.Close()
-		log.Println(con.RemoteAddr().String()+" error", err)
+		logrus.Debugln(con.RemoteAddr().String()+" error", err)
 		return
 	}
-	if ver == 4 {
-		logrus.Infoln(con.RemoteAddr().String(), "using socks4 request for service!")
-		err := s.handleSocks4(con)
-		if err != nil {
-			logrus.Warningln(err)
-		}
+	sess.protocol = versionProtocol(ver)
+	metricConnections.WithLabelValues(sess.protocol).Inc()
+	if !sess.allowProtocol() {
+		_ = con.Close()
+		err = &handshakeError{reason: HANDSHAKE_PROTOCOL, err: errors.New("protocol " + sess.protocol + " is not enabled on this listener")}
+		metricHandshakeErrors.WithLabelValues(sess.protocol, HANDSHAKE_PROTOCOL).Inc()
+		logrus.Warningln(con.RemoteAddr().String() + " " + err.Error())
 		return
 	}
-	if ver == 5 {
-		logrus.Infoln(con.RemoteAddr().String(), "using socks5 request for service!")
-		err = s.handleAuth(con)
-		if err != nil {
-			_ = con.Close()
-			logrus.Warningln(con.RemoteAddr().String()+" error", err)
-			return
-		}
-
-		err = s.handleSocks5(con)
-		if err != nil {
-			logrus.Warningln(con.RemoteAddr().String()+" error", err)
-			_ = con.Close()
+	if ver == 4 {
+		logrus.Debugln(con.RemoteAddr().String(), "using socks4 request for service!")
+		err = s.handleSocks4(sess)
+	} else if ver == 5 {
+		logrus.Debugln(con.RemoteAddr().String(), "using socks5 request for service!")
+		err = s.handleAuth(sess)
+		if err == nil {
+			err = s.handleSocks5(sess)
 		}
-		return
+	} else {
+		//default handle http
+		logrus.Debugln(con.RemoteAddr().String(), "using http request for service!")
+		err = s.handleProxy(sess, ver)
 	}
-	//default handle http
-	logrus.Infoln(con.RemoteAddr().String(), "using http request for service!")
-	err = s.handleProxy(con, ver)
 	if err != nil {
-		logrus.Warningln(con.RemoteAddr().String()+" http proxy error", err)
+		if !sess.handshaked {
+			metricHandshakeErrors.WithLabelValues(sess.protocol, handshakeErrorReason(sess, err)).Inc()
+		}
+		logrus.Warningln(con.RemoteAddr().String()+" "+sess.protocol+" error", err)
 		_ = con.Close()
 	}
-	return
+}
+
+// handshakeErrorReason tell why a client failed before its request was read
+func handshakeErrorReason(sess *session, err error) string {
+	var hsErr *handshakeError
+	if errors.As(err, &hsErr) {
+		return hsErr.reason
+	}
+	timeout := sess.settings.handshakeTimeout
+	if isTimeout(err) || (timeout > 0 && time.Since(sess.start) >= timeout) {
+		return HANDSHAKE_TIMEOUT
+	}
+	return HANDSHAKE_BAD_REQUEST
+}
+
+func versionProtocol(ver byte) string {
+	switch ver {
+	case 4:
+		return PROTOCOL_SOCKS4
+	case 5:
+		return PROTOCOL_SOCKS5
+	}
+	return PROTOCOL_HTTP
+}
+
+func (sess *session) allowProtocol() bool {
+	protocols := sess.settings.protocols
+	return protocols == nil || protocols[sess.protocol]
+}
+
+// handshakeDone lift the handshake deadline once the client request is read
+func (s *SocksServer) handshakeDone(sess *session) {
+	sess.handshaked = true
+	if sess.settings.handshakeTimeout > 0 {
+		_ = sess.conn.SetDeadline(time.Time{})
+	}
 }
 
 // http CONNECT first char is C
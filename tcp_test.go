@@ -0,0 +1,203 @@
+package proxy
+
+import (
+	"context"
+	"mixed-socks/socks"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// startServer serve s until the returned cancel is called, done is closed
+// once Serve returned
+func startServer(t *testing.T, s *SocksServer) (context.CancelFunc, chan struct{}) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	err := s.Listen(ctx)
+	if err != nil {
+		cancel()
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		err := s.Serve(ctx)
+		if err != nil {
+			t.Error(err)
+		}
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return cancel, done
+}
+
+// waitSessions wait for every session of s to end
+func waitSessions(t *testing.T, s *SocksServer) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if !s.sessions.wait(ctx) {
+		t.Fatalf("%d sessions still running", s.sessions.len())
+	}
+}
+
+// socks5Connect open a relay to target through the proxy at addr
+func socks5Connect(t *testing.T, addr string, target net.Addr) net.Conn {
+	t.Helper()
+	con := proxyExchange(t, addr, append([]byte{5, 1, METHOD_NO_AUTH}, socks5Request(CMD_CONNECT, target)...), []byte{5, METHOD_NO_AUTH})
+	if rep := readSocks5Reply(t, con); rep.Code != socks.REPLY_SUCCEEDED {
+		t.Fatalf("connect reply %d", rep.Code)
+	}
+	expectEcho(t, con)
+	return con
+}
+
+func TestServeShutdownGrace(t *testing.T) {
+	echo := newEchoServer(t)
+	tests := []struct {
+		name     string
+		grace    time.Duration
+		endFirst bool // the client ends its session during the grace period
+		min, max time.Duration
+	}{
+		{name: "session closed after grace", grace: 300 * time.Millisecond, min: 300 * time.Millisecond, max: 2 * time.Second},
+		{name: "session ends within grace", grace: 5 * time.Second, endFirst: true, max: 2 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewSocksServer("127.0.0.1", 0)
+			s.SetDialer(NewDirectDialer())
+			s.SetShutdownGrace(tt.grace)
+			cancel, done := startServer(t, s)
+			addr := s.ln.Addr().String()
+			con := socks5Connect(t, addr, echo)
+
+			start := time.Now()
+			cancel()
+			// new clients are refused while the session drains, one queued
+			// before the listener closed is reset without an answer
+			if c, err := net.Dial("tcp", addr); err == nil {
+				_, _ = c.Write([]byte{5, 1, METHOD_NO_AUTH})
+				_ = c.SetReadDeadline(time.Now().Add(2 * time.Second))
+				if n, _ := c.Read(make([]byte, 2)); n > 0 {
+					t.Error("listener still accepting while draining")
+				}
+				_ = c.Close()
+			}
+			select {
+			case <-done:
+				t.Fatal("Serve returned before the session ended")
+			default:
+			}
+			if tt.endFirst {
+				expectEcho(t, con)
+				_ = con.Close()
+			}
+			select {
+			case <-done:
+			case <-time.After(tt.max):
+				t.Fatal("Serve did not return after the shutdown grace period")
+			}
+			if elapsed := time.Since(start); elapsed < tt.min {
+				t.Errorf("Serve returned after %v, want at least %v", elapsed, tt.min)
+			}
+			if !tt.endFirst {
+				expectClosed(t, con)
+			}
+		})
+	}
+}
+
+// TestCloseKeepsSessions check Close stops accepting while the live
+// sessions relay until the ctx of Serve is done
+func TestCloseKeepsSessions(t *testing.T) {
+	echo := newEchoServer(t)
+	s := NewSocksServer("127.0.0.1", 0)
+	s.SetDialer(NewDirectDialer())
+	s.SetShutdownGrace(100 * time.Millisecond)
+	cancel, done := startServer(t, s)
+	addr := s.ln.Addr().String()
+	con := socks5Connect(t, addr, echo)
+
+	err := s.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, err := net.Dial("tcp", addr); err == nil {
+		_ = c.Close()
+		t.Error("listener still accepting after Close")
+	}
+	expectEcho(t, con)
+	select {
+	case <-done:
+		t.Fatal("Serve returned with a live session")
+	case <-time.After(100 * time.Millisecond):
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Serve did not return after ctx was done")
+	}
+	expectClosed(t, con)
+}
+
+func TestListenAndServeAddressInUse(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	s := NewSocksServer("127.0.0.1", ln.Addr().(*net.TCPAddr).Port)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := s.ListenAndServe(ctx); err == nil {
+		t.Error("bound address: no error")
+	}
+}
+
+// failingListener fail its first Accepts as a process out of file
+// descriptors would
+type failingListener struct {
+	net.Listener
+	fails int
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	if l.fails > 0 {
+		l.fails--
+		return nil, os.NewSyscallError("accept", syscall.EMFILE)
+	}
+	return l.Listener.Accept()
+}
+
+func TestServeRetriesAcceptErrors(t *testing.T) {
+	echo := newEchoServer(t)
+	s := NewSocksServer("127.0.0.1", 0)
+	s.SetDialer(NewDirectDialer())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err := s.Listen(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.ln = &failingListener{Listener: s.ln, fails: 3}
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Serve(ctx)
+	}()
+	_ = socks5Connect(t, s.ln.Addr().String(), echo).Close()
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("serve: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("serve still running")
+	}
+}
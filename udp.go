@@ -1,24 +1,30 @@
 package proxy
 
 import (
-	"encoding/binary"
 	"errors"
 	"github.com/sirupsen/logrus"
+	"mixed-socks/socks"
 	"net"
 	"strconv"
+	"sync"
 	"time"
 )
 
 type UdpServer struct {
-	udpAddr    *net.UDPAddr
-	udpIp      string //udp associate ip
-	udpPort    int    // udp associate address
+	udpAddr    *net.UDPAddr // udp associate address
 	serverConn *net.UDPConn
 	srcUdpMap  SrcUdpMap
+	dial       func(sess *session, network, addr string, port uint16) (net.Conn, error)
+	allow      func(network string, addr net.Addr) bool // access list of the listener, nil for everyone
+
+	mu     sync.Mutex
+	closed bool
+	served chan struct{} // closed when Serve returns, nil before it runs
 }
 
-func NewUdpServer() *UdpServer {
+func NewUdpServer(dial func(sess *session, network, addr string, port uint16) (net.Conn, error)) *UdpServer {
 	tcpLocal := UdpServer{
+		dial: dial,
 		srcUdpMap: SrcUdpMap{
 			associated: make(map[string]*SrcUdpInfo),
 		},
@@ -26,47 +32,99 @@ func NewUdpServer() *UdpServer {
 	return &tcpLocal
 }
 
-func (u *UdpServer) Listen() error {
-	port, err := freePort()
-	if err != nil {
-		logrus.Errorln(err)
-		return err
-	}
-	u.udpIp = "localhost"
-	u.udpPort = port
-	u.udpAddr, _ = net.ResolveUDPAddr("udp", u.udpIp+":"+strconv.Itoa(u.udpPort))
-	conn, err := net.ListenUDP("udp", u.udpAddr)
+// Listen bind the udp relay, datagrams are read by Serve
+func (u *UdpServer) Listen(addr *net.UDPAddr) error {
+	conn, err := net.ListenUDP("udp", addr)
 	if err != nil {
 		logrus.Errorln("connect error", err)
-		return errors.New("udp listen error")
+		return errors.New("udp listen error:" + err.Error())
 	}
-	//logrus.Infoln("Listen udp:" + u.udpAddr.String())
+	u.udpAddr = conn.LocalAddr().(*net.UDPAddr)
+	logrus.Infoln("listen udp:" + u.udpAddr.String())
 	u.serverConn = conn
-	go u.timeout()
+	return nil
+}
+
+// Serve relay the datagrams of the associations until Close is called
+func (u *UdpServer) Serve() {
+	u.mu.Lock()
+	if u.closed {
+		u.mu.Unlock()
+		return
+	}
+	served := make(chan struct{})
+	u.served = served
+	u.mu.Unlock()
+	defer close(served)
 	for {
 		var data = make([]byte, 8192)
-		n, srcAddr, err := conn.ReadFromUDP(data)
+		n, srcAddr, err := u.serverConn.ReadFromUDP(data)
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
 			logrus.Errorln("READ error", err)
 			continue
 		}
 		if n <= 0 {
 			continue
 		}
-		logrus.Infof("[%v]:", srcAddr)
-		go u.handleUdpPacket(srcAddr, data[:n])
+		// denied datagrams are only counted, logging each one would let
+		// a flood fill the log
+		if u.allow != nil && !u.allow("udp", srcAddr) {
+			logrus.Debugln(srcAddr.String() + " denied by the access list, drop package")
+			continue
+		}
+		logrus.Debugf("[%v]:", srcAddr)
+		// fragments are reassembled here one datagram at a time so the
+		// ones of a sequence keep their order, only forwarding is
+		// concurrent
+		u.handleUdpPacket(srcAddr, data[:n])
 	}
 }
 
-func (u *UdpServer) timeout() {
-	tick := time.Tick(time.Second * 100)
-	for {
-		select {
-		case <-tick:
-			u.srcUdpMap.timeout()
-		}
+// Close stop the relay and tear down the remaining associations, their
+// control connections are closed as they can not relay anymore
+func (u *UdpServer) Close() {
+	u.mu.Lock()
+	u.closed = true
+	served := u.served
+	u.mu.Unlock()
+	_ = u.serverConn.Close()
+	// the socket is only released once the read in progress returned, so
+	// the address can be bound again when Close returns
+	if served != nil {
+		<-served
+	}
+	for _, info := range u.srcUdpMap.all() {
+		u.release(info)
+		_ = info.sess.Close()
+	}
+}
+
+// associate register the association of a UDP ASSOCIATE request, only
+// datagrams from the ip of the control connection matching the requested
+// DST.ADDR and DST.PORT are relayed until release is called
+func (u *UdpServer) associate(sess *session, addr string, port uint16) *SrcUdpInfo {
+	info := &SrcUdpInfo{
+		sess:         sess,
+		localDestCon: make(map[string]net.Conn),
 	}
+	if tcpAddr, ok := sess.conn.RemoteAddr().(*net.TCPAddr); ok {
+		info.clientIP = tcpAddr.IP
+	}
+	info.expectAddr = &net.UDPAddr{IP: net.ParseIP(addr), Port: int(port)}
+	u.srcUdpMap.add(info)
+	metricUdpAssociations.WithLabelValues(sess.user).Inc()
+	return info
+}
 
+// release tear down an association once its control connection is closed
+func (u *UdpServer) release(info *SrcUdpInfo) {
+	if u.srcUdpMap.delete(info) {
+		metricUdpAssociations.WithLabelValues(info.sess.user).Dec()
+	}
+	info.Destroy()
 }
 
 /**
@@ -90,75 +148,63 @@ func (u *UdpServer) timeout() {
 */
 
 func (u *UdpServer) handleUdpPacket(srcAddr *net.UDPAddr, message []byte) {
-	logrus.Infoln(srcAddr.String() + " send udp package!")
-	length := len(message)
-	index := 3
-	if length < index {
-		logrus.Errorln("error package")
-		return
-	}
-	if message[0] != 0x00 && message[1] != 0x00 {
-		logrus.Errorln("rev failed not 0x0000")
+	logrus.Debugln(srcAddr.String() + " send udp package!")
+	header, index, err := socks.ParseUDPHeader(message)
+	if err != nil {
+		logrus.Errorln(srcAddr.String()+" error package", err)
 		return
 	}
-	if message[2] != 0x00 {
-		logrus.Errorln("FRAG  not support")
+	srcUdpInfo := u.srcUdpMap.get(srcAddr)
+	if srcUdpInfo == nil {
+		logrus.Warningln(srcAddr.String() + " has no udp association, drop package")
 		return
 	}
-	atype := message[3]
-	index = 4
-	var addr = ""
-	if atype == ATYPE_IPV4 {
-		index += 4
-		addr = net.IP(message[index-4 : index]).String()
-	} else if atype == ATYPE_DOMAINNAME {
-		addrLen := int(message[index])
-		index += 1
-		addr = string(message[index : index+addrLen])
-		index += addrLen
-	} else if atype == ATYPE_IPV6 {
-		addr = net.IP(message[index : index+16]).String()
-		index += 16
-	}
-	port := binary.BigEndian.Uint16(message[index : index+2])
-	index += 2
+	// replies always carry FRAG 0, keep a copy of the header so the
+	// datagram buffer is not shared with the remote reader
+	originHeader := append([]byte{}, message[:index]...)
+	originHeader[2] = 0x00
 	data := message[index:]
-	originHeader := message[0:index]
-	u.handleUdpPacket2(srcAddr, addr, port, data, originHeader)
-
+	frag, addr, port := header.Frag, header.Addr.Host(), header.Addr.Port
+	if frag != 0x00 {
+		var complete bool
+		complete, addr, port, data, originHeader = srcUdpInfo.reassemble(frag, addr, port, data, originHeader)
+		if !complete {
+			return
+		}
+	}
+	go u.handleUdpPacket2(srcAddr, srcUdpInfo, addr, port, data, originHeader)
 }
 
-func (u *UdpServer) handleUdpPacket2(srcAddr *net.UDPAddr, dstAddr string, port uint16, message []byte, originHeader []byte) {
-	srcUdpInfo := u.srcUdpMap.get(srcAddr)
-	laddr := srcUdpInfo.localAddr
-	var destAddr *net.UDPAddr
-	ua := dstAddr + ":" + strconv.Itoa(int(port))
+func (u *UdpServer) handleUdpPacket2(srcAddr *net.UDPAddr, srcUdpInfo *SrcUdpInfo, dstAddr string, port uint16, message []byte, originHeader []byte) {
+	ua := net.JoinHostPort(dstAddr, strconv.Itoa(int(port)))
 	remoteConn := srcUdpInfo.getRemoteConn(ua)
 	if remoteConn == nil {
-		destAddr, _ = net.ResolveUDPAddr("udp", ua)
-		udpCon, err := net.DialUDP("udp", laddr, destAddr)
+		udpCon, err := u.dial(srcUdpInfo.sess, "udp", dstAddr, port)
 		if err != nil {
-			logrus.Warningln("error connect " + dstAddr)
+			logrus.Warningln("error connect "+dstAddr, err)
 			return
 		}
-		remoteConn = udpCon
-		srcUdpInfo.addRemoteConn(ua, remoteConn)
-		if laddr == nil {
-			srcUdpInfo.setLocalAddr(udpCon.LocalAddr().(*net.UDPAddr))
+		if !srcUdpInfo.addRemoteConn(ua, udpCon) {
+			_ = udpCon.Close()
+			remoteConn = srcUdpInfo.getRemoteConn(ua)
+			if remoteConn == nil {
+				return
+			}
+		} else {
+			remoteConn = udpCon
+			go u.handleRemoteRead(srcAddr, udpCon, originHeader, ua, srcUdpInfo)
 		}
-		go u.handleRemoteRead(srcAddr, udpCon, originHeader, ua, srcUdpInfo)
 	}
 	_, err := remoteConn.Write(message)
 	if err != nil {
 		srcUdpInfo.deleteRemoteConn(ua)
 		return
 	}
-	srcUdpInfo.active()
 }
 
-func (u *UdpServer) handleRemoteRead(srcAddr *net.UDPAddr, udpCon *net.UDPConn,
+func (u *UdpServer) handleRemoteRead(srcAddr *net.UDPAddr, udpCon net.Conn,
 	originHeader []byte, key string, info *SrcUdpInfo) {
-	var b [65507]byte
+	var b [maxUdpData]byte
 	for {
 		err := udpCon.SetReadDeadline(time.Now().Add(time.Second * 100))
 		if err != nil {
@@ -169,7 +215,6 @@ func (u *UdpServer) handleRemoteRead(srcAddr *net.UDPAddr, udpCon *net.UDPConn,
 			logrus.Warningln("udp read error==========", err)
 			break
 		}
-		info.active()
 		buf := append(originHeader, b[:n]...)
 		_, err = u.serverConn.WriteToUDP(buf, srcAddr)
 		if err != nil {
@@ -182,55 +227,98 @@ func (u *UdpServer) handleRemoteRead(srcAddr *net.UDPAddr, udpCon *net.UDPConn,
 }
 
 type SrcUdpMap struct {
+	mu         sync.Mutex
 	associated map[string]*SrcUdpInfo // src string->src addr
+	pending    []*SrcUdpInfo          // associations waiting for their first datagram
 }
 
+// add register an association created by a UDP ASSOCIATE request
+func (u *SrcUdpMap) add(info *SrcUdpInfo) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.pending = append(u.pending, info)
+}
+
+// get find the association a datagram belongs to, the first datagram
+// matching a pending association binds it to its source address
 func (u *SrcUdpMap) get(srcAddr *net.UDPAddr) *SrcUdpInfo {
+	u.mu.Lock()
+	defer u.mu.Unlock()
 	src := srcAddr.String()
 	if u.associated[src] != nil {
 		return u.associated[src]
 	}
-	r := &SrcUdpInfo{
-		srcAddr:        srcAddr,
-		lastActiveTime: time.Now(),
-		localDestCon:   make(map[string]*net.UDPConn),
+	for i, info := range u.pending {
+		if info.match(srcAddr) {
+			u.pending = append(u.pending[:i], u.pending[i+1:]...)
+			info.srcAddr = srcAddr
+			u.associated[src] = info
+			return info
+		}
 	}
-	return r
-}
-
-func (u *SrcUdpMap) delete(srcAddr *net.UDPAddr) {
-	src := srcAddr.String()
-	delete(u.associated, src)
+	return nil
 }
 
-func (u *SrcUdpMap) timeout() {
-	for k, v := range u.associated {
-		if v.lastActiveTime.Add(time.Second * 100).Before(time.Now()) {
-			delete(u.associated, k)
-			v.Destroy()
-			logrus.Warningln("delete" + k)
+// delete forget an association, false when it was already gone
+func (u *SrcUdpMap) delete(info *SrcUdpInfo) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if info.srcAddr != nil {
+		key := info.srcAddr.String()
+		if u.associated[key] == info {
+			delete(u.associated, key)
+			return true
+		}
+		return false
+	}
+	for i, v := range u.pending {
+		if v == info {
+			u.pending = append(u.pending[:i], u.pending[i+1:]...)
+			return true
 		}
 	}
+	return false
 }
 
-type SrcUdpInfo struct {
-	srcAddr        *net.UDPAddr
-	localAddr      *net.UDPAddr
-	lastActiveTime time.Time
-	localDestCon   map[string]*net.UDPConn //  dst -> conn
+// all return every association, bound or pending
+func (u *SrcUdpMap) all() []*SrcUdpInfo {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	infos := append([]*SrcUdpInfo{}, u.pending...)
+	for _, info := range u.associated {
+		infos = append(infos, info)
+	}
+	return infos
 }
 
-func (u *SrcUdpInfo) setLocalAddr(localAddr *net.UDPAddr) {
-	u.localAddr = localAddr
-	u.lastActiveTime = time.Now()
-
+type SrcUdpInfo struct {
+	mu           sync.Mutex
+	sess         *session     // session of the tcp control connection
+	clientIP     net.IP       // ip of the tcp control connection
+	expectAddr   *net.UDPAddr // DST.ADDR and DST.PORT of the UDP ASSOCIATE request
+	srcAddr      *net.UDPAddr
+	localDestCon map[string]net.Conn //  dst -> conn
+	fragQueue    *fragQueue
 }
 
-func (u *SrcUdpInfo) active() {
-	u.lastActiveTime = time.Now()
+// match check a datagram source against the client ip and the
+// non zero parts of the UDP ASSOCIATE request
+func (u *SrcUdpInfo) match(srcAddr *net.UDPAddr) bool {
+	if !u.clientIP.Equal(srcAddr.IP) {
+		return false
+	}
+	if u.expectAddr == nil {
+		return true
+	}
+	if u.expectAddr.IP != nil && !u.expectAddr.IP.IsUnspecified() && !u.expectAddr.IP.Equal(srcAddr.IP) {
+		return false
+	}
+	return u.expectAddr.Port == 0 || u.expectAddr.Port == srcAddr.Port
 }
 
 func (u *SrcUdpInfo) deleteRemoteConn(remoteAddr string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
 	if c, ok := u.localDestCon[remoteAddr]; ok {
 		err := c.Close()
 		if err != nil {
@@ -240,11 +328,24 @@ func (u *SrcUdpInfo) deleteRemoteConn(remoteAddr string) {
 	}
 }
 
-func (u *SrcUdpInfo) addRemoteConn(remoteAddr string, con *net.UDPConn) {
+// addRemoteConn keep con unless the association is gone or
+// another datagram already connected to remoteAddr
+func (u *SrcUdpInfo) addRemoteConn(remoteAddr string, con net.Conn) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.localDestCon == nil {
+		return false
+	}
+	if _, ok := u.localDestCon[remoteAddr]; ok {
+		return false
+	}
 	u.localDestCon[remoteAddr] = con
+	return true
 }
 
-func (u *SrcUdpInfo) getRemoteConn(remoteAddr string) *net.UDPConn {
+func (u *SrcUdpInfo) getRemoteConn(remoteAddr string) net.Conn {
+	u.mu.Lock()
+	defer u.mu.Unlock()
 	if c, ok := u.localDestCon[remoteAddr]; ok {
 		return c
 	}
@@ -252,10 +353,97 @@ func (u *SrcUdpInfo) getRemoteConn(remoteAddr string) *net.UDPConn {
 }
 
 func (u *SrcUdpInfo) Destroy() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.resetFragQueue()
 	for _, v := range u.localDestCon {
 		err := v.Close()
 		if err != nil {
 			logrus.Warningln(err)
 		}
 	}
+	u.localDestCon = nil
+}
+
+/**
+  Implementation of fragmentation is optional; an implementation that
+  does not support fragmentation MUST drop any datagram whose FRAG
+  field is other than X'00'.
+
+  The FRAG field indicates whether or not this datagram is one of a
+  number of fragments.  If implemented, the high-order bit indicates
+  end-of-fragment sequence, while a value of X'00' indicates that this
+  datagram is standalone.  Values between 1 and 127 indicate the
+  fragment position within a fragment sequence.  Each receiver will
+  have a REASSEMBLY QUEUE and a REASSEMBLY TIMER associated with these
+  fragments.  The reassembly queue must be reinitialized and the
+  associated fragments abandoned whenever the REASSEMBLY TIMER expires,
+  or a new datagram arrives carrying a FRAG field whose value is less
+  than or equal to the highest FRAG value processed for this fragment
+  sequence.  The reassembly timer MUST be no less than 5 seconds.
+*/
+
+const (
+	fragTimeout = time.Second * 5
+	fragEnd     = 0x80
+	maxUdpData  = 65507
+)
+
+type fragQueue struct {
+	position     byte // highest FRAG position processed
+	addr         string
+	port         uint16
+	originHeader []byte
+	data         []byte
+	timer        *time.Timer
+}
+
+// reassemble queue a fragment, the payload and the destination of the
+// first fragment are returned once the end of the sequence arrives
+func (u *SrcUdpInfo) reassemble(frag byte, addr string, port uint16, data []byte,
+	originHeader []byte) (bool, string, uint16, []byte, []byte) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	position := frag &^ fragEnd
+	q := u.fragQueue
+	if q != nil && (position != q.position+1 || addr != q.addr || port != q.port) {
+		logrus.Warningln("udp fragment out of order, abandon sequence to " + q.addr)
+		u.resetFragQueue()
+		q = nil
+	}
+	if q == nil {
+		if position != 1 || u.localDestCon == nil {
+			return false, "", 0, nil, nil
+		}
+		q = &fragQueue{addr: addr, port: port, originHeader: originHeader}
+		q.timer = time.AfterFunc(fragTimeout, func() {
+			u.mu.Lock()
+			defer u.mu.Unlock()
+			if u.fragQueue == q {
+				logrus.Warningln("udp reassembly timeout, abandon sequence to " + q.addr)
+				u.fragQueue = nil
+			}
+		})
+		u.fragQueue = q
+	}
+	if len(q.data)+len(data) > maxUdpData {
+		logrus.Warningln("udp reassembly too large, abandon sequence to " + q.addr)
+		u.resetFragQueue()
+		return false, "", 0, nil, nil
+	}
+	q.position = position
+	q.data = append(q.data, data...)
+	if frag&fragEnd == 0 {
+		return false, "", 0, nil, nil
+	}
+	u.resetFragQueue()
+	return true, q.addr, q.port, q.data, q.originHeader
+}
+
+// resetFragQueue abandon the current fragment sequence, u.mu must be held
+func (u *SrcUdpInfo) resetFragQueue() {
+	if u.fragQueue != nil {
+		u.fragQueue.timer.Stop()
+		u.fragQueue = nil
+	}
 }
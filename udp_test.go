@@ -0,0 +1,278 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"mixed-socks/socks"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// newTestSession return a session on the server side of a loopback tcp
+// connection, closed with the test
+func newTestSession(t *testing.T) *session {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess := newSession(server, &serverSettings{})
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = sess.Close()
+	})
+	return sess
+}
+
+// newTestUdpServer start a udp relay on the loopback dialing targets
+// directly
+func newTestUdpServer(t *testing.T) *UdpServer {
+	t.Helper()
+	u := NewUdpServer(func(sess *session, network, addr string, port uint16) (net.Conn, error) {
+		return net.Dial(network, net.JoinHostPort(addr, strconv.Itoa(int(port))))
+	})
+	err := u.Listen(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go u.Serve()
+	t.Cleanup(u.Close)
+	return u
+}
+
+func udpDatagram(t *testing.T, frag byte, target net.Addr, data []byte) []byte {
+	t.Helper()
+	header, err := (&socks.UDPHeader{Frag: frag, Addr: socks.AddrFromNet(target)}).Append(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append(header, data...)
+}
+
+func TestUdpFragmentReassembly(t *testing.T) {
+	target, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	u := newTestUdpServer(t)
+	u.associate(newTestSession(t), "0.0.0.0", 0)
+	client, err := net.DialUDP("udp", nil, u.udpAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	tests := []struct {
+		name      string
+		fragments int
+	}{
+		{name: "end marker only", fragments: 1},
+		{name: "two fragments", fragments: 2},
+		{name: "ten fragments", fragments: 10},
+		{name: "max fragments", fragments: 127},
+	}
+	buf := make([]byte, maxUdpData)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// several sequences back to back so fragments racing each
+			// other would show
+			for round := 0; round < 20; round++ {
+				var want []byte
+				for i := 1; i <= tt.fragments; i++ {
+					chunk := []byte(strconv.Itoa(round) + "-" + strconv.Itoa(i) + ";")
+					want = append(want, chunk...)
+					frag := byte(i)
+					if i == tt.fragments {
+						frag |= fragEnd
+					}
+					_, err := client.Write(udpDatagram(t, frag, target.LocalAddr(), chunk))
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+				_ = target.SetReadDeadline(time.Now().Add(2 * time.Second))
+				n, _, err := target.ReadFromUDP(buf)
+				if err != nil {
+					t.Fatalf("round %d: %v", round, err)
+				}
+				if !bytes.Equal(buf[:n], want) {
+					t.Fatalf("round %d: got %q, want %q", round, buf[:n], want)
+				}
+			}
+		})
+	}
+}
+
+func TestUdpFragmentOutOfOrderDropped(t *testing.T) {
+	target, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	u := newTestUdpServer(t)
+	u.associate(newTestSession(t), "0.0.0.0", 0)
+	client, err := net.DialUDP("udp", nil, u.udpAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	for _, d := range [][]byte{
+		udpDatagram(t, 1, target.LocalAddr(), []byte("a")),
+		udpDatagram(t, 3|fragEnd, target.LocalAddr(), []byte("c")),
+		udpDatagram(t, 0, target.LocalAddr(), []byte("whole")),
+	} {
+		_, err := client.Write(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	buf := make([]byte, 64)
+	_ = target.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, _, err := target.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "whole" {
+		t.Errorf("got %q, want the standalone datagram only", buf[:n])
+	}
+}
+
+func TestSrcUdpInfoMatch(t *testing.T) {
+	client := net.IPv4(192, 0, 2, 1)
+	tests := []struct {
+		name   string
+		expect *net.UDPAddr
+		src    *net.UDPAddr
+		want   bool
+	}{
+		{name: "any", expect: &net.UDPAddr{IP: net.IPv4zero}, src: &net.UDPAddr{IP: client, Port: 5000}, want: true},
+		{name: "no expectation", src: &net.UDPAddr{IP: client, Port: 5000}, want: true},
+		{name: "other client ip", expect: &net.UDPAddr{IP: net.IPv4zero}, src: &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 5000}},
+		{name: "expected port", expect: &net.UDPAddr{IP: net.IPv4zero, Port: 5000}, src: &net.UDPAddr{IP: client, Port: 5000}, want: true},
+		{name: "other port", expect: &net.UDPAddr{IP: net.IPv4zero, Port: 5000}, src: &net.UDPAddr{IP: client, Port: 5001}},
+		{name: "expected ip", expect: &net.UDPAddr{IP: client}, src: &net.UDPAddr{IP: client, Port: 5000}, want: true},
+		{name: "expected ip not the client", expect: &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2)}, src: &net.UDPAddr{IP: client, Port: 5000}},
+		{name: "no ip expected", expect: &net.UDPAddr{Port: 5000}, src: &net.UDPAddr{IP: client, Port: 5000}, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info := &SrcUdpInfo{clientIP: client, expectAddr: tt.expect}
+			if got := info.match(tt.src); got != tt.want {
+				t.Errorf("match %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// newUdpEchoServer start a udp server on the loopback sending back what
+// it receives, closed with the test
+func newUdpEchoServer(t *testing.T) *net.UDPAddr {
+	t.Helper()
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = pc.Close()
+	})
+	go func() {
+		buf := make([]byte, maxUdpData)
+		for {
+			n, addr, err := pc.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			_, _ = pc.WriteToUDP(buf[:n], addr)
+		}
+	}()
+	return pc.LocalAddr().(*net.UDPAddr)
+}
+
+// udpRoundTrip send data to target through the relay and return the
+// data of the reply, nil when none arrives in time
+func udpRoundTrip(t *testing.T, client *net.UDPConn, target net.Addr, data []byte, timeout time.Duration) []byte {
+	t.Helper()
+	_, err := client.Write(udpDatagram(t, 0, target, data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, maxUdpData)
+	_ = client.SetReadDeadline(time.Now().Add(timeout))
+	n, err := client.Read(buf)
+	if err != nil {
+		return nil
+	}
+	_, index, err := socks.ParseUDPHeader(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf[index:n]
+}
+
+func TestUdpAssociationLifetime(t *testing.T) {
+	echo := newUdpEchoServer(t)
+	s := newTestServer(t)
+	client, err := net.DialUDP("udp", nil, s.udpServer.udpAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// no association yet, the datagram is dropped
+	if got := udpRoundTrip(t, client, echo, []byte("early"), 200*time.Millisecond); got != nil {
+		t.Fatalf("relayed %q without association", got)
+	}
+	control := udpAssociate(t, s.ln.Addr().String())
+	if got := udpRoundTrip(t, client, echo, []byte("ping"), 2*time.Second); string(got) != "ping" {
+		t.Fatalf("relayed %q, want ping", got)
+	}
+	if n := len(s.registry.List()); n != 1 {
+		t.Errorf("%d connections listed, want the association", n)
+	}
+
+	_ = control.Close()
+	waitSessions(t, s)
+	if n := len(s.udpServer.srcUdpMap.all()); n != 0 {
+		t.Fatalf("%d associations kept after the control connection closed", n)
+	}
+	if got := udpRoundTrip(t, client, echo, []byte("late"), 200*time.Millisecond); got != nil {
+		t.Errorf("relayed %q after the association ended", got)
+	}
+	if n := len(s.registry.List()); n != 0 {
+		t.Errorf("%d connections listed after the association ended", n)
+	}
+}
+
+func TestListenBindsUdpRelay(t *testing.T) {
+	for _, host := range []string{"127.0.0.1", "::1", ""} {
+		t.Run(host, func(t *testing.T) {
+			s := NewSocksServer(host, 0)
+			err := s.Listen(context.Background())
+			if err != nil {
+				if host == "::1" {
+					t.Skip("no ipv6 loopback:", err)
+				}
+				t.Fatal(err)
+			}
+			defer s.Close()
+			tcpAddr := s.ln.Addr().(*net.TCPAddr)
+			udpAddr := s.udpServer.udpAddr
+			if udpAddr.Port != tcpAddr.Port || !udpAddr.IP.Equal(tcpAddr.IP) {
+				t.Errorf("udp relay on %v, tcp listener on %v", udpAddr, tcpAddr)
+			}
+		})
+	}
+}
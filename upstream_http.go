@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// HTTPDialer connect through an upstream http proxy with CONNECT, tcp only
+type HTTPDialer struct {
+	addr     string
+	username string
+	password string
+	forward  Dialer
+}
+
+func (d *HTTPDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if network != "tcp" && network != "tcp4" && network != "tcp6" {
+		return nil, errors.New("http upstream does not support network " + network)
+	}
+	con, err := d.forward.DialContext(ctx, "tcp", d.addr)
+	if err != nil {
+		return nil, err
+	}
+	var reader *bufio.Reader
+	err = handshakeContext(ctx, con, func() error {
+		req := &http.Request{
+			Method: http.MethodConnect,
+			URL:    &url.URL{Opaque: address},
+			Host:   address,
+			Header: make(http.Header),
+		}
+		if d.username != "" {
+			credentials := base64.StdEncoding.EncodeToString([]byte(d.username + ":" + d.password))
+			req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+		}
+		err := req.Write(con)
+		if err != nil {
+			return err
+		}
+		reader = bufio.NewReader(con)
+		resp, err := http.ReadResponse(reader, req)
+		if err != nil {
+			return errors.New("read upstream response error:" + err.Error())
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return errors.New("upstream http proxy replied " + resp.Status)
+		}
+		return nil
+	})
+	if err != nil {
+		_ = con.Close()
+		return nil, err
+	}
+	if reader.Buffered() > 0 {
+		return &bufferedConn{Conn: con, r: reader}, nil
+	}
+	return con, nil
+}
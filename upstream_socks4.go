@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"mixed-socks/socks"
+	"net"
+	"strconv"
+)
+
+// Socks4Dialer connect through an upstream socks4 or socks4a proxy, tcp only
+type Socks4Dialer struct {
+	addr         string
+	userid       string
+	resolveLocal bool     // socks4:// resolve domains here, socks4a:// let the upstream do it
+	resolver     Resolver // of the domains resolved here, nil for the system resolver
+	forward      Dialer
+}
+
+func (d *Socks4Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if network != "tcp" && network != "tcp4" {
+		return nil, errors.New("socks4 upstream does not support network " + network)
+	}
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, errors.New("bad port " + portStr)
+	}
+	req := &socks.Request4{Command: CMD_CONNECT, Port: uint16(port), UserID: d.userid}
+	ip := net.ParseIP(host)
+	if ip == nil && d.resolveLocal {
+		ip, err = resolveIP(ctx, d.resolver, host, true)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if ip != nil {
+		req.IP = ip.To4()
+		if req.IP == nil {
+			return nil, errors.New("socks4 upstream can not reach ipv6 address " + host)
+		}
+	} else {
+		// socks4a, 0.0.0.x followed by the domain
+		req.Domain = host
+	}
+	msg, err := req.Append(nil)
+	if err != nil {
+		return nil, errors.New("bad socks4 request for " + address + ":" + err.Error())
+	}
+
+	con, err := d.forward.DialContext(ctx, "tcp", d.addr)
+	if err != nil {
+		return nil, err
+	}
+	err = handshakeContext(ctx, con, func() error {
+		_, err := con.Write(msg)
+		if err != nil {
+			return err
+		}
+		reply, err := socks.ReadReply4(con)
+		if err != nil {
+			return errors.New("read upstream reply error:" + err.Error())
+		}
+		if reply.Code != socks.REPLY4_GRANTED {
+			return errors.New("upstream socks4 reply " + strconv.Itoa(int(reply.Code)))
+		}
+		return nil
+	})
+	if err != nil {
+		_ = con.Close()
+		return nil, err
+	}
+	return con, nil
+}
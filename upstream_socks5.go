@@ -0,0 +1,235 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"mixed-socks/socks"
+	"net"
+	"strconv"
+)
+
+// Socks5Dialer connect through an upstream socks5 proxy, udp is relayed
+// with UDP ASSOCIATE
+type Socks5Dialer struct {
+	addr         string
+	username     string
+	password     string
+	resolveLocal bool     // socks5:// resolve domains here, socks5h:// let the upstream do it
+	resolver     Resolver // of the domains resolved here, nil for the system resolver
+	forward      Dialer
+}
+
+// socks5ReplyError is a request refused by the upstream, its reply code is
+// passed on to socks5 clients
+type socks5ReplyError struct {
+	rep byte
+}
+
+func (e *socks5ReplyError) Error() string {
+	return "upstream socks5 reply " + strconv.Itoa(int(e.rep))
+}
+
+func (d *Socks5Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		con, err := d.forward.DialContext(ctx, "tcp", d.addr)
+		if err != nil {
+			return nil, err
+		}
+		_, err = d.handshake(ctx, con, CMD_CONNECT, address)
+		if err != nil {
+			_ = con.Close()
+			return nil, err
+		}
+		return con, nil
+	case "udp", "udp4", "udp6":
+		return d.dialUDP(ctx, address)
+	}
+	return nil, errors.New("socks5 upstream does not support network " + network)
+}
+
+func (d *Socks5Dialer) dialUDP(ctx context.Context, address string) (net.Conn, error) {
+	con, err := d.forward.DialContext(ctx, "tcp", d.addr)
+	if err != nil {
+		return nil, err
+	}
+	bnd, err := d.handshake(ctx, con, CMD_UDP, "0.0.0.0:0")
+	if err != nil {
+		_ = con.Close()
+		return nil, err
+	}
+	if bnd.IP == nil || bnd.IP.IsUnspecified() {
+		// the relay lives on the upstream host
+		host, _, _ := net.SplitHostPort(d.addr)
+		bnd.IP, err = resolveIP(ctx, d.resolver, host, false)
+		if err != nil {
+			_ = con.Close()
+			return nil, err
+		}
+	}
+	relay, err := d.forward.DialContext(ctx, "udp", bnd.String())
+	if err != nil {
+		_ = con.Close()
+		return nil, err
+	}
+	header, err := d.udpHeader(ctx, address)
+	if err != nil {
+		_ = con.Close()
+		_ = relay.Close()
+		return nil, err
+	}
+	udpCon := &socks5UDPConn{Conn: relay, control: con, header: header}
+	go udpCon.watchControl()
+	return udpCon, nil
+}
+
+func (d *Socks5Dialer) udpHeader(ctx context.Context, address string) ([]byte, error) {
+	dst, err := d.targetAddr(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	return (&socks.UDPHeader{Addr: dst}).Append(nil)
+}
+
+// targetAddr is the DST.ADDR and DST.PORT of address, resolved here for
+// socks5://
+func (d *Socks5Dialer) targetAddr(ctx context.Context, address string) (socks.Addr, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return socks.Addr{}, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return socks.Addr{}, errors.New("bad port " + portStr)
+	}
+	if d.resolveLocal {
+		ip, err := resolveIP(ctx, d.resolver, host, false)
+		if err != nil {
+			return socks.Addr{}, err
+		}
+		host = ip.String()
+	}
+	dst, err := socks.NewAddr(host, uint16(port))
+	if err != nil {
+		return socks.Addr{}, errors.New("bad target " + address + ":" + err.Error())
+	}
+	return dst, nil
+}
+
+// handshake negotiate the auth method and send the request, the
+// BND.ADDR and BND.PORT of the reply are returned
+func (d *Socks5Dialer) handshake(ctx context.Context, con net.Conn, cmd byte, address string) (*net.UDPAddr, error) {
+	dst, err := d.targetAddr(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	bnd := &net.UDPAddr{}
+	err = handshakeContext(ctx, con, func() error {
+		methods := []byte{0x05, 0x01, METHOD_NO_AUTH}
+		if d.username != "" {
+			methods = []byte{0x05, 0x02, METHOD_NO_AUTH, METHOD_USER_PASS}
+		}
+		_, err := con.Write(methods)
+		if err != nil {
+			return err
+		}
+		buf := make([]byte, 256)
+		_, err = io.ReadFull(con, buf[:2])
+		if err != nil {
+			return errors.New("read upstream auth method error:" + err.Error())
+		}
+		if buf[0] != 0x05 {
+			return errors.New("upstream is not a socks5 server")
+		}
+		switch buf[1] {
+		case METHOD_NO_AUTH:
+		case METHOD_USER_PASS:
+			if len(d.username) > 255 || len(d.password) > 255 {
+				return errors.New("upstream username or password too long")
+			}
+			auth := []byte{0x01, byte(len(d.username))}
+			auth = append(auth, d.username...)
+			auth = append(auth, byte(len(d.password)))
+			auth = append(auth, d.password...)
+			_, err = con.Write(auth)
+			if err != nil {
+				return err
+			}
+			_, err = io.ReadFull(con, buf[:2])
+			if err != nil {
+				return errors.New("read upstream auth status error:" + err.Error())
+			}
+			if buf[1] != 0x00 {
+				return errors.New("upstream socks5 authentication failed")
+			}
+		default:
+			return errors.New("upstream socks5 requires an unsupported auth method")
+		}
+
+		req, err := (&socks.Request{Command: cmd, Addr: dst}).Append(nil)
+		if err != nil {
+			return err
+		}
+		_, err = con.Write(req)
+		if err != nil {
+			return err
+		}
+		reply, err := socks.ReadReply(con)
+		if err != nil {
+			return errors.New("read upstream reply error:" + err.Error())
+		}
+		if reply.Code != socks.REPLY_SUCCEEDED {
+			return &socks5ReplyError{rep: reply.Code}
+		}
+		bnd.IP, bnd.Port = reply.Addr.IP, int(reply.Addr.Port)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return bnd, nil
+}
+
+// socks5UDPConn relay the datagrams of one target through the udp
+// relay of an upstream socks5 proxy
+type socks5UDPConn struct {
+	net.Conn          // connected to the upstream relay
+	control  net.Conn // the association lives as long as this connection
+	header   []byte
+}
+
+func (c *socks5UDPConn) Write(b []byte) (int, error) {
+	buf := append(append([]byte{}, c.header...), b...)
+	_, err := c.Conn.Write(buf)
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *socks5UDPConn) Read(b []byte) (int, error) {
+	buf := make([]byte, maxUdpData)
+	for {
+		n, err := c.Conn.Read(buf)
+		if err != nil {
+			return 0, err
+		}
+		header, index, err := socks.ParseUDPHeader(buf[:n])
+		if err != nil || header.Frag != 0x00 {
+			continue
+		}
+		return copy(b, buf[index:n]), nil
+	}
+}
+
+func (c *socks5UDPConn) Close() error {
+	_ = c.control.Close()
+	return c.Conn.Close()
+}
+
+// watchControl close the relay when the upstream drops the association
+func (c *socks5UDPConn) watchControl() {
+	_, _ = io.Copy(io.Discard, c.control)
+	_ = c.Conn.Close()
+}
@@ -1,17 +1,76 @@
 package proxy
 
 import (
+	"bufio"
+	"context"
+	"errors"
+	"github.com/sirupsen/logrus"
+	"io"
 	"net"
+	"net/http"
+	"time"
 )
 
-func freePort() (int, error) {
-	addr, err := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
-	if err != nil {
-		return 0, err
+// bufferedConn serve reads from r first, so the bytes buffered
+// while parsing the http header are not lost
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// relay copy data both ways between the client of sess and dest until
+// one side is done or nothing is relayed for the idle timeout, dest is
+// closed along with the session which is listed in the registry meanwhile
+func (s *SocksServer) relay(sess *session, dest net.Conn) {
+	sess.addCloser(dest)
+	s.registry.add(sess)
+	defer s.registry.remove(sess)
+	_, upstream, _ := sess.route()
+	relays := metricRelays.WithLabelValues(sess.protocol, sess.user, upstream)
+	relays.Inc()
+	defer relays.Dec()
+	sess.lastActive.Store(time.Now().UnixNano())
+	idleDone := make(chan struct{})
+	defer close(idleDone)
+	go watchIdle(sess, idleDone)
+	con := sess.conn
+	forward := func(src net.Conn, dest net.Conn) {
+		defer func(src, dest net.Conn) {
+			_ = dest.Close()
+			_ = src.Close()
+		}(src, dest)
+		_, _ = io.Copy(dest, src)
 	}
-	l, err := net.Listen("tcp", addr.String())
+	done := make(chan struct{})
+	go func() {
+		forward(dest, con)
+		close(done)
+	}()
+	forward(con, dest)
+	<-done
+}
+
+// serveHTTP serve handler on addr in the background until ctx is done
+func serveHTTP(ctx context.Context, name, addr string, handler http.Handler) error {
+	ln, err := net.Listen("tcp", addr)
 	if err != nil {
-		return 0, err
+		return errors.New(name + " listen error:" + err.Error())
 	}
-	return l.Addr().(*net.TCPAddr).Port, nil
+	server := &http.Server{Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		_ = server.Close()
+	}()
+	logrus.Infoln("listen " + name + ":" + ln.Addr().String())
+	go func() {
+		err := server.Serve(ln)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logrus.Errorln(name+" server error", err)
+		}
+	}()
+	return nil
 }